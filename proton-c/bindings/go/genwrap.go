@@ -260,7 +260,7 @@ var (
 	enumDefRe   = regexp.MustCompile("typedef enum {([^}]*)} pn_([a-z_]+)_t;")
 	enumValRe   = regexp.MustCompile("PN_[A-Z_]+")
 	skipEventRe = regexp.MustCompile("EVENT_NONE|REACTOR|SELECTABLE|TIMER")
-	skipFnRe    = regexp.MustCompile("attach|context|class|collect|link_recv|link_send|transport_.*logf$|transport_.*trace|transport_head|transport_tail|transport_push|connection_set_password|link_get_drain")
+	skipFnRe    = regexp.MustCompile("attach|context|class|collect|link_recv|link_send|transport_.*logf$|transport_.*trace|transport_head|transport_tail|transport_push|connection_set_password|link_get_drain|link_flow$|link_drain$|transport_.*max_frame")
 )
 
 // Generate event wrappers.
@@ -347,9 +347,9 @@ func mapType(ctype string) (g genType) {
 	case "C.uint64_t":
 		g.Gotype = "uint64"
 	case "C.uint32_t":
-		g.Gotype = "uint16"
-	case "C.uint16_t":
 		g.Gotype = "uint32"
+	case "C.uint16_t":
+		g.Gotype = "uint16"
 	case "C.const char *":
 		fallthrough
 	case "C.char *":
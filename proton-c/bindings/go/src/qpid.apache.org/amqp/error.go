@@ -23,6 +23,7 @@ package amqp
 import "C"
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
 )
@@ -36,22 +37,43 @@ import (
 // You can also pass any Go error to such functions, the remote peer
 // will see the equivalent of MakeError(error)
 //
-type Error struct{ Name, Description string }
+// Errors received from the remote peer, for example the outcome of a rejected
+// delivery or the condition of a closed link, are returned as Error values.
+// Use IsCondition() or helpers like IsNotFound() to check the condition name.
+//
+// Note: because of the Info map, Error values are not comparable with ==.
+// Use IsCondition() to check the name, or reflect.DeepEqual() to compare.
+type Error struct {
+	Name, Description string
+	// Info is the optional AMQP condition info map of extra diagnostic
+	// information, for example the names of invalid fields when rejecting a
+	// message. It is nil if the condition has no info.
+	Info Map
+}
 
 // Error implements the Go error interface for AMQP error errors.
-func (c Error) Error() string { return fmt.Sprintf("%s: %s", c.Name, c.Description) }
+func (c Error) Error() string {
+	if len(c.Info) > 0 {
+		return fmt.Sprintf("%s: %s %v", c.Name, c.Description, c.Info)
+	}
+	return fmt.Sprintf("%s: %s", c.Name, c.Description)
+}
 
 // Errorf makes a Error with name and formatted description as per fmt.Sprintf
 func Errorf(name, format string, arg ...interface{}) Error {
-	return Error{name, fmt.Sprintf(format, arg...)}
+	return Error{Name: name, Description: fmt.Sprintf(format, arg...)}
 }
 
 // MakeError makes an AMQP error from a go error using the Go error type as the name
 // and the err.Error() string as the description.
 func MakeError(err error) Error {
-	return Error{reflect.TypeOf(err).Name(), err.Error()}
+	return Error{Name: reflect.TypeOf(err).Name(), Description: err.Error()}
 }
 
+// ErrAborted is returned when reading a delivery that the sender aborted
+// before it was complete.
+var ErrAborted = errors.New("delivery aborted by sender")
+
 var (
 	InternalError         = "amqp:internal-error"
 	NotFound              = "amqp:not-found"
@@ -66,8 +88,37 @@ var (
 	ResourceDeleted       = "amqp:resource-deleted"
 	IllegalState          = "amqp:illegal-state"
 	FrameSizeTooSmall     = "amqp:frame-size-too-small"
+
+	// Connection error conditions
+	ConnectionForced       = "amqp:connection:forced"
+	ConnectionFramingError = "amqp:connection:framing-error"
+	ConnectionRedirect     = "amqp:connection:redirect"
+
+	// Link error conditions
+	LinkDetachForced          = "amqp:link:detach-forced"
+	LinkTransferLimitExceeded = "amqp:link:transfer-limit-exceeded"
+	LinkMessageSizeExceeded   = "amqp:link:message-size-exceeded"
+	LinkRedirect              = "amqp:link:redirect"
+	LinkStolen                = "amqp:link:stolen"
 )
 
+// IsCondition returns true if err is an Error with the given condition name.
+func IsCondition(err error, name string) bool {
+	e, ok := err.(Error)
+	return ok && e.Name == name
+}
+
+// IsNotFound returns true if err is an Error with condition NotFound.
+func IsNotFound(err error) bool { return IsCondition(err, NotFound) }
+
+// IsResourceLimitExceeded returns true if err is an Error with condition
+// ResourceLimitExceeded. This is normally a transient condition, the operation
+// may succeed if retried later.
+func IsResourceLimitExceeded(err error) bool { return IsCondition(err, ResourceLimitExceeded) }
+
+// IsUnauthorizedAccess returns true if err is an Error with condition UnauthorizedAccess.
+func IsUnauthorizedAccess(err error) bool { return IsCondition(err, UnauthorizedAccess) }
+
 type PnErrorCode int
 
 func (e PnErrorCode) String() string {
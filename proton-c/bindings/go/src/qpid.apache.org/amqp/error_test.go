@@ -0,0 +1,54 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package amqp
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestIsCondition(t *testing.T) {
+	err := error(Errorf(NotFound, "no such queue %v", "q"))
+	if !IsNotFound(err) || !IsCondition(err, NotFound) {
+		t.Errorf("expected not-found: %v", err)
+	}
+	if IsResourceLimitExceeded(err) || IsUnauthorizedAccess(err) {
+		t.Errorf("wrong condition: %v", err)
+	}
+	if IsNotFound(fmt.Errorf("%s: not an amqp.Error", NotFound)) {
+		t.Error("plain error should not match")
+	}
+	if !IsResourceLimitExceeded(Errorf(ResourceLimitExceeded, "full")) {
+		t.Error("expected resource-limit-exceeded")
+	}
+}
+
+func TestErrorInfo(t *testing.T) {
+	err := error(Error{InvalidField, "bad fields", Map{"fields": List{"a", "b"}}})
+	if !IsCondition(err, InvalidField) || IsNotFound(err) {
+		t.Errorf("wrong condition: %v", err)
+	}
+	if _, ok := err.(Error); !ok {
+		t.Errorf("want amqp.Error, got %T", err)
+	}
+	if s := err.Error(); s != "amqp:invalid-field: bad fields map[fields:[a b]]" {
+		t.Errorf("bad error string %q", s)
+	}
+}
@@ -129,6 +129,33 @@ func TestPrimitivesExact(t *testing.T) {
 	checkDecode(d, float64(0.125), &f64, t)
 }
 
+func TestDecoderMore(t *testing.T) {
+	want := []interface{}{Described{Symbol("a"), int32(1)}, Described{uint64(2), "b"}, "c"}
+	var data []byte
+	for _, v := range want {
+		b, err := Marshal(v, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, b...)
+	}
+	d := NewDecoder(bytes.NewReader(data))
+	var got []interface{}
+	for d.More() {
+		var v interface{}
+		if err := d.Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, v)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("%#v != %#v", want, got)
+	}
+	if d.More() {
+		t.Error("expected no more data")
+	}
+}
+
 func TestPrimitivesCompatible(t *testing.T) {
 	d := NewDecoder(getReader(t, "primitives"))
 	// Decoding into compatible types
@@ -0,0 +1,286 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package amqp
+
+// #include <proton/message.h>
+import "C"
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// maxJSONInt is the largest integer a JSON number holds exactly as a float64.
+const maxJSONInt = 1 << 53
+
+// jsonValue converts an AMQP value to a value that encoding/json renders as
+// its JSON equivalent:
+//
+//   - maps are objects, keys that are not strings or symbols are rendered with fmt.Sprint
+//   - lists and arrays are arrays
+//   - strings and symbols are strings, a char is a single character string
+//   - binary is a base64 encoded string
+//   - timestamps are RFC3339 strings
+//   - UUIDs are strings in the canonical 8-4-4-4-12 form
+//   - described values are objects {"descriptor": ..., "value": ...}
+//   - 64-bit integers with magnitude greater than 2^53 are decimal strings, JSON
+//     numbers are float64 and would lose precision
+//
+// Returns an error for values with no JSON equivalent, for example NaN.
+func jsonValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case nil, bool, string, int8, int16, int32, uint8, uint16, uint32:
+		return v, nil
+	case int64:
+		return jsonInt(v), nil
+	case int:
+		return jsonInt(int64(v)), nil
+	case uint64:
+		if v > maxJSONInt {
+			return strconv.FormatUint(v, 10), nil
+		}
+		return v, nil
+	case uint:
+		return jsonValue(uint64(v))
+	case float32:
+		return jsonFloat(float64(v))
+	case float64:
+		return jsonFloat(v)
+	case Symbol:
+		return string(v), nil
+	case Char:
+		return string(rune(v)), nil
+	case Binary:
+		return base64.StdEncoding.EncodeToString([]byte(v)), nil
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case UUID:
+		return v.String(), nil
+	case AnnotationKey:
+		return jsonValue(v.Get())
+	case Described:
+		d, err := jsonValue(v.Descriptor)
+		if err != nil {
+			return nil, err
+		}
+		value, err := jsonValue(v.Value)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"descriptor": d, "value": value}, nil
+	case Array:
+		return jsonValue(v.Values)
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Map:
+		obj := make(map[string]interface{}, rv.Len())
+		for _, k := range rv.MapKeys() {
+			value, err := jsonValue(rv.MapIndex(k).Interface())
+			if err != nil {
+				return nil, err
+			}
+			obj[jsonKey(k.Interface())] = value
+		}
+		return obj, nil
+	case reflect.Slice, reflect.Array:
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			value, err := jsonValue(rv.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			list[i] = value
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("cannot convert %T to JSON", v)
+}
+
+func jsonInt(i int64) interface{} {
+	if i > maxJSONInt || i < -maxJSONInt {
+		return strconv.FormatInt(i, 10)
+	}
+	return i
+}
+
+func jsonFloat(f float64) (interface{}, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("cannot convert %v to JSON", f)
+	}
+	return f, nil
+}
+
+// jsonKey converts a map key to a JSON object key.
+func jsonKey(k interface{}) string {
+	switch k := k.(type) {
+	case string:
+		return k
+	case Symbol:
+		return string(k)
+	case AnnotationKey:
+		return jsonKey(k.Get())
+	default:
+		return fmt.Sprint(k)
+	}
+}
+
+func (m *message) BodyJSON() ([]byte, error) {
+	v, err := jsonValue(m.Body())
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// MarshalJSON renders the message as a JSON object with the message
+// properties that are set, using their AMQP field names, and the body.
+func (m *message) MarshalJSON() ([]byte, error) {
+	obj := map[string]interface{}{}
+	set := func(name string, v interface{}, isSet bool) {
+		if isSet {
+			obj[name] = v
+		}
+	}
+	set("durable", m.Durable(), m.Durable())
+	set("priority", m.Priority(), m.Priority() != C.PN_DEFAULT_PRIORITY)
+	set("ttl", m.TTL().Nanoseconds()/int64(time.Millisecond), m.TTL() != 0)
+	set("first-acquirer", m.FirstAcquirer(), m.FirstAcquirer())
+	set("delivery-count", m.DeliveryCount(), m.DeliveryCount() != 0)
+	set("message-id", m.MessageId(), m.MessageId() != nil)
+	set("user-id", m.UserId(), m.UserId() != "")
+	set("to", m.Address(), m.Address() != "")
+	set("subject", m.Subject(), m.Subject() != "")
+	set("reply-to", m.ReplyTo(), m.ReplyTo() != "")
+	set("correlation-id", m.CorrelationId(), m.CorrelationId() != nil)
+	set("content-type", m.ContentType(), m.ContentType() != "")
+	set("content-encoding", m.ContentEncoding(), m.ContentEncoding() != "")
+	set("absolute-expiry-time", m.ExpiryTime(), !m.ExpiryTime().IsZero())
+	set("creation-time", m.CreationTime(), !m.CreationTime().IsZero())
+	set("group-id", m.GroupId(), m.GroupId() != "")
+	set("group-sequence", m.GroupSequence(), m.GroupSequence() != 0)
+	set("reply-to-group-id", m.ReplyToGroupId(), m.ReplyToGroupId() != "")
+	set("message-annotations", m.MessageAnnotations(), len(m.MessageAnnotations()) > 0)
+	set("application-properties", m.ApplicationProperties(), len(m.ApplicationProperties()) > 0)
+	set("body", m.Body(), true)
+	v, err := jsonValue(obj)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// JSONHeaders is the key of a top-level JSON object member that holds the
+// application-properties of a message, see MessageFromJSON()
+const JSONHeaders = "_headers"
+
+// MessageFromJSON makes a message with a body converted from the JSON
+// document in data. Objects become Map with string keys, arrays become List,
+// strings and bools are unchanged, null is nil. Integers become the narrowest of
+// int8, int16, int32 or int64 that holds them, or uint64 if too large for
+// int64. Other numbers become float64.
+//
+// If the document is an object with a JSONHeaders member, that member must be
+// an object of simple values. It is removed from the body and becomes the
+// application-properties of the message.
+//
+// The conversion is the reverse of Message.BodyJSON() for maps, lists, strings,
+// bools and integers that fit in int64, but the AMQP types are not preserved:
+// symbols, binary and timestamps become strings and integers become the
+// narrowest type. Returns an error if data is not valid JSON.
+func MessageFromJSON(data []byte) (Message, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, fmt.Errorf("invalid JSON message: %v", err)
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, fmt.Errorf("invalid JSON message: unexpected data after JSON value")
+	}
+	m := NewMessage()
+	if obj, ok := v.(map[string]interface{}); ok {
+		if h, ok := obj[JSONHeaders]; ok {
+			headers, ok := h.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("invalid JSON message: %s is not an object", JSONHeaders)
+			}
+			props := make(map[string]interface{}, len(headers))
+			for k, v := range headers {
+				switch v.(type) {
+				case map[string]interface{}, []interface{}:
+					return nil, fmt.Errorf("invalid JSON message: %s %q is not a simple value", JSONHeaders, k)
+				}
+				props[k] = fromJSON(v)
+			}
+			m.SetApplicationProperties(props)
+			delete(obj, JSONHeaders)
+		}
+	}
+	m.SetBody(fromJSON(v))
+	return m, nil
+}
+
+// fromJSON converts a value decoded by encoding/json with UseNumber to an AMQP value.
+func fromJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(Map, len(v))
+		for k, x := range v {
+			m[k] = fromJSON(x)
+		}
+		return m
+	case []interface{}:
+		l := make(List, len(v))
+		for i, x := range v {
+			l[i] = fromJSON(x)
+		}
+		return l
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			switch {
+			case i >= math.MinInt8 && i <= math.MaxInt8:
+				return int8(i)
+			case i >= math.MinInt16 && i <= math.MaxInt16:
+				return int16(i)
+			case i >= math.MinInt32 && i <= math.MaxInt32:
+				return int32(i)
+			default:
+				return i
+			}
+		}
+		if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return u
+		}
+		f, _ := v.Float64() // Valid JSON number, error only if out of range.
+		return f
+	default:
+		return v
+	}
+}
@@ -26,6 +26,9 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"sort"
+	"strings"
+	"time"
 	"unsafe"
 )
 
@@ -85,6 +88,8 @@ Go types are encoded as follows
  +-------------------------------------+--------------------------------------------+
  |Symbol                               |symbol                                      |
  +-------------------------------------+--------------------------------------------+
+ |Char                                 |char                                        |
+ +-------------------------------------+--------------------------------------------+
  |interface{}                          |the contained type                          |
  +-------------------------------------+--------------------------------------------+
  |nil                                  |null                                        |
@@ -93,20 +98,38 @@ Go types are encoded as follows
  +-------------------------------------+--------------------------------------------+
  |Map                                  |map, may have mixed types for keys, values  |
  +-------------------------------------+--------------------------------------------+
+ |OrderedMap                           |map with entries in slice order             |
+ +-------------------------------------+--------------------------------------------+
  |[]T                                  |list with T converted as above              |
  +-------------------------------------+--------------------------------------------+
  |List                                 |list, may have mixed types  values          |
  +-------------------------------------+--------------------------------------------+
+ |Array                                |array of values of Array.Type               |
+ +-------------------------------------+--------------------------------------------+
  |Described                            |described type                              |
  +-------------------------------------+--------------------------------------------+
+ |struct                               |map with string keys, see below             |
+ +-------------------------------------+--------------------------------------------+
 
-The following Go types cannot be marshaled: uintptr, function, channel, array (use slice), struct
+A struct is encoded as an AMQP map with a string key for each exported field,
+nested structs are encoded as nested maps. Unexported fields are skipped. The
+key and encoding can be controlled with an "amqp" field tag, similar to encoding/json:
 
-TODO: Not yet implemented:
+	Name  string `amqp:"name"`            // key is "name"
+	Count int    `amqp:"count,omitempty"` // omitted if zero/empty
+	Extra string `amqp:"-"`               // not encoded
+
+A pointer is encoded as the value it points to, a nil pointer is encoded as null.
 
-Go types: struct, complex64/128.
+The entries of a Go map or Map are encoded in a fixed order of their keys, so
+equal maps have the same encoding. Keys are ordered by Go type name, then by
+their fmt.Sprint value. Use OrderedMap to choose the order.
 
-AMQP types: decimal32/64/128, char, timestamp, uuid, array.
+The following Go types cannot be marshaled: uintptr, function, channel, array (use slice)
+
+TODO: Not yet implemented:
+
+Go types: complex64/128.
 */
 func Marshal(v interface{}, buffer []byte) (outbuf []byte, err error) {
 	defer recoverMarshal(&err)
@@ -203,12 +226,36 @@ func marshal(v interface{}, data *C.pn_data_t) {
 		C.pn_data_put_binary(data, pnBytes([]byte(v)))
 	case Symbol:
 		C.pn_data_put_symbol(data, pnBytes([]byte(v)))
+	case Char:
+		C.pn_data_put_char(data, C.pn_char_t(v))
+	case Decimal32:
+		C.pn_data_put_decimal32(data, C.pn_decimal32_t(v))
+	case Decimal64:
+		C.pn_data_put_decimal64(data, C.pn_decimal64_t(v))
+	case Decimal128:
+		C.pn_data_put_decimal128(data, pnDecimal128(v))
+	case time.Time:
+		C.pn_data_put_timestamp(data, pnTime(v))
+	case UUID:
+		C.pn_data_put_uuid(data, pnUUID(v))
 	case Map: // Special map type
+		keys := make([]interface{}, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		C.pn_data_put_map(data)
+		C.pn_data_enter(data)
+		for _, i := range keyOrder(keys) {
+			marshal(keys[i], data)
+			marshal(v[keys[i]], data)
+		}
+		C.pn_data_exit(data)
+	case OrderedMap:
 		C.pn_data_put_map(data)
 		C.pn_data_enter(data)
-		for key, val := range v {
-			marshal(key, data)
-			marshal(val, data)
+		for _, e := range v {
+			marshal(e.Key, data)
+			marshal(e.Value, data)
 		}
 		C.pn_data_exit(data)
 	case Described:
@@ -219,12 +266,22 @@ func marshal(v interface{}, data *C.pn_data_t) {
 		C.pn_data_exit(data)
 	case AnnotationKey:
 		marshal(v.Get(), data)
+	case Array:
+		putArray(data, v)
 	default:
 		switch reflect.TypeOf(v).Kind() {
 		case reflect.Map:
 			putMap(data, v)
 		case reflect.Slice:
 			putList(data, v)
+		case reflect.Struct:
+			putStruct(data, v)
+		case reflect.Ptr:
+			if ptr := reflect.ValueOf(v); ptr.IsNil() {
+				C.pn_data_put_null(data)
+			} else {
+				marshal(ptr.Elem().Interface(), data)
+			}
 		default:
 			panic(newMarshalError(v, "no conversion"))
 		}
@@ -242,15 +299,33 @@ func clearMarshal(v interface{}, data *C.pn_data_t) {
 
 func putMap(data *C.pn_data_t, v interface{}) {
 	mapValue := reflect.ValueOf(v)
+	keyValues := mapValue.MapKeys()
+	keys := make([]interface{}, len(keyValues))
+	for i, key := range keyValues {
+		keys[i] = key.Interface()
+	}
 	C.pn_data_put_map(data)
 	C.pn_data_enter(data)
-	for _, key := range mapValue.MapKeys() {
-		marshal(key.Interface(), data)
-		marshal(mapValue.MapIndex(key).Interface(), data)
+	for _, i := range keyOrder(keys) {
+		marshal(keys[i], data)
+		marshal(mapValue.MapIndex(keyValues[i]).Interface(), data)
 	}
 	C.pn_data_exit(data)
 }
 
+// keyOrder returns the indexes of map keys in encoding order: by Go type name,
+// then by fmt.Sprint value.
+func keyOrder(keys []interface{}) []int {
+	order := make([]string, len(keys))
+	index := make([]int, len(keys))
+	for i, k := range keys {
+		order[i] = fmt.Sprintf("%T\x00%v", k, k)
+		index[i] = i
+	}
+	sort.Slice(index, func(i, j int) bool { return order[index[i]] < order[index[j]] })
+	return index
+}
+
 func putList(data *C.pn_data_t, v interface{}) {
 	listValue := reflect.ValueOf(v)
 	C.pn_data_put_list(data)
@@ -261,6 +336,90 @@ func putList(data *C.pn_data_t, v interface{}) {
 	C.pn_data_exit(data)
 }
 
+func putArray(data *C.pn_data_t, v Array) {
+	if v.Type == DescribedType {
+		panic(newMarshalError(v, "array of described values is not supported"))
+	}
+	C.pn_data_put_array(data, false, C.pn_type_t(v.Type))
+	C.pn_data_enter(data)
+	for _, value := range v.Values {
+		marshal(value, data)
+		if t := Type(C.pn_data_type(data)); t != v.Type {
+			panic(newMarshalError(v, fmt.Sprintf("%s value in array of %s", t, v.Type)))
+		}
+	}
+	C.pn_data_exit(data)
+}
+
+func putStruct(data *C.pn_data_t, v interface{}) {
+	structValue := reflect.ValueOf(v)
+	C.pn_data_put_map(data)
+	C.pn_data_enter(data)
+	for _, f := range structFields(structValue.Type()) {
+		fieldValue := structValue.Field(f.index)
+		if f.omitEmpty && isEmptyValue(fieldValue) {
+			continue
+		}
+		marshal(f.name, data)
+		marshal(fieldValue.Interface(), data)
+	}
+	C.pn_data_exit(data)
+}
+
+// structField describes how a struct field is encoded as a map entry.
+type structField struct {
+	index     int
+	name      string
+	omitEmpty bool
+}
+
+// structFields returns the encoded fields of struct type t, in field order.
+func structFields(t reflect.Type) (fields []structField) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" { // Unexported
+			continue
+		}
+		f := structField{index: i, name: sf.Name}
+		tag := sf.Tag.Get("amqp")
+		if tag == "-" {
+			continue
+		}
+		if tag != "" {
+			parts := strings.Split(tag, ",")
+			if parts[0] != "" {
+				f.name = parts[0]
+			}
+			for _, opt := range parts[1:] {
+				if opt == "omitempty" {
+					f.omitEmpty = true
+				}
+			}
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// isEmptyValue uses the same definition of "empty" as encoding/json omitempty.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
 // Encoder encodes AMQP values to an io.Writer
 type Encoder struct {
 	writer io.Writer
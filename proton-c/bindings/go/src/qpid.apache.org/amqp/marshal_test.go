@@ -20,6 +20,8 @@ under the License.
 package amqp
 
 import (
+	"bytes"
+	"fmt"
 	"testing"
 )
 
@@ -45,6 +47,22 @@ func TestSymbolKey(t *testing.T) {
 
 }
 
+// Symbols and strings are distinct types, they keep their type in a round trip.
+func TestSymbolMapKey(t *testing.T) {
+	m := Map{Symbol("x-opt-key"): Symbol("symbol"), "x-opt-key": "string"}
+	bytes, err := Marshal(m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v interface{}
+	if _, err := Unmarshal(bytes, &v); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual(m, v); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestStringKey(t *testing.T) {
 	bytes, err := Marshal(AnnotationKeyString("foo"), nil)
 	if err != nil {
@@ -88,3 +106,166 @@ func TestIntKey(t *testing.T) {
 	}
 
 }
+
+type testInner struct {
+	Id   uint64 `amqp:"id"`
+	Tags []string
+}
+
+type testStruct struct {
+	Name    string    `amqp:"name"`
+	Count   int32     `amqp:"count,omitempty"`
+	Skip    string    `amqp:"-"`
+	Inner   testInner `amqp:"inner"`
+	Any     interface{}
+	private int
+}
+
+func TestStruct(t *testing.T) {
+	in := testStruct{Name: "x", Skip: "skip", Inner: testInner{Id: 42, Tags: []string{"a", "b"}}, Any: Symbol("s"), private: 1}
+	bytes, err := Marshal(in, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Fields appear as a map keyed by tag or field name, empty/skipped fields omitted.
+	var m Map
+	if _, err := Unmarshal(bytes, &m); err != nil {
+		t.Fatal(err)
+	}
+	want := Map{"name": "x", "inner": Map{"id": uint64(42), "Tags": List{"a", "b"}}, "Any": Symbol("s")}
+	if err := checkEqual(want, m); err != nil {
+		t.Error(err)
+	}
+
+	var out testStruct
+	if _, err := Unmarshal(bytes, &out); err != nil {
+		t.Fatal(err)
+	}
+	in.Skip, in.private = "", 0
+	if err := checkEqual(in, out); err != nil {
+		t.Error(err)
+	}
+
+	// Symbol keys match, unknown keys are ignored.
+	bytes, err = Marshal(Map{Symbol("name"): "y", Symbol("count"): int32(3), "unknown": true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = testStruct{}
+	if _, err := Unmarshal(bytes, &out); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual(testStruct{Name: "y", Count: 3}, out); err != nil {
+		t.Error(err)
+	}
+
+	// Non-map data cannot unmarshal to a struct.
+	bytes, _ = Marshal("foo", nil)
+	if _, err := Unmarshal(bytes, &out); err == nil {
+		t.Error("expected error unmarshaling string to struct")
+	}
+}
+
+type testPointers struct {
+	Inner *testInner `amqp:"inner"`
+	Name  *string    `amqp:"name"`
+}
+
+func TestStructPointers(t *testing.T) {
+	name := "x"
+	in := &testPointers{Inner: &testInner{Id: 7, Tags: []string{"a"}}, Name: &name}
+	bytes, err := Marshal(in, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Map
+	if _, err := Unmarshal(bytes, &m); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual(Map{"inner": Map{"id": uint64(7), "Tags": List{"a"}}, "name": "x"}, m); err != nil {
+		t.Error(err)
+	}
+	var out testPointers // Nil pointers are allocated
+	if _, err := Unmarshal(bytes, &out); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual(in, &out); err != nil {
+		t.Error(err)
+	}
+
+	// Nil pointers are encoded as null and decode to nil.
+	bytes, err = Marshal(testPointers{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = nil
+	if _, err := Unmarshal(bytes, &m); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual(Map{"inner": nil, "name": nil}, m); err != nil {
+		t.Error(err)
+	}
+	if _, err := Unmarshal(bytes, &out); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual(testPointers{}, out); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMapOrder(t *testing.T) {
+	m := Map{}
+	sm := map[string]int{}
+	for i := 0; i < 20; i++ {
+		m[int64(i)] = int64(i)
+		m[fmt.Sprint(i)] = int64(i)
+		sm[fmt.Sprint(i)] = i
+	}
+	m[nil] = "null key"
+	first, err := Marshal(m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sfirst, err := Marshal(sm, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if b, _ := Marshal(m, nil); !bytes.Equal(first, b) {
+			t.Fatal("Map encoding is not deterministic")
+		}
+		if b, _ := Marshal(sm, nil); !bytes.Equal(sfirst, b) {
+			t.Fatal("map encoding is not deterministic")
+		}
+	}
+	var m2 Map
+	if _, err := Unmarshal(first, &m2); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual(m, m2); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOrderedMap(t *testing.T) {
+	om := OrderedMap{{"z", int64(1)}, {Symbol("a"), "x"}, {int32(3), nil}, {"m", List{"l"}}}
+	b, err := Marshal(om, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var om2 OrderedMap
+	if _, err := Unmarshal(b, &om2); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual(om, om2); err != nil {
+		t.Error(err)
+	}
+	// Also decodes as a plain map.
+	var m Map
+	if _, err := Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual(Map{"z": int64(1), Symbol("a"): "x", int32(3): nil, "m": List{"l"}}, m); err != nil {
+		t.Error(err)
+	}
+}
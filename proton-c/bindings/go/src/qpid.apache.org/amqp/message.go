@@ -32,11 +32,22 @@ package amqp
 //     return result;
 // }
 //
+// /* Set an empty, not absent, user id */
+// int msg_set_empty_user_id(pn_message_t* m) {
+//     pn_bytes_t b = { 0, "" };
+//     return pn_message_set_user_id(m, b);
+// }
+//
 import "C"
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"math"
+	"reflect"
 	"runtime"
+	"strings"
 	"time"
 )
 
@@ -53,7 +64,9 @@ type Message interface {
 	Priority() uint8
 	SetPriority(uint8)
 
-	// TTL or Time To Live, a message it may be dropped after this duration
+	// TTL or Time To Live, a message it may be dropped after this duration.
+	// A zero TTL means the message does not expire. The TTL must not be
+	// negative, Encode returns an error if a negative TTL was set.
 	TTL() time.Duration
 	SetTTL(time.Duration)
 
@@ -65,26 +78,41 @@ type Message interface {
 	FirstAcquirer() bool
 	SetFirstAcquirer(bool)
 
-	// DeliveryCount tracks how many attempts have been made to
-	// delivery a message.
+	// DeliveryCount is the number of earlier unsuccessful attempts to deliver
+	// the message. It is 0 for a first delivery, including when the sender
+	// omitted the header: 0 is the AMQP default.
 	DeliveryCount() uint32
 	SetDeliveryCount(uint32)
 
 	// MessageId provides a unique identifier for a message.
 	// it can be an a string, an unsigned long, a uuid or a
-	// binary value.
+	// binary value. A uuid is represented as UUID.
+	//
+	// The AMQP type is preserved: set a string, uint64, UUID or Binary and
+	// MessageId() returns the same type after the message is decoded.
 	MessageId() interface{}
 	SetMessageId(interface{})
 
+	// MessageIdString renders MessageId() as a string, see IdString().
+	MessageIdString() string
+
+	// UserId is the identity of the user that produced the message. It is
+	// encoded as AMQP binary, the string can hold any bytes, use
+	// []byte(m.UserId()) to get the raw value.
 	UserId() string
 	SetUserId(string)
 
+	// Address is the AMQP "to" field, the address of the node the message is
+	// destined for.
 	Address() string
 	SetAddress(string)
 
+	// Subject is an application-defined summary of the message, for example
+	// for routing or dispatching.
 	Subject() string
 	SetSubject(string)
 
+	// ReplyTo is the address of the node to send replies to.
 	ReplyTo() string
 	SetReplyTo(string)
 
@@ -93,36 +121,87 @@ type Message interface {
 	CorrelationId() interface{}
 	SetCorrelationId(interface{})
 
+	// CorrelationIdString renders CorrelationId() as a string, see IdString().
+	CorrelationIdString() string
+
+	// ContentType is the MIME type of the body, for example "application/json".
+	// It is encoded as a symbol. "" means not set, SetContentType("") removes
+	// the content type from the message.
 	ContentType() string
 	SetContentType(string)
 
+	// ContentEncoding is the encoding applied to the body, for example "gzip".
+	// It is encoded as a symbol. "" means not set, SetContentEncoding("")
+	// removes the content encoding from the message.
 	ContentEncoding() string
 	SetContentEncoding(string)
 
 	// ExpiryTime indicates an absoulte time when the message may be dropped.
 	// A Zero time (i.e. t.isZero() == true) indicates a message never expires.
+	// Times are stored with millisecond precision.
 	ExpiryTime() time.Time
 	SetExpiryTime(time.Time)
 
+	// CreationTime is the time the message was created, millisecond precision.
+	// A Zero time indicates the creation time is not set.
 	CreationTime() time.Time
 	SetCreationTime(time.Time)
 
+	// Expired is true if the ExpiryTime has passed. If there is no ExpiryTime
+	// but there is a TTL and a CreationTime, it is true if the TTL has passed
+	// since the CreationTime. It is false for a message with no expiry
+	// information.
+	Expired() bool
+
+	// GroupId identifies the group a message belongs to. Related messages with
+	// the same group id can be processed in order, for example by one worker.
 	GroupId() string
 	SetGroupId(string)
 
-	GroupSequence() int32
-	SetGroupSequence(int32)
+	// GroupSequence is the position of the message in its group. It is an AMQP
+	// sequence-no, that wraps around from math.MaxUint32 to 0, use
+	// SequenceLess to compare sequence numbers.
+	GroupSequence() uint32
+	SetGroupSequence(uint32)
 
+	// ReplyToGroupId is the group id for replies to this message.
 	ReplyToGroupId() string
 	SetReplyToGroupId(string)
 
+	// HasProperty is true if field is present in the message. The string
+	// accessors such as Subject() return "" both for an absent field and a field
+	// set to "", HasProperty tells them apart. Setting a field, even to "",
+	// makes it present. A new message has no fields present, and Decode()
+	// preserves which fields were present in the encoded message.
+	HasProperty(field PropertyField) bool
+	// ClearProperty removes field from the message, so it is not encoded.
+	ClearProperty(field PropertyField)
+
 	// Property map set by the application to be carried with the message.
-	// Values must be simple types (not maps, lists or sequences)
+	// Values must be simple types (not maps, lists or sequences), Encode
+	// returns an error if there are invalid values.
+	//
+	// A key with an explicit AMQP null value is in the map with a nil value,
+	// an absent key is not in the map. Use ApplicationProperty() to tell them
+	// apart, and set a nil value to encode a null.
 	ApplicationProperties() map[string]interface{}
 	SetApplicationProperties(map[string]interface{})
 
+	// ApplicationProperty returns a single application property value,
+	// and false if there is no such property.
+	ApplicationProperty(key string) (interface{}, bool)
+	SetApplicationProperty(key string, v interface{})
+
+	// Typed application property values. Return an error if there is no such
+	// property or it does not have the expected type. ApplicationPropertyInt
+	// accepts any AMQP integer type that fits in an int64.
+	ApplicationPropertyString(key string) (string, error)
+	ApplicationPropertyInt(key string) (int64, error)
+	ApplicationPropertyBool(key string) (bool, error)
+
 	// Per-delivery annotations to provide delivery instructions.
 	// May be added or removed by intermediaries during delivery.
+	// Annotation keys are symbols or ulongs, see AnnotationKey.
 	DeliveryAnnotations() map[AnnotationKey]interface{}
 	SetDeliveryAnnotations(map[AnnotationKey]interface{})
 
@@ -131,36 +210,108 @@ type Message interface {
 	MessageAnnotations() map[AnnotationKey]interface{}
 	SetMessageAnnotations(map[AnnotationKey]interface{})
 
+	// Footer annotations are encoded in a section after the body,
+	// for example message hashes or signatures.
+	Footer() map[AnnotationKey]interface{}
+	SetFooter(map[AnnotationKey]interface{})
+
 	// Inferred indicates how the message content
 	// is encoded into AMQP sections. If inferred is true then binary and
 	// list values in the body of the message will be encoded as AMQP DATA
 	// and AMQP SEQUENCE sections, respectively. If inferred is false,
 	// then all values in the body of the message will be encoded as AMQP
 	// VALUE sections regardless of their type.
+	//
+	// For example a []byte body is encoded as a DATA section if Inferred() is
+	// true and as an AMQP VALUE holding a binary if it is false. Values that are
+	// not binary or list are always encoded as AMQP VALUE. Decode() sets
+	// Inferred() to show how the sender framed the body.
 	Inferred() bool
 	SetInferred(bool)
 
 	// Marshal a Go value into the message body. See amqp.Marshal() for details.
 	Marshal(interface{})
 
+	// SetBody sets the body to a single value, encoded as an AMQP VALUE section.
+	// Equivalent to m.Marshal(v); m.SetInferred(false)
+	SetBody(v interface{})
+
+	// SetSequence sets the body to a list of values, encoded as an AMQP SEQUENCE section.
+	// Equivalent to m.Marshal(List(v)); m.SetInferred(true)
+	SetSequence(v []interface{})
+
+	// SetData sets the body to binary data, encoded as an AMQP DATA section.
+	// Equivalent to m.Marshal(Binary(v)); m.SetInferred(true)
+	SetData(v []byte)
+
 	// Unmarshal the message body into the value pointed to by v. See amqp.Unmarshal() for details.
-	Unmarshal(interface{})
+	// Returns an error if the body can't be decoded or does not match v.
+	Unmarshal(interface{}) error
 
 	// Body value resulting from the default unmarshalling of message body as interface{}
 	Body() interface{}
 
+	// BodyJSON renders Body() as JSON. Maps are objects, symbols are strings,
+	// binary is base64, timestamps are RFC3339 strings and described values
+	// are {"descriptor": ..., "value": ...} objects. Conversion is lossy: the
+	// AMQP type is not recorded, and 64-bit integers with magnitude greater
+	// than 2^53 are rendered as decimal strings since a JSON number cannot hold
+	// them exactly. Returns an error for values with no JSON equivalent, for
+	// example NaN.
+	BodyJSON() ([]byte, error)
+
+	// MarshalJSON implements json.Marshaler. The message is an object with the
+	// properties that are set, using the AMQP field names, and a "body"
+	// converted as for BodyJSON.
+	MarshalJSON() ([]byte, error)
+
+	// EncodedSize returns the number of bytes Encode would return, without
+	// encoding the message into a buffer.
+	EncodedSize() (int, error)
+
 	// Encode encodes the message as AMQP data. If buffer is non-nil and is large enough
 	// the message is encoded into it, otherwise a new buffer is created.
 	// Returns the buffer containing the message.
+	//
+	// The header section is omitted if all the header fields have their
+	// default values.
 	Encode(buffer []byte) ([]byte, error)
 
 	// Decode data into this message. Overwrites an existing message content.
+	// Inferred() is true if the body was a DATA or SEQUENCE section, so
+	// the type of body section is preserved if the message is re-encoded.
+	// A body of several DATA sections is decoded as a single Binary value,
+	// the sections joined in order.
 	Decode(buffer []byte) error
 
+	// DecodeLimited is like Decode but returns an error instead of decoding data
+	// that is larger than maxBytes or has more than maxElements AMQP values.
+	//
+	// Use it for data from untrusted sources. Decoding allocates memory in
+	// proportion to the encoded size plus a fixed amount per value, some values
+	// (for example an array of nulls) take no space at all when encoded. The limits
+	// are checked by scanning data before it is decoded.
+	DecodeLimited(buffer []byte, maxElements, maxBytes int) error
+
+	// DecodeSectionLimited is like Decode but returns an error naming the
+	// section instead of decoding data with a section larger than its limit, see
+	// SectionLimits. The limits are checked by scanning the section headers
+	// before data is decoded.
+	DecodeSectionLimited(buffer []byte, limits SectionLimits) error
+
+	// DecodeCheckIds is like Decode but also checks the types of the
+	// message-id and correlation-id, which AMQP restricts to ulong, uuid,
+	// binary or string. Decode accepts an id of any type, for example a list
+	// sent by a faulty peer. DecodeCheckIds returns an error naming the field
+	// instead, unless lenient is true: then the id is replaced by the string
+	// IdString(id) so the message can still be processed.
+	DecodeCheckIds(buffer []byte, lenient bool) error
+
 	// Clear the message contents.
 	Clear()
 
-	// Copy the contents of another message to this one.
+	// Copy the contents of another message to this one. The copy is a deep
+	// copy, it shares no memory with m.
 	Copy(m Message) error
 
 	// Deprecated: use DeliveryAnnotations() for a more type-safe interface
@@ -176,16 +327,24 @@ type Message interface {
 	SetProperties(v map[string]interface{})
 }
 
-type message struct{ pn *C.pn_message_t }
+type message struct {
+	pn      *C.pn_message_t
+	footer  *C.pn_data_t // pn_message_t does not handle the footer section
+	ttlErr  error        // Error from setting an invalid TTL, returned by Encode()
+	propErr error        // Error from setting invalid application properties, returned by Encode()
+	body    []byte       // Encoded body sections from NewMessageBytes, nil if the body is in pn
+}
 
 func freeMessage(m *message) {
 	C.pn_message_free(m.pn)
+	C.pn_data_free(m.footer)
 	m.pn = nil
+	m.footer = nil
 }
 
 // NewMessage creates a new message instance.
 func NewMessage() Message {
-	m := &message{C.pn_message()}
+	m := &message{pn: C.pn_message(), footer: C.pn_data(0)}
 	runtime.SetFinalizer(m, freeMessage)
 	return m
 }
@@ -198,7 +357,53 @@ func NewMessageWith(value interface{}) Message {
 	return m
 }
 
-func (m *message) Clear() { C.pn_message_clear(m.pn) }
+// NewMessageBytes creates a message from encoded message data, for example
+// from proton.Delivery.RawBytes(), without decoding the body. The other
+// sections are decoded as usual, so a forwarder can inspect or change the
+// annotations and properties and send the message on with the original body
+// bytes. Encode() writes the body sections verbatim unless the body is
+// replaced, for example by SetBody() or Marshal().
+//
+// Body() and Unmarshal() decode the body sections each time they are called.
+// encoded is copied, it can be re-used when NewMessageBytes returns.
+func NewMessageBytes(encoded []byte) (Message, error) {
+	sections, err := splitSections(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("decoding message: %s", err)
+	}
+	var other, body []byte
+	inferred := false
+	for _, s := range sections {
+		switch s.code {
+		case dataCode, sequenceCode, valueCode:
+			if body == nil {
+				inferred = s.code != valueCode
+			}
+			body = append(body, s.bytes...)
+		default:
+			other = append(other, s.bytes...)
+		}
+	}
+	m := NewMessage().(*message)
+	if len(other) > 0 {
+		if err := m.Decode(other); err != nil {
+			return nil, err
+		}
+	}
+	if body != nil {
+		m.SetInferred(inferred)
+		m.body = body
+	}
+	return m, nil
+}
+
+func (m *message) Clear() {
+	C.pn_message_clear(m.pn)
+	C.pn_data_clear(m.footer)
+	m.ttlErr = nil
+	m.propErr = nil
+	m.body = nil
+}
 
 func (m *message) Copy(x Message) error {
 	if data, err := x.Encode(nil); err == nil {
@@ -208,6 +413,58 @@ func (m *message) Copy(x Message) error {
 	}
 }
 
+// PropertyField identifies a string field of the AMQP properties section, for
+// Message.HasProperty and Message.ClearProperty.
+//
+// Other properties don't need it: MessageId() and CorrelationId() are nil if
+// absent, and "" is not a valid ContentType() or ContentEncoding() so setting
+// "" removes them.
+type PropertyField int
+
+const (
+	PropertyUserId PropertyField = iota
+	PropertyAddress
+	PropertySubject
+	PropertyReplyTo
+	PropertyGroupId
+	PropertyReplyToGroupId
+)
+
+func (m *message) HasProperty(field PropertyField) bool {
+	switch field {
+	case PropertyUserId:
+		return C.pn_message_get_user_id(m.pn).start != nil
+	case PropertyAddress:
+		return C.pn_message_get_address(m.pn) != nil
+	case PropertySubject:
+		return C.pn_message_get_subject(m.pn) != nil
+	case PropertyReplyTo:
+		return C.pn_message_get_reply_to(m.pn) != nil
+	case PropertyGroupId:
+		return C.pn_message_get_group_id(m.pn) != nil
+	case PropertyReplyToGroupId:
+		return C.pn_message_get_reply_to_group_id(m.pn) != nil
+	}
+	return false
+}
+
+func (m *message) ClearProperty(field PropertyField) {
+	switch field {
+	case PropertyUserId:
+		C.pn_message_set_user_id(m.pn, C.pn_bytes_t{0, nil})
+	case PropertyAddress:
+		C.pn_message_set_address(m.pn, nil)
+	case PropertySubject:
+		C.pn_message_set_subject(m.pn, nil)
+	case PropertyReplyTo:
+		C.pn_message_set_reply_to(m.pn, nil)
+	case PropertyGroupId:
+		C.pn_message_set_group_id(m.pn, nil)
+	case PropertyReplyToGroupId:
+		C.pn_message_set_reply_to_group_id(m.pn, nil)
+	}
+}
+
 // ==== message get functions
 
 func rewindGet(data *C.pn_data_t) (v interface{}) {
@@ -223,26 +480,66 @@ func (m *message) Priority() uint8 { return uint8(C.pn_message_get_priority(m.pn
 func (m *message) TTL() time.Duration {
 	return time.Duration(C.pn_message_get_ttl(m.pn)) * time.Millisecond
 }
-func (m *message) FirstAcquirer() bool        { return bool(C.pn_message_is_first_acquirer(m.pn)) }
-func (m *message) DeliveryCount() uint32      { return uint32(C.pn_message_get_delivery_count(m.pn)) }
-func (m *message) MessageId() interface{}     { return rewindGet(C.pn_message_id(m.pn)) }
-func (m *message) UserId() string             { return goString(C.pn_message_get_user_id(m.pn)) }
-func (m *message) Address() string            { return C.GoString(C.pn_message_get_address(m.pn)) }
-func (m *message) Subject() string            { return C.GoString(C.pn_message_get_subject(m.pn)) }
-func (m *message) ReplyTo() string            { return C.GoString(C.pn_message_get_reply_to(m.pn)) }
-func (m *message) CorrelationId() interface{} { return rewindGet(C.pn_message_correlation_id(m.pn)) }
-func (m *message) ContentType() string        { return C.GoString(C.pn_message_get_content_type(m.pn)) }
-func (m *message) ContentEncoding() string    { return C.GoString(C.pn_message_get_content_encoding(m.pn)) }
+func (m *message) FirstAcquirer() bool         { return bool(C.pn_message_is_first_acquirer(m.pn)) }
+func (m *message) DeliveryCount() uint32       { return uint32(C.pn_message_get_delivery_count(m.pn)) }
+func (m *message) MessageId() interface{}      { return rewindGet(C.pn_message_id(m.pn)) }
+func (m *message) UserId() string              { return goString(C.pn_message_get_user_id(m.pn)) }
+func (m *message) Address() string             { return C.GoString(C.pn_message_get_address(m.pn)) }
+func (m *message) Subject() string             { return C.GoString(C.pn_message_get_subject(m.pn)) }
+func (m *message) ReplyTo() string             { return C.GoString(C.pn_message_get_reply_to(m.pn)) }
+func (m *message) CorrelationId() interface{}  { return rewindGet(C.pn_message_correlation_id(m.pn)) }
+func (m *message) MessageIdString() string     { return IdString(m.MessageId()) }
+func (m *message) CorrelationIdString() string { return IdString(m.CorrelationId()) }
+func (m *message) ContentType() string         { return C.GoString(C.pn_message_get_content_type(m.pn)) }
+func (m *message) ContentEncoding() string {
+	return C.GoString(C.pn_message_get_content_encoding(m.pn))
+}
+
+// SequenceLess is true if sequence number a comes before b, using the serial
+// number arithmetic of RFC-1982 that AMQP uses for a sequence-no. Sequence
+// numbers wrap around, so math.MaxUint32 comes before 0.
+func SequenceLess(a, b uint32) bool { return int32(a-b) < 0 }
+
+// IdString renders a message-id or correlation-id as a string for logging: a
+// string as is, an unsigned long in decimal, a UUID in the canonical
+// 8-4-4-4-12 form and binary in hexadecimal. A missing id is "".
+//
+// Different ids can have the same string, for example "1" and uint64(1). To
+// use ids as map keys use the value returned by MessageId() or
+// CorrelationId(), which is a valid map key for all id types.
+func IdString(id interface{}) string {
+	switch id := id.(type) {
+	case nil:
+		return ""
+	case string:
+		return id
+	case Binary:
+		return fmt.Sprintf("%x", string(id))
+	case []byte:
+		return fmt.Sprintf("%x", id)
+	default:
+		return fmt.Sprint(id)
+	}
+}
 
 func (m *message) ExpiryTime() time.Time {
-	return time.Unix(0, int64(time.Millisecond*time.Duration(C.pn_message_get_expiry_time(m.pn))))
+	return goTime(C.pn_message_get_expiry_time(m.pn))
 }
 func (m *message) CreationTime() time.Time {
-	return time.Unix(0, int64(time.Millisecond)*int64(C.pn_message_get_creation_time(m.pn)))
+	return goTime(C.pn_message_get_creation_time(m.pn))
+}
+func (m *message) Expired() bool {
+	expiry := m.ExpiryTime()
+	if ttl, created := m.TTL(), m.CreationTime(); expiry.IsZero() && ttl > 0 && !created.IsZero() {
+		expiry = created.Add(ttl)
+	}
+	return !expiry.IsZero() && time.Now().After(expiry)
+}
+func (m *message) GroupId() string       { return C.GoString(C.pn_message_get_group_id(m.pn)) }
+func (m *message) GroupSequence() uint32 { return uint32(C.pn_message_get_group_sequence(m.pn)) }
+func (m *message) ReplyToGroupId() string {
+	return C.GoString(C.pn_message_get_reply_to_group_id(m.pn))
 }
-func (m *message) GroupId() string        { return C.GoString(C.pn_message_get_group_id(m.pn)) }
-func (m *message) GroupSequence() int32   { return int32(C.pn_message_get_group_sequence(m.pn)) }
-func (m *message) ReplyToGroupId() string { return C.GoString(C.pn_message_get_reply_to_group_id(m.pn)) }
 
 func getAnnotations(data *C.pn_data_t) (v map[AnnotationKey]interface{}) {
 	C.pn_data_rewind(data)
@@ -257,6 +554,7 @@ func (m *message) DeliveryAnnotations() map[AnnotationKey]interface{} {
 func (m *message) MessageAnnotations() map[AnnotationKey]interface{} {
 	return getAnnotations(C.pn_message_annotations(m.pn))
 }
+func (m *message) Footer() map[AnnotationKey]interface{} { return getAnnotations(m.footer) }
 
 func (m *message) ApplicationProperties() map[string]interface{} {
 	var v map[string]interface{}
@@ -267,6 +565,75 @@ func (m *message) ApplicationProperties() map[string]interface{} {
 	return v
 }
 
+func (m *message) ApplicationProperty(key string) (interface{}, bool) {
+	v, ok := m.ApplicationProperties()[key]
+	return v, ok
+}
+
+func (m *message) applicationProperty(key string) (interface{}, error) {
+	if v, ok := m.ApplicationProperty(key); ok {
+		return v, nil
+	}
+	return nil, fmt.Errorf("no application property %q", key)
+}
+
+func propertyTypeError(key string, v interface{}, want string) error {
+	return fmt.Errorf("application property %q is %T, not %s", key, v, want)
+}
+
+func (m *message) ApplicationPropertyString(key string) (string, error) {
+	v, err := m.applicationProperty(key)
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case Symbol:
+		return string(v), nil
+	}
+	if err == nil {
+		err = propertyTypeError(key, v, "string")
+	}
+	return "", err
+}
+
+func (m *message) ApplicationPropertyInt(key string) (int64, error) {
+	v, err := m.applicationProperty(key)
+	switch v := v.(type) {
+	case int8:
+		return int64(v), nil
+	case int16:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case uint8:
+		return int64(v), nil
+	case uint16:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case uint64:
+		if v <= math.MaxInt64 {
+			return int64(v), nil
+		}
+	}
+	if err == nil {
+		err = propertyTypeError(key, v, "int64")
+	}
+	return 0, err
+}
+
+func (m *message) ApplicationPropertyBool(key string) (bool, error) {
+	v, err := m.applicationProperty(key)
+	if b, ok := v.(bool); ok {
+		return b, nil
+	}
+	if err == nil {
+		err = propertyTypeError(key, v, "bool")
+	}
+	return false, err
+}
+
 // ==== message set methods
 
 func setData(v interface{}, data *C.pn_data_t) {
@@ -278,12 +645,23 @@ func (m *message) SetInferred(b bool)  { C.pn_message_set_inferred(m.pn, C.bool(
 func (m *message) SetDurable(b bool)   { C.pn_message_set_durable(m.pn, C.bool(b)) }
 func (m *message) SetPriority(b uint8) { C.pn_message_set_priority(m.pn, C.uint8_t(b)) }
 func (m *message) SetTTL(d time.Duration) {
+	if d < 0 {
+		m.ttlErr = fmt.Errorf("invalid TTL %v, must not be negative", d)
+		return
+	}
+	m.ttlErr = nil
 	C.pn_message_set_ttl(m.pn, C.pn_millis_t(d/time.Millisecond))
 }
 func (m *message) SetFirstAcquirer(b bool)     { C.pn_message_set_first_acquirer(m.pn, C.bool(b)) }
 func (m *message) SetDeliveryCount(c uint32)   { C.pn_message_set_delivery_count(m.pn, C.uint32_t(c)) }
 func (m *message) SetMessageId(id interface{}) { setData(id, C.pn_message_id(m.pn)) }
-func (m *message) SetUserId(s string)          { C.pn_message_set_user_id(m.pn, pnBytes(([]byte)(s))) }
+func (m *message) SetUserId(s string) {
+	if s == "" {
+		C.msg_set_empty_user_id(m.pn)
+		return
+	}
+	C.pn_message_set_user_id(m.pn, pnBytes(([]byte)(s)))
+}
 func (m *message) SetAddress(s string) {
 	C.msg_set_str(m.pn, C.CString(s), C.set_fn(C.pn_message_set_address))
 }
@@ -295,9 +673,17 @@ func (m *message) SetReplyTo(s string) {
 }
 func (m *message) SetCorrelationId(c interface{}) { setData(c, C.pn_message_correlation_id(m.pn)) }
 func (m *message) SetContentType(s string) {
+	if s == "" { // An empty MIME type is not valid, don't encode it.
+		C.pn_message_set_content_type(m.pn, nil)
+		return
+	}
 	C.msg_set_str(m.pn, C.CString(s), C.set_fn(C.pn_message_set_content_type))
 }
 func (m *message) SetContentEncoding(s string) {
+	if s == "" {
+		C.pn_message_set_content_encoding(m.pn, nil)
+		return
+	}
 	C.msg_set_str(m.pn, C.CString(s), C.set_fn(C.pn_message_set_content_encoding))
 }
 func (m *message) SetExpiryTime(t time.Time)   { C.pn_message_set_expiry_time(m.pn, pnTime(t)) }
@@ -305,7 +691,7 @@ func (m *message) SetCreationTime(t time.Time) { C.pn_message_set_creation_time(
 func (m *message) SetGroupId(s string) {
 	C.msg_set_str(m.pn, C.CString(s), C.set_fn(C.pn_message_set_group_id))
 }
-func (m *message) SetGroupSequence(s int32) {
+func (m *message) SetGroupSequence(s uint32) {
 	C.pn_message_set_group_sequence(m.pn, C.pn_sequence_t(s))
 }
 func (m *message) SetReplyToGroupId(s string) {
@@ -318,14 +704,40 @@ func (m *message) SetDeliveryAnnotations(v map[AnnotationKey]interface{}) {
 func (m *message) SetMessageAnnotations(v map[AnnotationKey]interface{}) {
 	setData(v, C.pn_message_annotations(m.pn))
 }
+func (m *message) SetFooter(v map[AnnotationKey]interface{}) { setData(v, m.footer) }
 func (m *message) SetApplicationProperties(v map[string]interface{}) {
-	setData(v, C.pn_message_properties(m.pn))
+	data := C.pn_message_properties(m.pn)
+	setData(v, data)
+	m.propErr = checkProperties(data)
+}
+func (m *message) SetApplicationProperty(key string, v interface{}) {
+	properties := m.ApplicationProperties()
+	if properties == nil {
+		properties = make(map[string]interface{})
+	}
+	properties[key] = v
+	m.SetApplicationProperties(properties)
 }
 
 // Marshal/Unmarshal body
-func (m *message) Marshal(v interface{})   { clearMarshal(v, C.pn_message_body(m.pn)) }
-func (m *message) Unmarshal(v interface{}) { rewindUnmarshal(v, C.pn_message_body(m.pn)) }
-func (m *message) Body() (v interface{})   { m.Unmarshal(&v); return }
+func (m *message) Marshal(v interface{}) { m.body = nil; clearMarshal(v, C.pn_message_body(m.pn)) }
+func (m *message) Unmarshal(v interface{}) (err error) {
+	if m.body != nil { // From NewMessageBytes, decode a message with only the body sections
+		b, err := DecodeMessage(m.body)
+		if err != nil {
+			return err
+		}
+		return b.Unmarshal(v)
+	}
+	defer recoverUnmarshal(&err)
+	rewindUnmarshal(v, C.pn_message_body(m.pn))
+	return nil
+}
+func (m *message) Body() (v interface{}) { m.Unmarshal(&v); return }
+
+func (m *message) SetBody(v interface{})       { m.Marshal(v); m.SetInferred(false) }
+func (m *message) SetSequence(v []interface{}) { m.Marshal(List(v)); m.SetInferred(true) }
+func (m *message) SetData(v []byte)            { m.Marshal(Binary(v)); m.SetInferred(true) }
 
 func (m *message) Decode(data []byte) error {
 	m.Clear()
@@ -335,6 +747,124 @@ func (m *message) Decode(data []byte) error {
 	if C.pn_message_decode(m.pn, cPtr(data), cLen(data)) < 0 {
 		return fmt.Errorf("decoding message: %s", PnError(C.pn_message_error(m.pn)))
 	}
+	// pn_message_decode does not report the body section type or decode the
+	// footer. It has already validated the message, so this scan only reads
+	// section headers (descriptor and value size), not section contents. If the
+	// scan fails the message is still accepted, with no footer.
+	//
+	// pn_message_decode keeps only one of several data sections, the scan joins
+	// them into a single body.
+	body := false
+	var joined []byte
+	sections := 0
+	for len(data) > 0 {
+		s, err := nextSection(data)
+		if err != nil {
+			break
+		}
+		if s.code == dataCode {
+			if b, err := dataBytes(s); err == nil {
+				joined = append(joined, b...)
+				sections++
+			}
+		}
+		switch {
+		case !body && (s.code == dataCode || s.code == sequenceCode || s.code == valueCode):
+			m.SetInferred(s.code != valueCode)
+			body = true
+		case s.code == footerCode:
+			value := s.bytes[s.value:]
+			if n := C.pn_data_decode(m.footer, cPtr(value), cLen(value)); n < 0 {
+				return fmt.Errorf("decoding message footer: %s", PnErrorCode(n))
+			}
+		}
+		data = data[len(s.bytes):]
+	}
+	if sections > 1 {
+		m.SetData(joined)
+	}
+	return nil
+}
+
+func (m *message) DecodeLimited(data []byte, maxElements, maxBytes int) error {
+	if len(data) > maxBytes {
+		m.Clear()
+		return fmt.Errorf("decoding message: %d bytes, limit is %d", len(data), maxBytes)
+	}
+	n := 0
+	for rest := data; len(rest) > 0; {
+		size, err := countValue(rest, &n, maxElements)
+		if err != nil {
+			m.Clear()
+			return fmt.Errorf("decoding message: %s", err)
+		}
+		rest = rest[size:]
+	}
+	return m.Decode(data)
+}
+
+// SectionLimits are the maximum encoded sizes in bytes of each message
+// section for DecodeSectionLimited. A limit of 0 means no limit. Body limits
+// the total size of the body sections.
+type SectionLimits struct {
+	Header, DeliveryAnnotations, MessageAnnotations, Properties, ApplicationProperties, Body, Footer int
+}
+
+func (m *message) DecodeSectionLimited(data []byte, limits SectionLimits) error {
+	sizes := make(map[uint64]int)
+	for rest := data; len(rest) > 0; {
+		s, err := nextSection(rest)
+		if err != nil {
+			m.Clear()
+			return fmt.Errorf("decoding message: %s", err)
+		}
+		switch s.code {
+		case dataCode, sequenceCode:
+			s.code = valueCode // Count all body sections together
+		}
+		sizes[s.code] += len(s.bytes)
+		rest = rest[len(s.bytes):]
+	}
+	for _, l := range []struct {
+		name  string
+		code  uint64
+		limit int
+	}{
+		{"header", headerCode, limits.Header},
+		{"delivery-annotations", deliveryAnnotationsCode, limits.DeliveryAnnotations},
+		{"message-annotations", messageAnnotationsCode, limits.MessageAnnotations},
+		{"properties", propertiesCode, limits.Properties},
+		{"application-properties", applicationPropertiesCode, limits.ApplicationProperties},
+		{"body", valueCode, limits.Body},
+		{"footer", footerCode, limits.Footer},
+	} {
+		if size := sizes[l.code]; l.limit > 0 && size > l.limit {
+			m.Clear()
+			return fmt.Errorf("decoding message: %s section is %d bytes, limit is %d", l.name, size, l.limit)
+		}
+	}
+	return m.Decode(data)
+}
+
+func (m *message) DecodeCheckIds(data []byte, lenient bool) error {
+	if err := m.Decode(data); err != nil {
+		return err
+	}
+	for _, id := range []struct {
+		name string
+		data *C.pn_data_t
+	}{
+		{"message-id", C.pn_message_id(m.pn)},
+		{"correlation-id", C.pn_message_correlation_id(m.pn)},
+	} {
+		if err := checkId(id.data); err != nil {
+			if !lenient {
+				m.Clear()
+				return fmt.Errorf("decoding message: properties %s %s", id.name, err)
+			}
+			setData(IdString(rewindGet(id.data)), id.data)
+		}
+	}
 	return nil
 }
 
@@ -345,6 +875,9 @@ func DecodeMessage(data []byte) (m Message, err error) {
 }
 
 func (m *message) Encode(buffer []byte) ([]byte, error) {
+	if err := m.validate(); err != nil {
+		return nil, fmt.Errorf("cannot encode message: %s", err)
+	}
 	encode := func(buf []byte) ([]byte, error) {
 		len := cLen(buf)
 		result := C.pn_message_encode(m.pn, cPtr(buf), &len)
@@ -357,11 +890,594 @@ func (m *message) Encode(buffer []byte) ([]byte, error) {
 			return buf[:len], nil
 		}
 	}
-	return encodeGrow(buffer, encode)
+	buffer, err := encodeGrow(buffer, encode)
+	if err == nil && m.defaultHeader() {
+		// proton always encodes the header section first, remove it.
+		var n int
+		if n, err = encodedSize(buffer); err == nil {
+			buffer = buffer[:copy(buffer, buffer[n:])]
+		}
+	}
+	if err == nil && m.body != nil {
+		// pn has no body, it follows the other sections and precedes the footer.
+		buffer = append(buffer, m.body...)
+	}
+	if err == nil && C.pn_data_size(m.footer) > 0 {
+		buffer, err = m.encodeFooter(buffer)
+	}
+	return buffer, err
+}
+
+func (m *message) EncodedSize() (int, error) {
+	if err := m.validate(); err != nil {
+		return 0, fmt.Errorf("cannot encode message: %s", err)
+	}
+	data := C.pn_data(0)
+	defer C.pn_data_free(data)
+	if result := C.pn_message_data(m.pn, data); result < 0 {
+		return 0, fmt.Errorf("cannot encode message: %s", PnErrorCode(result))
+	}
+	size := C.pn_data_encoded_size(data)
+	if size < 0 {
+		return 0, fmt.Errorf("cannot encode message: %s", PnErrorCode(size))
+	}
+	if m.defaultHeader() { // Encode omits the header, see Encode()
+		header := C.pn_data(0)
+		defer C.pn_data_free(header)
+		C.pn_data_appendn(header, data, 1)
+		size -= C.pn_data_encoded_size(header)
+	}
+	size += C.ssize_t(len(m.body))
+	if C.pn_data_size(m.footer) > 0 { // Descriptor and map, see encodeFooter()
+		size += 3 + C.pn_data_encoded_size(m.footer)
+	}
+	return int(size), nil
+}
+
+// encodeFooter appends the footer section to buffer.
+func (m *message) encodeFooter(buffer []byte) ([]byte, error) {
+	encode := func(buf []byte) ([]byte, error) {
+		n := int(C.pn_data_encode(m.footer, cPtr(buf), cLen(buf)))
+		switch {
+		case n == int(C.PN_OVERFLOW):
+			return buf, overflow
+		case n < 0:
+			return buf, fmt.Errorf("cannot encode message footer: %s", PnErrorCode(n))
+		default:
+			return buf[:n], nil
+		}
+	}
+	footer, err := encodeGrow(nil, encode)
+	if err != nil {
+		return buffer, err
+	}
+	buffer = append(buffer, 0x00, 0x53, byte(footerCode)) // Described, smallulong descriptor
+	return append(buffer, footer...), nil
+}
+
+// validate returns an error if any of the message fields are invalid.
+func (m *message) validate() error {
+	if m.ttlErr != nil {
+		return m.ttlErr
+	}
+	return m.propErr
+}
+
+// MessagesEqual returns true if messages a and b have equal fields in every
+// section, see MessageDiff().
+func MessagesEqual(a, b Message) bool { return MessageDiff(a, b) == "" }
+
+// messageFields are the fields compared by MessageDiff, in section order.
+var messageFields = []struct {
+	name string
+	get  func(Message) interface{}
+}{
+	{"Durable", func(m Message) interface{} { return m.Durable() }},
+	{"Priority", func(m Message) interface{} { return m.Priority() }},
+	{"TTL", func(m Message) interface{} { return m.TTL() }},
+	{"FirstAcquirer", func(m Message) interface{} { return m.FirstAcquirer() }},
+	{"DeliveryCount", func(m Message) interface{} { return m.DeliveryCount() }},
+	{"DeliveryAnnotations", func(m Message) interface{} { return m.DeliveryAnnotations() }},
+	{"MessageAnnotations", func(m Message) interface{} { return m.MessageAnnotations() }},
+	{"MessageId", func(m Message) interface{} { return m.MessageId() }},
+	{"UserId", func(m Message) interface{} { return m.UserId() }},
+	{"Address", func(m Message) interface{} { return m.Address() }},
+	{"Subject", func(m Message) interface{} { return m.Subject() }},
+	{"ReplyTo", func(m Message) interface{} { return m.ReplyTo() }},
+	{"CorrelationId", func(m Message) interface{} { return m.CorrelationId() }},
+	{"ContentType", func(m Message) interface{} { return m.ContentType() }},
+	{"ContentEncoding", func(m Message) interface{} { return m.ContentEncoding() }},
+	{"ExpiryTime", func(m Message) interface{} { return m.ExpiryTime() }},
+	{"CreationTime", func(m Message) interface{} { return m.CreationTime() }},
+	{"GroupId", func(m Message) interface{} { return m.GroupId() }},
+	{"GroupSequence", func(m Message) interface{} { return m.GroupSequence() }},
+	{"ReplyToGroupId", func(m Message) interface{} { return m.ReplyToGroupId() }},
+	{"ApplicationProperties", func(m Message) interface{} { return m.ApplicationProperties() }},
+	{"Inferred", func(m Message) interface{} { return m.Inferred() }},
+	{"Body", func(m Message) interface{} { return m.Body() }},
+	{"Footer", func(m Message) interface{} { return m.Footer() }},
+}
+
+// MessageDiff compares messages a and b field by field and returns a line for
+// each field that differs, with both values, or "" if the messages are equal.
+// It is intended for tests that compare a sent and a received message.
+//
+// Field values are compared as AMQP values, they are equal if they marshal to
+// the same AMQP encoding. So maps are equal if they have the same entries in
+// any order, and Go values with the same AMQP type are equal, for example int
+// and int64 are both AMQP long. Values of different AMQP types are not equal,
+// for example int32(1) and int64(1), or a string and the same Symbol.
+func MessageDiff(a, b Message) string {
+	var diffs []string
+	for _, f := range messageFields {
+		if va, vb := f.get(a), f.get(b); !equalValues(va, vb) {
+			diffs = append(diffs, fmt.Sprintf("%s: %#v != %#v", f.name, va, vb))
+		}
+	}
+	return strings.Join(diffs, "\n")
+}
+
+// equalValues returns true if a and b have the same AMQP encoding, or are deeply
+// equal if either cannot be marshaled.
+func equalValues(a, b interface{}) bool {
+	ba, erra := Marshal(a, nil)
+	bb, errb := Marshal(b, nil)
+	if erra != nil || errb != nil {
+		return reflect.DeepEqual(a, b)
+	}
+	return bytes.Equal(ba, bb)
+}
+
+// ValidateMessage checks that m is a valid AMQP message that Encode can
+// encode. If not it returns an error that names the invalid section or field,
+// for example a negative TTL, an application property that is not a simple
+// type, an annotation key that is not a symbol or ulong, or a message-id that
+// is not an allowed type. Messages created by Decode are also checked, since
+// a peer may send sections that Decode accepts but that are not valid AMQP.
+func ValidateMessage(m Message) error {
+	mm, ok := m.(*message)
+	if !ok {
+		_, err := m.Encode(nil)
+		return err
+	}
+	if mm.ttlErr != nil {
+		return fmt.Errorf("invalid message header: %s", mm.ttlErr)
+	}
+	checks := []struct {
+		section string
+		check   func(*C.pn_data_t) error
+		data    *C.pn_data_t
+	}{
+		{"delivery-annotations", checkAnnotations, C.pn_message_instructions(mm.pn)},
+		{"message-annotations", checkAnnotations, C.pn_message_annotations(mm.pn)},
+		{"properties message-id", checkId, C.pn_message_id(mm.pn)},
+		{"properties correlation-id", checkId, C.pn_message_correlation_id(mm.pn)},
+		{"", checkProperties, C.pn_message_properties(mm.pn)}, // Error names the section
+		{"footer", checkAnnotations, mm.footer},
+	}
+	for _, c := range checks {
+		if err := c.check(c.data); err != nil {
+			if c.section == "" {
+				return fmt.Errorf("invalid message: %s", err)
+			}
+			return fmt.Errorf("invalid message %s: %s", c.section, err)
+		}
+	}
+	return nil
+}
+
+// checkAnnotations returns an error if an encoded annotations map has a key
+// that is not a symbol or ulong.
+func checkAnnotations(data *C.pn_data_t) error {
+	defer C.pn_data_rewind(data)
+	C.pn_data_rewind(data)
+	if !C.pn_data_next(data) {
+		return nil
+	}
+	if t := C.pn_data_type(data); t != C.PN_MAP {
+		return fmt.Errorf("is %s, must be a map", C.pn_type_t(t).String())
+	}
+	C.pn_data_enter(data)
+	for C.pn_data_next(data) {
+		switch t := C.pn_data_type(data); t {
+		case C.PN_SYMBOL, C.PN_ULONG:
+		default:
+			return fmt.Errorf("key is %s, must be symbol or ulong", C.pn_type_t(t).String())
+		}
+		C.pn_data_next(data) // Skip the value
+	}
+	return nil
+}
+
+// checkId returns an error if an encoded message-id or correlation-id has a
+// type that is not allowed.
+func checkId(data *C.pn_data_t) error {
+	defer C.pn_data_rewind(data)
+	C.pn_data_rewind(data)
+	if !C.pn_data_next(data) {
+		return nil
+	}
+	switch t := C.pn_data_type(data); t {
+	case C.PN_NULL, C.PN_ULONG, C.PN_UUID, C.PN_BINARY, C.PN_STRING:
+		return nil
+	default:
+		return fmt.Errorf("is %s, must be ulong, uuid, binary or string", C.pn_type_t(t).String())
+	}
+}
+
+// checkProperties returns an error if an encoded application-properties map
+// has a key that is not a string, or a value that is not a simple type.
+func checkProperties(data *C.pn_data_t) error {
+	defer C.pn_data_rewind(data)
+	C.pn_data_rewind(data)
+	if !C.pn_data_next(data) || C.pn_data_type(data) != C.PN_MAP {
+		return nil
+	}
+	C.pn_data_enter(data)
+	for C.pn_data_next(data) {
+		if t := C.pn_data_type(data); t != C.PN_STRING {
+			return fmt.Errorf("application property key is %s, must be string", C.pn_type_t(t).String())
+		}
+		key := goString(C.pn_data_get_string(data))
+		if !C.pn_data_next(data) {
+			break
+		}
+		switch t := C.pn_data_type(data); t {
+		case C.PN_MAP, C.PN_LIST, C.PN_ARRAY, C.PN_DESCRIBED:
+			return fmt.Errorf("application property %q is %s, must be a simple type", key, C.pn_type_t(t).String())
+		}
+	}
+	return nil
+}
+
+// defaultHeader is true if all the header fields have default values.
+func (m *message) defaultHeader() bool {
+	return !m.Durable() && m.Priority() == C.PN_DEFAULT_PRIORITY && m.TTL() == 0 &&
+		!m.FirstAcquirer() && m.DeliveryCount() == 0
+}
+
+// MessageEncoder encodes messages into a re-usable buffer, to avoid
+// allocating a new buffer for every message in a publishing loop.
+// The zero value is ready to use. A MessageEncoder is not safe for concurrent use.
+type MessageEncoder struct {
+	buffer []byte
+}
+
+// Reset sets the buffer used by subsequent calls to Encode. If buffer is nil
+// or too small a new buffer is allocated as needed.
+func (e *MessageEncoder) Reset(buffer []byte) { e.buffer = buffer[:cap(buffer)] }
+
+// Encode encodes m and returns the encoded bytes. The returned slice shares
+// the encoder's buffer, so it is only valid until the next call to Encode or
+// Reset.
+func (e *MessageEncoder) Encode(m Message) ([]byte, error) {
+	bytes, err := m.Encode(e.buffer)
+	if err == nil {
+		e.buffer = bytes[:cap(bytes)]
+	}
+	return bytes, err
 }
 
 // TODO aconway 2015-09-14: Multi-section messages.
 
+// ==== Message sections
+
+// Descriptor codes for message sections
+const (
+	headerCode                uint64 = 0x70
+	deliveryAnnotationsCode   uint64 = 0x71
+	messageAnnotationsCode    uint64 = 0x72
+	propertiesCode            uint64 = 0x73
+	applicationPropertiesCode uint64 = 0x74
+	dataCode                  uint64 = 0x75
+	sequenceCode              uint64 = 0x76
+	valueCode                 uint64 = 0x77
+	footerCode                uint64 = 0x78
+)
+
+var sectionCodes = map[string]uint64{
+	"amqp:header:list":                headerCode,
+	"amqp:delivery-annotations:map":   deliveryAnnotationsCode,
+	"amqp:message-annotations:map":    messageAnnotationsCode,
+	"amqp:properties:list":            propertiesCode,
+	"amqp:application-properties:map": applicationPropertiesCode,
+	"amqp:data:binary":                dataCode,
+	"amqp:amqp-sequence:list":         sequenceCode,
+	"amqp:amqp-value:*":               valueCode,
+	"amqp:footer:map":                 footerCode,
+}
+
+// section is a single encoded section of a message.
+type section struct {
+	code  uint64 // Descriptor code
+	bytes []byte // Encoded section including the descriptor
+	value int    // Offset of the section value in bytes
+}
+
+// nextSection returns the first section in data without decoding the section
+// contents.
+func nextSection(data []byte) (s section, err error) {
+	if data[0] != 0 {
+		return s, fmt.Errorf("message section is not a described type")
+	}
+	d, err := encodedSize(data[1:]) // Descriptor
+	if err != nil {
+		return s, err
+	}
+	v, err := encodedSize(data[1+d:]) // Value
+	if err != nil {
+		return s, err
+	}
+	s = section{bytes: data[:1+d+v], value: 1 + d}
+	s.code, err = sectionCode(data[1 : 1+d])
+	return s, err
+}
+
+// splitSections splits encoded message data into sections without decoding
+// the section contents.
+func splitSections(data []byte) (sections []section, err error) {
+	for len(data) > 0 {
+		s, err := nextSection(data)
+		if err != nil {
+			return nil, err
+		}
+		sections = append(sections, s)
+		data = data[len(s.bytes):]
+	}
+	return sections, nil
+}
+
+// BodyBytes returns the body of encoded message data without decoding the
+// message, if the body is a single AMQP data section.
+//
+// The returned slice is not a copy, it aliases data, so it is only valid until
+// data is modified or re-used, for example as the buffer for the next
+// proton.Delivery.RawBytes(). Copy it if you need to keep it.
+func BodyBytes(data []byte) ([]byte, error) {
+	var body []byte
+	found := false
+	for len(data) > 0 {
+		s, err := nextSection(data)
+		if err != nil {
+			return nil, err
+		}
+		if s.code == dataCode {
+			if found {
+				return nil, fmt.Errorf("message body has more than one data section")
+			}
+			found = true
+			if body, err = dataBytes(s); err != nil {
+				return nil, err
+			}
+		}
+		data = data[len(s.bytes):]
+	}
+	if !found {
+		return nil, fmt.Errorf("message body is not a data section")
+	}
+	return body, nil
+}
+
+// UnmarshalBody unmarshals the body of encoded message data into the value
+// pointed to by v, see Unmarshal(), without decoding the other sections. It
+// is the same as DecodeMessage(data) followed by Message.Unmarshal(v) but
+// does not create a Message.
+//
+// A body of AMQP data sections is unmarshaled as a single Binary, a body of an
+// AMQP sequence section as a List.
+func UnmarshalBody(data []byte, v interface{}) error {
+	var value, binary []byte // Encoded value or sequence, contents of data sections
+	found := false
+	for len(data) > 0 {
+		s, err := nextSection(data)
+		if err != nil {
+			return err
+		}
+		switch s.code {
+		case dataCode:
+			b, err := dataBytes(s)
+			if err != nil {
+				return err
+			}
+			binary = append(binary, b...)
+			found = true
+		case valueCode, sequenceCode:
+			if value != nil {
+				return fmt.Errorf("message body has more than one value or sequence section")
+			}
+			value = s.bytes[s.value:]
+			found = true
+		}
+		data = data[len(s.bytes):]
+	}
+	if !found {
+		return fmt.Errorf("message has no body")
+	}
+	if value == nil {
+		var err error
+		if value, err = Marshal(Binary(binary), nil); err != nil {
+			return err
+		}
+	}
+	_, err := Unmarshal(value, v)
+	return err
+}
+
+// dataBytes returns the binary value of a data section, it aliases the section bytes.
+func dataBytes(s section) ([]byte, error) {
+	switch v := s.bytes[s.value:]; v[0] {
+	case 0xa0: // vbin8
+		return v[2:], nil
+	case 0xb0: // vbin32
+		return v[5:], nil
+	default:
+		return nil, fmt.Errorf("invalid data section format code 0x%x", v[0])
+	}
+}
+
+// sectionCode returns the numeric code for an encoded section descriptor.
+func sectionCode(d []byte) (uint64, error) {
+	switch d[0] {
+	case 0x44: // ulong0
+		return 0, nil
+	case 0x53: // smallulong
+		return uint64(d[1]), nil
+	case 0x80: // ulong
+		return binary.BigEndian.Uint64(d[1:]), nil
+	case 0xa3: // sym8
+		if code, ok := sectionCodes[string(d[2:])]; ok {
+			return code, nil
+		}
+	case 0xb3: // sym32
+		if code, ok := sectionCodes[string(d[5:])]; ok {
+			return code, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid message section descriptor")
+}
+
+// encodedSize returns the size of the first AMQP encoded value in data.
+func encodedSize(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, fmt.Errorf("unexpected end of data")
+	}
+	if data[0] == 0 { // Described type: descriptor followed by value
+		d, err := encodedSize(data[1:])
+		if err != nil {
+			return 0, err
+		}
+		v, err := encodedSize(data[1+d:])
+		return 1 + d + v, err
+	}
+	var size int
+	switch data[0] >> 4 {
+	case 0x4:
+		size = 1
+	case 0x5:
+		size = 2
+	case 0x6:
+		size = 3
+	case 0x7:
+		size = 5
+	case 0x8:
+		size = 9
+	case 0x9:
+		size = 17
+	case 0xa, 0xc, 0xe: // One byte size
+		if len(data) >= 2 {
+			size = 2 + int(data[1])
+		}
+	case 0xb, 0xd, 0xf: // Four byte size
+		if len(data) >= 5 {
+			size = 5 + int(binary.BigEndian.Uint32(data[1:]))
+		}
+	default:
+		return 0, fmt.Errorf("invalid format code 0x%x", data[0])
+	}
+	if size == 0 || size > len(data) {
+		return 0, fmt.Errorf("unexpected end of data")
+	}
+	return size, nil
+}
+
+// countValue counts the first AMQP value in data and the values it contains,
+// adding to *n. Returns the encoded size of the value, or an error if the data
+// is invalid or *n would exceed max.
+func countValue(data []byte, n *int, max int) (int, error) {
+	if len(data) == 0 {
+		return 0, fmt.Errorf("unexpected end of data")
+	}
+	if *n++; *n > max {
+		return 0, fmt.Errorf("more than %d elements", max)
+	}
+	if data[0] == 0 { // Described type: descriptor followed by value
+		d, err := countValue(data[1:], n, max)
+		if err != nil {
+			return 0, err
+		}
+		v, err := countValue(data[1+d:], n, max)
+		return 1 + d + v, err
+	}
+	size, err := countBody(data[0], data[1:], n, max)
+	return 1 + size, err
+}
+
+// countBody counts the values in the body of a value with format code, which
+// is data without the format code. Array elements are encoded this way.
+// Returns the size of the body.
+func countBody(code byte, data []byte, n *int, max int) (int, error) {
+	var w int // Width of the size and count fields
+	switch code >> 4 {
+	case 0x4, 0x5, 0x6, 0x7, 0x8, 0x9:
+		size := [...]int{0, 1, 2, 4, 8, 16}[code>>4-0x4]
+		if size > len(data) {
+			return 0, fmt.Errorf("unexpected end of data")
+		}
+		return size, nil
+	case 0xa, 0xc, 0xe:
+		w = 1
+	case 0xb, 0xd, 0xf:
+		w = 4
+	default:
+		return 0, fmt.Errorf("invalid format code 0x%x", code)
+	}
+	readUint := func(b []byte) int {
+		if w == 1 {
+			return int(b[0])
+		}
+		return int(binary.BigEndian.Uint32(b))
+	}
+	if len(data) < w {
+		return 0, fmt.Errorf("unexpected end of data")
+	}
+	size := readUint(data)
+	if size < 0 || size > len(data)-w {
+		return 0, fmt.Errorf("unexpected end of data")
+	}
+	body := data[w : w+size]
+	switch code {
+	case 0xc0, 0xc1, 0xd0, 0xd1: // List or map: count then values
+		if len(body) < w {
+			return 0, fmt.Errorf("unexpected end of data")
+		}
+		for values := body[w:]; len(values) > 0; {
+			v, err := countValue(values, n, max)
+			if err != nil {
+				return 0, err
+			}
+			values = values[v:]
+		}
+	case 0xe0, 0xf0: // Array: count, one constructor, then value bodies
+		if len(body) < w+1 {
+			return 0, fmt.Errorf("unexpected end of data")
+		}
+		count, values := readUint(body), body[w:]
+		if count < 0 || count > max-*n {
+			return 0, fmt.Errorf("more than %d elements", max)
+		}
+		*n += count
+		if values[0] == 0 { // Described element type
+			d, err := countValue(values[1:], n, max)
+			if err != nil {
+				return 0, err
+			}
+			values = values[1+d:]
+		}
+		if len(values) == 0 {
+			return 0, fmt.Errorf("unexpected end of data")
+		}
+		elementCode, values := values[0], values[1:]
+		for i := 0; i < count; i++ {
+			v, err := countBody(elementCode, values, n, max)
+			if err != nil {
+				return 0, err
+			}
+			values = values[v:]
+		}
+	}
+	return w + size, nil
+}
+
 // TODO aconway 2016-09-09: Message.String() use inspect.
 
 // ==== Deprecated functions
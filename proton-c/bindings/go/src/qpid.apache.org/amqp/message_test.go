@@ -20,6 +20,10 @@ under the License.
 package amqp
 
 import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
 	"testing"
 	"time"
 )
@@ -50,8 +54,10 @@ func TestDefaultMessage(t *testing.T) {
 		{m.ReplyTo(), ""},
 		{m.ContentType(), ""},
 		{m.ContentEncoding(), ""},
+		{m.ExpiryTime(), time.Time{}},
+		{m.CreationTime(), time.Time{}},
 		{m.GroupId(), ""},
-		{m.GroupSequence(), int32(0)},
+		{m.GroupSequence(), uint32(0)},
 		{m.ReplyToGroupId(), ""},
 		{m.MessageId(), nil},
 		{m.CorrelationId(), nil},
@@ -108,7 +114,7 @@ func TestMessageRoundTrip(t *testing.T) {
 		{m.ContentType(), "content"},
 		{m.ContentEncoding(), "encoding"},
 		{m.GroupId(), "group"},
-		{m.GroupSequence(), int32(42)},
+		{m.GroupSequence(), uint32(42)},
 		{m.ReplyToGroupId(), "replytogroup"},
 		{m.MessageId(), "id"},
 		{m.CorrelationId(), "correlation"},
@@ -199,3 +205,1081 @@ func TestMessageBodyTypes(t *testing.T) {
 
 	// TODO aconway 2015-09-08: array etc.
 }
+
+func TestMessageBodySections(t *testing.T) {
+	for _, x := range []struct {
+		set      func(Message)
+		code     uint64
+		inferred bool
+		body     interface{}
+	}{
+		{func(m Message) { m.SetBody(List{"a", int32(1)}) }, valueCode, false, List{"a", int32(1)}},
+		{func(m Message) { m.SetBody(Binary("bin")) }, valueCode, false, Binary("bin")},
+		{func(m Message) { m.SetBody(Map{"k": "v"}) }, valueCode, false, Map{"k": "v"}},
+		{func(m Message) { m.SetSequence([]interface{}{"a", int32(1)}) }, sequenceCode, true, List{"a", int32(1)}},
+		{func(m Message) { m.SetData([]byte("bin")) }, dataCode, true, Binary("bin")},
+		{func(m Message) { m.Marshal([]byte("bin")); m.SetInferred(true) }, dataCode, true, Binary("bin")},
+		{func(m Message) { m.Marshal([]byte("bin")); m.SetInferred(false) }, valueCode, false, Binary("bin")},
+		{func(m Message) { m.Marshal("str"); m.SetInferred(true) }, valueCode, false, "str"},
+	} {
+		m := NewMessage()
+		x.set(m)
+		bytes, err := m.Encode(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sections, err := splitSections(bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code := sections[len(sections)-1].code; code != x.code {
+			t.Errorf("%#v: want section 0x%x, got 0x%x", x.body, x.code, code)
+		}
+		m2, err := DecodeMessage(bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkEqual(x.inferred, m2.Inferred()); err != nil {
+			t.Errorf("%#v: inferred %v", x.body, err)
+		}
+		if err := checkEqual(x.body, m2.Body()); err != nil {
+			t.Error(err)
+		}
+		// Re-encoding preserves the section type
+		if bytes2, err := m2.Encode(nil); err != nil || string(bytes) != string(bytes2) {
+			t.Errorf("%#v: re-encoded %v != %v (%v)", x.body, bytes2, bytes, err)
+		}
+	}
+}
+
+func TestMessageHeader(t *testing.T) {
+	hasHeader := func(m Message) bool {
+		bytes, err := m.Encode(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sections, err := splitSections(bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(sections) > 0 && sections[0].code == headerCode
+	}
+	m := NewMessageWith("x")
+	if hasHeader(m) {
+		t.Error("default header should be omitted")
+	}
+	m.SetDurable(true)
+	m.SetTTL(60 * time.Second)
+	if !hasHeader(m) {
+		t.Error("header missing")
+	}
+	if err := roundTrip(m); err != nil {
+		t.Error(err)
+	}
+	m2, err := DecodeMessage(func() []byte { b, _ := m.Encode(nil); return b }())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m2.Durable() || m2.TTL() != 60*time.Second || m2.Priority() != 4 {
+		t.Errorf("bad header: durable=%v ttl=%v priority=%v", m2.Durable(), m2.TTL(), m2.Priority())
+	}
+
+	m.SetTTL(-time.Second)
+	if _, err := m.Encode(nil); err == nil {
+		t.Error("expected error for negative TTL")
+	}
+	if m.TTL() != 60*time.Second {
+		t.Errorf("negative TTL should be ignored, got %v", m.TTL())
+	}
+	// A valid TTL replaces the error
+	m.SetTTL(time.Minute)
+	if _, err := m.Encode(nil); err != nil || m.TTL() != time.Minute {
+		t.Errorf("want TTL %v, got %v %v", time.Minute, m.TTL(), err)
+	}
+	m.SetTTL(-time.Second)
+	m.Clear()
+	if _, err := m.Encode(nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestApplicationProperty(t *testing.T) {
+	m := NewMessage()
+	m.SetApplicationProperty("s", "str")
+	m.SetApplicationProperty("i", int32(-3))
+	m.SetApplicationProperty("u", uint64(7))
+	m.SetApplicationProperty("b", true)
+
+	if v, ok := m.ApplicationProperty("s"); !ok || v != "str" {
+		t.Errorf("want str, true got %v, %v", v, ok)
+	}
+	if v, ok := m.ApplicationProperty("none"); ok || v != nil {
+		t.Errorf("want nil, false got %v, %v", v, ok)
+	}
+	if s, err := m.ApplicationPropertyString("s"); err != nil || s != "str" {
+		t.Errorf("want str got %v, %v", s, err)
+	}
+	if i, err := m.ApplicationPropertyInt("i"); err != nil || i != -3 {
+		t.Errorf("want -3 got %v, %v", i, err)
+	}
+	if i, err := m.ApplicationPropertyInt("u"); err != nil || i != 7 {
+		t.Errorf("want 7 got %v, %v", i, err)
+	}
+	if b, err := m.ApplicationPropertyBool("b"); err != nil || !b {
+		t.Errorf("want true got %v, %v", b, err)
+	}
+	// Errors for missing properties and type mismatch
+	for _, err := range []error{
+		func() error { _, err := m.ApplicationPropertyString("i"); return err }(),
+		func() error { _, err := m.ApplicationPropertyInt("s"); return err }(),
+		func() error { _, err := m.ApplicationPropertyBool("none"); return err }(),
+	} {
+		if err == nil {
+			t.Error("expected error")
+		}
+	}
+	if err := roundTrip(m); err != nil {
+		t.Error(err)
+	}
+	// Compound values are not allowed
+	m.SetApplicationProperty("list", List{1, 2})
+	if _, err := m.Encode(nil); err == nil {
+		t.Error("expected error encoding list property")
+	}
+	m.SetApplicationProperties(map[string]interface{}{"s": "str"})
+	if _, err := m.Encode(nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMessageAnnotationKeys(t *testing.T) {
+	annotations := map[AnnotationKey]interface{}{
+		AnnotationKeySymbol("x-opt-sym"): "a",
+		AnnotationKeyUint64(42):          "b",
+	}
+	m := NewMessage()
+	m.SetMessageAnnotations(annotations)
+	m.SetDeliveryAnnotations(annotations)
+	bytes, err := m.Encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := DecodeMessage(bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, got := range []map[AnnotationKey]interface{}{m2.MessageAnnotations(), m2.DeliveryAnnotations()} {
+		if err := checkEqual(annotations, got); err != nil {
+			t.Error(err)
+		}
+		for k := range got {
+			switch k.Get().(type) {
+			case Symbol, uint64:
+			default:
+				t.Errorf("bad key type %T", k.Get())
+			}
+		}
+	}
+	// Re-encoding preserves the key types
+	if bytes2, err := m2.Encode(nil); err != nil || string(bytes) != string(bytes2) {
+		t.Errorf("re-encoded %v != %v (%v)", bytes2, bytes, err)
+	}
+
+	// String keys are not valid annotation keys, they are treated as symbols.
+	data, err := Marshal(map[string]interface{}{"str": "c"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[AnnotationKey]interface{}
+	if _, err := Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual(map[AnnotationKey]interface{}{AnnotationKeySymbol("str"): "c"}, got); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBodyBytes(t *testing.T) {
+	for _, body := range []string{"", "small", strings.Repeat("x", 1000)} {
+		m := NewMessage()
+		m.SetSubject("subject")
+		m.SetData([]byte(body))
+		m.SetFooter(map[AnnotationKey]interface{}{AnnotationKeySymbol("x-opt-sig"): "sig"})
+		data, err := m.Encode(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := BodyBytes(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkEqual(body, string(got)); err != nil {
+			t.Error(err)
+		}
+		// The body aliases the encoded data.
+		if len(got) > 0 && &got[0] != &data[bytes.Index(data, got)] {
+			t.Error("body is a copy")
+		}
+	}
+	data, err := NewMessageWith("value").Encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := BodyBytes(data); err == nil {
+		t.Error("expected error for amqp-value body")
+	}
+}
+
+func TestDecodeDataSections(t *testing.T) {
+	m := NewMessage()
+	m.SetSubject("subject")
+	m.SetData([]byte("one"))
+	data, err := m.Encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Append two more data sections, vbin8 and vbin32.
+	data = append(data, 0x00, 0x53, 0x75, 0xa0, 3, 't', 'w', 'o')
+	data = append(data, 0x00, 0x53, 0x75, 0xb0, 0, 0, 0, 5, 't', 'h', 'r', 'e', 'e')
+	m2 := NewMessage()
+	if err := m2.Decode(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual(Binary("onetwothree"), m2.Body()); err != nil {
+		t.Error(err)
+	}
+	if err := checkEqual("subject", m2.Subject()); err != nil {
+		t.Error(err)
+	}
+	if !m2.Inferred() {
+		t.Error("expected inferred body")
+	}
+}
+
+func TestNewMessageBytes(t *testing.T) {
+	m := NewMessage()
+	m.SetMessageAnnotations(map[AnnotationKey]interface{}{AnnotationKeySymbol("x-opt-hop"): int32(1)})
+	m.SetFooter(map[AnnotationKey]interface{}{AnnotationKeySymbol("x-opt-sig"): "sig"})
+	data, err := m.Encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Insert a value body before the footer as a str32, which proton would
+	// re-encode as a str8.
+	body := []byte{0x00, 0x53, 0x77, 0xb1, 0, 0, 0, 3, 'a', 'b', 'c'}
+	sections, err := splitSections(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	footer := sections[len(sections)-1].bytes
+	data = append(append(data[:len(data)-len(footer):len(data)-len(footer)], body...), footer...)
+
+	m2, err := NewMessageBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual(int32(1), m2.MessageAnnotations()[AnnotationKeySymbol("x-opt-hop")]); err != nil {
+		t.Error(err)
+	}
+	if err := checkEqual("abc", m2.Body()); err != nil {
+		t.Error(err)
+	}
+	var s string
+	if err := m2.Unmarshal(&s); err != nil || s != "abc" {
+		t.Errorf("want abc, got %q %v", s, err)
+	}
+	var n int
+	if err := m2.Unmarshal(&n); err == nil {
+		t.Errorf("expected error unmarshaling string body into int, got %v", n)
+	}
+	if err := NewMessageWith("abc").Unmarshal(&n); err == nil {
+		t.Errorf("expected error unmarshaling string body into int, got %v", n)
+	}
+	m2.SetMessageAnnotations(map[AnnotationKey]interface{}{AnnotationKeySymbol("x-opt-hop"): int32(2)})
+	encoded, err := m2.Encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(encoded, append(body, footer...)) {
+		t.Errorf("body not encoded verbatim: %x", encoded)
+	}
+	if size, err := m2.EncodedSize(); err != nil || size != len(encoded) {
+		t.Errorf("EncodedSize %v, %v: want %v", size, err, len(encoded))
+	}
+	m3, err := DecodeMessage(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual(int32(2), m3.MessageAnnotations()[AnnotationKeySymbol("x-opt-hop")]); err != nil {
+		t.Error(err)
+	}
+	if err := checkEqual("abc", m3.Body()); err != nil {
+		t.Error(err)
+	}
+	if err := checkEqual("sig", m3.Footer()[AnnotationKeySymbol("x-opt-sig")]); err != nil {
+		t.Error(err)
+	}
+
+	// Replacing the body encodes the new one.
+	m2.SetBody("xyz")
+	if encoded, err = m2.Encode(nil); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encoded, body) {
+		t.Errorf("old body encoded: %x", encoded)
+	}
+	if m3, err = DecodeMessage(encoded); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual("xyz", m3.Body()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMessageDiff(t *testing.T) {
+	m := NewMessage()
+	m.SetSubject("subject")
+	m.SetApplicationProperties(map[string]interface{}{"a": 1, "b": "x", "c": true})
+	m.SetBody(Map{"one": 1, "two": 2, Symbol("three"): List{1, "x"}})
+	data, err := m.Encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := DecodeMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Decoded values are int64, not int, and the maps are new.
+	if diff := MessageDiff(m, m2); diff != "" {
+		t.Errorf("unexpected difference: %s", diff)
+	}
+	if !MessagesEqual(m, m2) {
+		t.Error("messages not equal")
+	}
+
+	m2.SetSubject("other")
+	m2.SetBody(Map{"one": int32(1), "two": 2, Symbol("three"): List{1, "x"}})
+	want := `Subject: "subject" != "other"`
+	if diff := MessageDiff(m, m2); !strings.HasPrefix(diff, want+"\nBody: ") || strings.Count(diff, "\n") != 1 {
+		t.Errorf("want %q and Body, got %q", want, diff)
+	}
+	if MessagesEqual(m, m2) {
+		t.Error("messages equal")
+	}
+}
+
+func TestUnmarshalBody(t *testing.T) {
+	type body struct {
+		Name string `amqp:"name"`
+		N    int64  `amqp:"n"`
+	}
+	m := NewMessageWith(body{"x", 3})
+	m.SetSubject("subject")
+	data, err := m.Encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got body
+	if err := UnmarshalBody(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual(body{"x", 3}, got); err != nil {
+		t.Error(err)
+	}
+
+	// Data sections are joined.
+	m.SetData([]byte("one"))
+	if data, err = m.Encode(nil); err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, 0x00, 0x53, 0x75, 0xa0, 3, 't', 'w', 'o')
+	var b []byte
+	if err := UnmarshalBody(data, &b); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual("onetwo", string(b)); err != nil {
+		t.Error(err)
+	}
+
+	m.SetSequence([]interface{}{"a", "b"})
+	if data, err = m.Encode(nil); err != nil {
+		t.Fatal(err)
+	}
+	var l []string
+	if err := UnmarshalBody(data, &l); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual([]string{"a", "b"}, l); err != nil {
+		t.Error(err)
+	}
+	if err := UnmarshalBody(data, &got); err == nil {
+		t.Error("expected error unmarshaling a list to a struct")
+	}
+
+	m = NewMessage()
+	m.SetSubject("no body")
+	if data, err = m.Encode(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnmarshalBody(data, &b); err == nil {
+		t.Error("expected error for a message with no body")
+	}
+}
+
+func TestMessageFooter(t *testing.T) {
+	footer := map[AnnotationKey]interface{}{AnnotationKeySymbol("x-opt-sig"): Binary("signature")}
+	m := NewMessageWith("body")
+	m.SetFooter(footer)
+	bytes, err := m.Encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sections, err := splitSections(bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := sections[len(sections)-1].code; code != footerCode {
+		t.Errorf("footer is not the last section: 0x%x", code)
+	}
+	m2, err := DecodeMessage(bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual(footer, m2.Footer()); err != nil {
+		t.Error(err)
+	}
+	if err := checkEqual("body", m2.Body()); err != nil {
+		t.Error(err)
+	}
+	if err := checkEqual(map[AnnotationKey]interface{}{}, m2.MessageAnnotations()); err != nil {
+		t.Error(err)
+	}
+	m2.Clear()
+	if err := checkEqual(map[AnnotationKey]interface{}{}, m2.Footer()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMessageTimes(t *testing.T) {
+	m := NewMessage()
+	created := time.Unix(1500000000, 123456789) // Sub-millisecond precision is dropped
+	expires := created.Add(time.Hour)
+	m.SetCreationTime(created)
+	m.SetExpiryTime(expires)
+	bytes, err := m.Encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := DecodeMessage(bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := created.Truncate(time.Millisecond); !m2.CreationTime().Equal(want) {
+		t.Errorf("%v != %v", want, m2.CreationTime())
+	}
+	if want := expires.Truncate(time.Millisecond); !m2.ExpiryTime().Equal(want) {
+		t.Errorf("%v != %v", want, m2.ExpiryTime())
+	}
+	// Zero time means not set
+	m.SetCreationTime(time.Time{})
+	if !m.CreationTime().IsZero() {
+		t.Errorf("expected zero time, got %v", m.CreationTime())
+	}
+}
+
+func TestMessageExpired(t *testing.T) {
+	m := NewMessage()
+	if m.Expired() {
+		t.Error("message with no expiry information is expired")
+	}
+	m.SetTTL(time.Hour) // TTL without creation time is not enough
+	if m.Expired() {
+		t.Error("message with no creation time is expired")
+	}
+	m.SetCreationTime(time.Now().Add(-2 * time.Hour))
+	if !m.Expired() {
+		t.Error("expected TTL to have passed since creation")
+	}
+	m.SetExpiryTime(time.Now().Add(time.Hour)) // Expiry time takes precedence
+	if m.Expired() {
+		t.Error("message with future expiry time is expired")
+	}
+	m.SetExpiryTime(time.Now().Add(-time.Second))
+	if !m.Expired() {
+		t.Error("message with past expiry time is not expired")
+	}
+}
+
+func TestMessageContentType(t *testing.T) {
+	m := NewMessage()
+	m.SetContentType("application/json")
+	m.SetContentEncoding("gzip")
+	bytes, err := m.Encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := DecodeMessage(bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual("application/json", m2.ContentType()); err != nil {
+		t.Error(err)
+	}
+	if err := checkEqual("gzip", m2.ContentEncoding()); err != nil {
+		t.Error(err)
+	}
+	// Check the properties are encoded as symbols
+	sections, err := splitSections(bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields []interface{}
+	for _, s := range sections {
+		if s.code == propertiesCode {
+			if _, err := Unmarshal(s.bytes[s.value:], &fields); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if len(fields) < 8 {
+		t.Fatalf("missing properties: %v", fields)
+	}
+	if err := checkEqual(Symbol("application/json"), fields[6]); err != nil {
+		t.Error(err)
+	}
+	if err := checkEqual(Symbol("gzip"), fields[7]); err != nil {
+		t.Error(err)
+	}
+
+	// Setting "" removes the field, the encoding is the same as an empty message.
+	m.SetContentType("")
+	m.SetContentEncoding("")
+	if err := checkEqual("", m.ContentType()); err != nil {
+		t.Error(err)
+	}
+	bytes, err = m.Encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty, err := NewMessage().Encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual(empty, bytes); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMessagePropertyPresence(t *testing.T) {
+	fields := []PropertyField{PropertyUserId, PropertyAddress, PropertySubject, PropertyReplyTo, PropertyGroupId, PropertyReplyToGroupId}
+	m := NewMessage()
+	for _, f := range fields {
+		if m.HasProperty(f) {
+			t.Errorf("field %v present in new message", f)
+		}
+	}
+	// Set every field to "", except subject which is absent.
+	m.SetUserId("")
+	m.SetAddress("")
+	m.SetReplyTo("")
+	m.SetGroupId("")
+	m.SetReplyToGroupId("")
+	m.SetApplicationProperties(map[string]interface{}{"null": nil})
+	bytes, err := m.Encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := DecodeMessage(bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range fields {
+		if want := f != PropertySubject; m2.HasProperty(f) != want {
+			t.Errorf("field %v: want present %v, got %v", f, want, m2.HasProperty(f))
+		}
+	}
+	if v, ok := m2.ApplicationProperty("null"); !ok || v != nil {
+		t.Errorf("want explicit null property, got %v %v", v, ok)
+	}
+	if _, ok := m2.ApplicationProperty("absent"); ok {
+		t.Error("absent property is present")
+	}
+	for _, f := range fields {
+		m2.ClearProperty(f)
+		if m2.HasProperty(f) {
+			t.Errorf("field %v present after clear", f)
+		}
+	}
+}
+
+func TestMessageUserId(t *testing.T) {
+	m := NewMessage()
+	id := string([]byte{0, 0xff, 'u'}) // Not valid UTF-8
+	m.SetUserId(id)
+	m.SetAddress("to")
+	bytes, err := m.Encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := DecodeMessage(bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual(id, m2.UserId()); err != nil {
+		t.Error(err)
+	}
+	// user-id is binary, to is a string.
+	sections, err := splitSections(bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields []interface{}
+	if _, err := Unmarshal(sections[0].bytes[sections[0].value:], &fields); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual(propertiesCode, sections[0].code); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual(Binary(id), fields[1]); err != nil {
+		t.Error(err)
+	}
+	if err := checkEqual("to", fields[2]); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMessageGroup(t *testing.T) {
+	m := NewMessage()
+	m.SetGroupId("group")
+	m.SetGroupSequence(math.MaxUint32) // Encoded as an AMQP uint
+	m.SetReplyToGroupId("replies")
+	bytes, err := m.Encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := DecodeMessage(bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual(uint32(math.MaxUint32), m2.GroupSequence()); err != nil {
+		t.Error(err)
+	}
+	if err := checkEqual("group", m2.GroupId()); err != nil {
+		t.Error(err)
+	}
+	if err := checkEqual("replies", m2.ReplyToGroupId()); err != nil {
+		t.Error(err)
+	}
+	for _, x := range []struct {
+		a, b uint32
+		less bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{1, 1, false},
+		{math.MaxUint32, 0, true},
+		{0, math.MaxUint32, false},
+		{math.MaxUint32 - 1, 1, true},
+	} {
+		if got := SequenceLess(x.a, x.b); got != x.less {
+			t.Errorf("SequenceLess(%v, %v) want %v", x.a, x.b, x.less)
+		}
+	}
+}
+
+func TestMessageUUID(t *testing.T) {
+	m := NewMessage()
+	id := UUID{0xde, 0xad, 0xbe, 0xef, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	m.SetMessageId(id)
+	m.SetCorrelationId(id)
+	bytes, err := m.Encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := DecodeMessage(bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual(id, m2.MessageId()); err != nil {
+		t.Error(err)
+	}
+	if err := checkEqual(id, m2.CorrelationId()); err != nil {
+		t.Error(err)
+	}
+	if err := checkEqual("deadbeef-0102-0304-0506-0708090a0b0c", id.String()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMessageIdTypes(t *testing.T) {
+	for _, x := range []struct {
+		id  interface{}
+		str string
+	}{
+		{nil, ""},
+		{"id", "id"},
+		{uint64(42), "42"},
+		{UUID{0xde, 0xad, 0xbe, 0xef, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}, "deadbeef-0102-0304-0506-0708090a0b0c"},
+		{Binary("\x01\xff"), "01ff"},
+	} {
+		m := NewMessage()
+		m.SetMessageId(x.id)
+		m.SetCorrelationId(x.id)
+		bytes, err := m.Encode(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m2, err := DecodeMessage(bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkEqual(x.id, m2.MessageId()); err != nil {
+			t.Error(err)
+		}
+		if err := checkEqual(x.id, m2.CorrelationId()); err != nil {
+			t.Error(err)
+		}
+		if err := checkEqual(x.str, m2.MessageIdString()); err != nil {
+			t.Error(err)
+		}
+		if err := checkEqual(x.str, m2.CorrelationIdString()); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestDecodeLimited(t *testing.T) {
+	m := NewMessageWith(List{"a", Map{"b": int32(1)}, []string{"c", "d"}})
+	m.SetApplicationProperties(map[string]interface{}{"x": true})
+	bytes, err := m.Encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2 := NewMessage()
+	if err := m2.DecodeLimited(bytes, 100, len(bytes)); err != nil {
+		t.Error(err)
+	}
+	if err := checkEqual(m.Body(), m2.Body()); err != nil {
+		t.Error(err)
+	}
+	if err := m2.DecodeLimited(bytes, 100, len(bytes)-1); err == nil {
+		t.Error("expected error for too many bytes")
+	}
+	if err := m2.DecodeLimited(bytes, 5, len(bytes)); err == nil {
+		t.Error("expected error for too many elements")
+	}
+	// amqp-value section holding an array of 2^31 nulls in 13 bytes.
+	bomb := []byte{0x00, 0x53, 0x77, 0xf0, 0, 0, 0, 5, 0x80, 0, 0, 0, 0x40}
+	if err := m2.DecodeLimited(bomb, 1000, 1000); err == nil {
+		t.Error("expected error for array of nulls")
+	}
+	if err := m2.DecodeLimited(bytes[:len(bytes)-1], 100, len(bytes)); err == nil {
+		t.Error("expected error for truncated data")
+	}
+}
+
+func TestDecodeSectionLimited(t *testing.T) {
+	m := NewMessageWith("small")
+	m.SetMessageAnnotations(map[AnnotationKey]interface{}{AnnotationKeyString("big"): strings.Repeat("x", 1000)})
+	bytes, err := m.Encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2 := NewMessage()
+	if err := m2.DecodeSectionLimited(bytes, SectionLimits{MessageAnnotations: 2000, Body: 100}); err != nil {
+		t.Error(err)
+	}
+	if err := checkEqual("small", m2.Body()); err != nil {
+		t.Error(err)
+	}
+	err = m2.DecodeSectionLimited(bytes, SectionLimits{MessageAnnotations: 100, Body: 100})
+	if err == nil || !strings.Contains(err.Error(), "message-annotations section is 1022 bytes, limit is 100") {
+		t.Errorf("expected message-annotations limit error, got %v", err)
+	}
+	if m2.Body() != nil {
+		t.Errorf("expected cleared message, got %v", m2.Body())
+	}
+	err = m2.DecodeSectionLimited(bytes, SectionLimits{Body: 5})
+	if err == nil || !strings.Contains(err.Error(), "body section") {
+		t.Errorf("expected body limit error, got %v", err)
+	}
+	if err := m2.DecodeSectionLimited(bytes[:len(bytes)-1], SectionLimits{}); err == nil {
+		t.Error("expected error for truncated data")
+	}
+}
+
+func TestMessageEncoder(t *testing.T) {
+	var enc MessageEncoder
+	enc.Reset(make([]byte, 1024))
+	b1, err := enc.Encode(NewMessageWith("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := DecodeMessage(b1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual("one", m.Body()); err != nil {
+		t.Error(err)
+	}
+	b2, err := enc.Encode(NewMessageWith("two"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &b1[0] != &b2[0] {
+		t.Error("buffer was not re-used")
+	}
+	// Grows if needed
+	big := make([]byte, 4096)
+	b3, err := enc.Encode(NewMessageWith(big))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err = DecodeMessage(b3); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual(Binary(big), m.Body()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMessageBodyJSON(t *testing.T) {
+	m := NewMessage()
+	m.SetBody(Map{
+		"s":      "str",
+		"sym":    Symbol("sym"),
+		"c":      Char('é'),
+		"bin":    Binary("\x00\x01"),
+		"t":      time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC),
+		"l":      List{int32(1), true, nil},
+		"big":    uint64(1<<53 + 1),
+		"neg":    int64(-1 << 60),
+		"d":      Described{Symbol("x:y"), 1.5},
+		int32(3): "int key",
+	})
+	got, err := m.BodyJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"3":"int key","big":"9007199254740993","bin":"AAE=","c":"é","d":{"descriptor":"x:y","value":1.5},` +
+		`"l":[1,true,null],"neg":"-1152921504606846976","s":"str","sym":"sym","t":"2017-07-14T02:40:00Z"}`
+	if err := checkEqual(want, string(got)); err != nil {
+		t.Error(err)
+	}
+
+	m.SetBody(math.NaN())
+	if _, err := m.BodyJSON(); err == nil {
+		t.Error("expected error for NaN")
+	}
+
+	m = NewMessageWith("hello")
+	m.SetSubject("greeting")
+	m.SetApplicationProperties(map[string]interface{}{"n": int64(1)})
+	got, err = json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{"application-properties":{"n":1},"body":"hello","subject":"greeting"}`
+	if err := checkEqual(want, string(got)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMessageFromJSON(t *testing.T) {
+	m, err := MessageFromJSON([]byte(`{"_headers": {"h": "x", "n": 300}, "s": "str", "l": [1, -70000, 5000000000, 18446744073709551615, 1.5, true, null], "o": {"k": "v"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEqual(map[string]interface{}{"h": "x", "n": int16(300)}, m.ApplicationProperties()); err != nil {
+		t.Error(err)
+	}
+	want := Map{
+		"s": "str",
+		"l": List{int8(1), int32(-70000), int64(5000000000), uint64(math.MaxUint64), 1.5, true, nil},
+		"o": Map{"k": "v"},
+	}
+	if err := checkEqual(want, m.Body()); err != nil {
+		t.Error(err)
+	}
+
+	// Round trip through BodyJSON, integers greater than 2^53 become strings.
+	body, err := m.BodyJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := MessageFromJSON(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want["l"].(List)[3] = "18446744073709551615"
+	if err := checkEqual(want, m2.Body()); err != nil {
+		t.Error(err)
+	}
+
+	for _, bad := range []string{``, `{"a":`, `[1] [2]`, `{"_headers": [1]}`, `{"_headers": {"a": {}}}`} {
+		if _, err := MessageFromJSON([]byte(bad)); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestMessageDeliveryCount(t *testing.T) {
+	m := NewMessageWith("x")
+	for _, want := range []uint32{0, 3} { // No header section is encoded for 0
+		m.SetDeliveryCount(want)
+		bytes, err := m.Encode(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m2, err := DecodeMessage(bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkEqual(want, m2.DeliveryCount()); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestMessageEncodedSize(t *testing.T) {
+	plain := NewMessageWith("hello")
+	full := NewMessageWith(Map{"k": List{int32(1), "x"}})
+	full.SetDurable(true)
+	full.SetSubject("subject")
+	full.SetApplicationProperties(map[string]interface{}{"p": int64(1)})
+	full.SetMessageAnnotations(map[AnnotationKey]interface{}{AnnotationKeyString("a"): "b"})
+	full.SetFooter(map[AnnotationKey]interface{}{AnnotationKeyString("f"): "g"})
+	large := NewMessage()
+	large.SetData(make([]byte, 100000))
+
+	for _, m := range []Message{NewMessage(), plain, full, large} {
+		bytes, err := m.Encode(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, err := m.EncodedSize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkEqual(len(bytes), size); err != nil {
+			t.Error(err)
+		}
+	}
+
+	m := NewMessage()
+	m.SetTTL(-1)
+	if _, err := m.EncodedSize(); err == nil {
+		t.Error("expected error for negative TTL")
+	}
+}
+
+func TestDecodeCheckIds(t *testing.T) {
+	body := []byte{0x00, 0x53, 0x77, 0x40}
+	for _, x := range []struct {
+		properties []byte
+		want       string
+		id         func(Message) interface{}
+	}{
+		// message-id is the list [1]
+		{[]byte{0x00, 0x53, 0x73, 0xc0, 0x05, 0x01, 0xc0, 0x03, 0x01, 0x54, 0x01},
+			"decoding message: properties message-id is list, must be ulong, uuid, binary or string",
+			Message.MessageId},
+		// correlation-id, the 6th field, is the list [1]
+		{[]byte{0x00, 0x53, 0x73, 0xc0, 0x0a, 0x06, 0x40, 0x40, 0x40, 0x40, 0x40, 0xc0, 0x03, 0x01, 0x54, 0x01},
+			"decoding message: properties correlation-id is list, must be ulong, uuid, binary or string",
+			Message.CorrelationId},
+	} {
+		data := append(x.properties, body...)
+		m := NewMessage()
+		if err := m.Decode(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkEqual(List{int32(1)}, x.id(m)); err != nil {
+			t.Error(err)
+		}
+		if err := m.DecodeCheckIds(data, false); err == nil || err.Error() != x.want {
+			t.Errorf("want %q, got %v", x.want, err)
+		}
+		if err := m.DecodeCheckIds(data, true); err != nil {
+			t.Error(err)
+		}
+		if err := checkEqual("[1]", x.id(m)); err != nil {
+			t.Error(err)
+		}
+		if err := ValidateMessage(m); err != nil {
+			t.Error(err)
+		}
+	}
+
+	m := NewMessageWith("x")
+	m.SetMessageId(uint64(1))
+	m.SetCorrelationId("c")
+	data, err := m.Encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.DecodeCheckIds(data, false); err != nil {
+		t.Error(err)
+	}
+	if err := checkEqual(uint64(1), m.MessageId()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateMessage(t *testing.T) {
+	m := NewMessageWith("x")
+	m.SetMessageId(uint64(1))
+	m.SetApplicationProperties(map[string]interface{}{"a": int32(1)})
+	m.SetMessageAnnotations(map[AnnotationKey]interface{}{AnnotationKeyUint64(1): "v"})
+	if err := ValidateMessage(m); err != nil {
+		t.Error(err)
+	}
+
+	m = NewMessage()
+	m.SetTTL(-1)
+	m2 := NewMessage()
+	m2.SetApplicationProperties(map[string]interface{}{"a": List{}})
+	m3 := NewMessage()
+	m3.SetMessageId(true)
+	m4 := NewMessage()
+	m4.SetApplicationProperties(map[string]interface{}{"a": Map{"k": "v"}})
+	m5 := NewMessage()
+	m5.SetApplicationProperties(map[string]interface{}{"a": Array{IntType, []interface{}{int32(1)}}})
+	m6 := NewMessage()
+	m6.SetApplicationProperties(map[string]interface{}{"a": Described{uint64(1), "v"}})
+	for _, x := range []struct {
+		m    Message
+		want string
+	}{
+		{m, "invalid message header: invalid TTL -1ns, must not be negative"},
+		{m2, `invalid message: application property "a" is list, must be a simple type`},
+		{m3, "invalid message properties message-id: is bool, must be ulong, uuid, binary or string"},
+		{m4, `invalid message: application property "a" is map, must be a simple type`},
+		{m5, `invalid message: application property "a" is array, must be a simple type`},
+		{m6, `invalid message: application property "a" is described, must be a simple type`},
+	} {
+		if err := ValidateMessage(x.m); err == nil || err.Error() != x.want {
+			t.Errorf("want %q, got %v", x.want, err)
+		}
+	}
+
+	// Decoded sections are checked too. Each message has one invalid section and a null body.
+	body := []byte{0x00, 0x53, 0x77, 0x40}
+	for _, x := range []struct {
+		section []byte
+		want    string
+	}{
+		{[]byte{0x00, 0x53, 0x72, 0xc1, 0x07, 0x02, 0xa1, 0x01, 'k', 0xa1, 0x01, 'v'},
+			"invalid message message-annotations: key is string, must be symbol or ulong"},
+		{[]byte{0x00, 0x53, 0x74, 0xc1, 0x07, 0x02, 0xa3, 0x01, 'k', 0xa1, 0x01, 'v'},
+			"invalid message: application property key is symbol, must be string"},
+	} {
+		m, err := DecodeMessage(append(x.section, body...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ValidateMessage(m); err == nil || err.Error() != x.want {
+			t.Errorf("want %q, got %v", x.want, err)
+		}
+	}
+}
@@ -98,16 +98,77 @@ var (
 // Map is a generic map that can have mixed key and value types and so can represent any AMQP map
 type Map map[interface{}]interface{}
 
+// OrderedMap is an AMQP map that keeps its entries in order. It is encoded
+// with the entries in slice order, and an AMQP map unmarshals into it with the
+// entries in encoded order. Use it when the exact encoding of a map matters,
+// for example to sign it. It does not check for duplicate keys, which AMQP
+// does not allow.
+type OrderedMap []MapEntry
+
+// MapEntry is a key and value in an OrderedMap.
+type MapEntry struct {
+	Key, Value interface{}
+}
+
 // List is a generic list that can hold mixed values and can represent any AMQP list.
 //
 type List []interface{}
 
+// Type is an AMQP type code, used as the element type of an Array.
+type Type C.pn_type_t
+
+const (
+	NullType       Type = C.PN_NULL
+	BoolType       Type = C.PN_BOOL
+	UbyteType      Type = C.PN_UBYTE
+	ByteType       Type = C.PN_BYTE
+	UshortType     Type = C.PN_USHORT
+	ShortType      Type = C.PN_SHORT
+	CharType       Type = C.PN_CHAR
+	UintType       Type = C.PN_UINT
+	IntType        Type = C.PN_INT
+	UlongType      Type = C.PN_ULONG
+	LongType       Type = C.PN_LONG
+	TimestampType  Type = C.PN_TIMESTAMP
+	FloatType      Type = C.PN_FLOAT
+	DoubleType     Type = C.PN_DOUBLE
+	Decimal32Type  Type = C.PN_DECIMAL32
+	Decimal64Type  Type = C.PN_DECIMAL64
+	Decimal128Type Type = C.PN_DECIMAL128
+	UUIDType       Type = C.PN_UUID
+	BinaryType     Type = C.PN_BINARY
+	StringType     Type = C.PN_STRING
+	SymbolType     Type = C.PN_SYMBOL
+	DescribedType  Type = C.PN_DESCRIBED
+	ArrayType      Type = C.PN_ARRAY
+	ListType       Type = C.PN_LIST
+	MapType        Type = C.PN_MAP
+)
+
+// String returns the AMQP name of the type, for example "symbol".
+func (t Type) String() string { return C.pn_type_t(t).String() }
+
+// Array is an AMQP array: a sequence of values that all have the same AMQP
+// Type and are encoded with a single constructor. Marshal returns an error if a
+// value does not encode as Type. Arrays of described values are not supported.
+//
+// Use Array for peers that require array fields, and for compact encoding of
+// large sequences of small values. A Go slice or List is encoded as an AMQP list.
+type Array struct {
+	Type   Type
+	Values []interface{}
+}
+
 // Symbol is a string that is encoded as an AMQP symbol
 type Symbol string
 
 func (s Symbol) String() string   { return string(s) }
 func (s Symbol) GoString() string { return fmt.Sprintf("s\"%s\"", s) }
 
+// Char is a Unicode code point that is encoded as an AMQP char.
+// A Go rune is an int32 and is encoded as an AMQP int, use Char for char.
+type Char rune
+
 // Binary is a string that is encoded as an AMQP binary.
 // It is a string rather than a byte[] because byte[] is not hashable and can't be used as
 // a map key, AMQP frequently uses binary types as map keys. It can convert to and from []byte
@@ -116,6 +177,26 @@ type Binary string
 func (b Binary) String() string   { return string(b) }
 func (b Binary) GoString() string { return fmt.Sprintf("b\"%s\"", b) }
 
+// Decimal32 is an AMQP decimal32, an IEEE 754 32-bit decimal floating point
+// value. It holds the raw encoded bits, no arithmetic conversion is done.
+type Decimal32 uint32
+
+// Decimal64 is an AMQP decimal64, an IEEE 754 64-bit decimal floating point
+// value. It holds the raw encoded bits, no arithmetic conversion is done.
+type Decimal64 uint64
+
+// Decimal128 is an AMQP decimal128, an IEEE 754 128-bit decimal floating point
+// value. It holds the raw encoded bytes, no arithmetic conversion is done.
+type Decimal128 [16]byte
+
+// UUID is an AMQP 128-bit universally unique identifier, as defined by RFC-4122 section 4.1.2
+type UUID [16]byte
+
+// String formats the UUID in the canonical lower-case 8-4-4-4-12 hexadecimal form.
+func (u UUID) String() string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
 // GoString for Map prints values with their types, useful for debugging.
 func (m Map) GoString() string {
 	out := &bytes.Buffer{}
@@ -147,19 +228,56 @@ func (l List) GoString() string {
 }
 
 // pnTime converts Go time.Time to Proton millisecond Unix time.
-func pnTime(t time.Time) C.pn_timestamp_t {
-	secs := t.Unix()
-	// Note: sub-second accuracy is not guaraunteed if the Unix time in
-	// nanoseconds cannot be represented by an int64 (sometime around year 2260)
-	msecs := (t.UnixNano() % int64(time.Second)) / int64(time.Millisecond)
-	return C.pn_timestamp_t(secs*1000 + msecs)
+//
+// Note: t.isZero() is converted to C.pn_timestamp_t(0) and vice-versa. These
+// are used as "not set" sentinel values by the Go and Proton APIs, so it is
+// better to conserve the "zeroness" even though they don't represent the same
+// time instant.
+//
+func pnTime(t time.Time) (pnt C.pn_timestamp_t) {
+	if !t.IsZero() {
+		pnt = C.pn_timestamp_t(t.Unix()*1000 + int64(t.Nanosecond())/int64(time.Millisecond))
+	}
+	return
 }
 
 // goTime converts a pn_timestamp_t to a Go time.Time.
-func goTime(t C.pn_timestamp_t) time.Time {
-	secs := int64(t) / 1000
-	nsecs := (int64(t) % 1000) * int64(time.Millisecond)
-	return time.Unix(secs, nsecs)
+//
+// Note: C.pn_timestamp_t(0) is converted to a zero time.Time, see pnTime.
+//
+func goTime(pnt C.pn_timestamp_t) (t time.Time) {
+	if pnt != 0 {
+		t = time.Unix(int64(pnt/1000), int64(pnt%1000)*int64(time.Millisecond))
+	}
+	return
+}
+
+func pnDecimal128(d Decimal128) (pn C.pn_decimal128_t) {
+	for i := range d {
+		pn.bytes[i] = C.char(d[i])
+	}
+	return
+}
+
+func goDecimal128(pn C.pn_decimal128_t) (d Decimal128) {
+	for i := range d {
+		d[i] = byte(pn.bytes[i])
+	}
+	return
+}
+
+func pnUUID(u UUID) (pn C.pn_uuid_t) {
+	for i := range u {
+		pn.bytes[i] = C.char(u[i])
+	}
+	return
+}
+
+func goUUID(pn C.pn_uuid_t) (u UUID) {
+	for i := range u {
+		u[i] = byte(pn.bytes[i])
+	}
+	return
 }
 
 func goBytes(cBytes C.pn_bytes_t) (bytes []byte) {
@@ -213,8 +331,20 @@ func (k AnnotationKey) String() string { return fmt.Sprintf("%v", k.Get()) }
 
 // Described represents an AMQP described type, which is really
 // just a pair of AMQP values - the first is treated as a "descriptor",
-// and is normally a string or ulong providing information about the type.
+// and is normally a symbol or ulong providing information about the type.
 // The second is the "value" and can be any AMQP value.
+//
+// The AMQP type of the descriptor is preserved when decoding, a symbol
+// descriptor decodes as Symbol and a ulong descriptor as uint64.
+//
+// An AMQP composite type, such as an error or a link source, is a Described
+// with the type's descriptor and a List of its fields in order, with nil for
+// absent fields. For example an amqp:error:list:
+//
+//	Described{uint64(0x1d), List{Symbol("amqp:not-found"), "no such node", nil}}
+//
+// A peer may omit trailing absent fields, so a decoded List can be shorter
+// than the full list of fields.
 type Described struct {
 	Descriptor interface{}
 	Value      interface{}
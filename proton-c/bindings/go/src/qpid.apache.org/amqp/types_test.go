@@ -21,8 +21,10 @@ package amqp
 
 import (
 	"fmt"
+	"math"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func checkEqual(want interface{}, got interface{}) error {
@@ -60,7 +62,9 @@ var rtValues = []interface{}{
 	int8(-8), int16(-16), int32(-32), int64(-64),
 	uint8(8), uint16(16), uint32(32), uint64(64),
 	float32(0.32), float64(0.64),
-	"string", Binary("Binary"), Symbol("symbol"),
+	"string", Binary("Binary"), Symbol("symbol"), Char('é'),
+	Decimal32(0x32), Decimal64(0x64), Decimal128{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+	UUID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
 	nil,
 	Map{"V": "X"},
 	List{"V", int32(1)},
@@ -85,7 +89,9 @@ var vstrings = []string{
 	"-8", "-16", "-32", "-64",
 	"8", "16", "32", "64",
 	"0.32", "0.64",
-	"string", "Binary", "symbol",
+	"string", "Binary", "symbol", "233",
+	"50", "100", "[1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16]",
+	"01020304-0506-0708-090a-0b0c0d0e0f10",
 	"<nil>",
 	"map[V:X]",
 	"[V 1]",
@@ -135,6 +141,109 @@ func TestTypesRoundTripAll(t *testing.T) {
 	}
 }
 
+// Numeric types at their boundaries round trip to the same type and value.
+func TestNumericRoundTrip(t *testing.T) {
+	values := []interface{}{
+		int8(math.MinInt8), int8(-1), int8(math.MaxInt8),
+		int16(math.MinInt16), int16(-1), int16(math.MaxInt16),
+		int32(math.MinInt32), int32(-1), int32(math.MaxInt32),
+		int64(math.MinInt64), int64(-1), int64(math.MaxInt64),
+		uint8(0), uint8(math.MaxUint8),
+		uint16(0), uint16(math.MaxUint16),
+		uint32(0), uint32(math.MaxUint32),
+		uint64(0), uint64(math.MaxUint64),
+		float32(-math.MaxFloat32), float32(math.SmallestNonzeroFloat32),
+		-math.MaxFloat64, math.SmallestNonzeroFloat64,
+		Char(0), Char('a'), Char(0x10FFFF),
+	}
+	for _, x := range values {
+		marshalled, err := Marshal(x, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v interface{}
+		if err := checkUnmarshal(marshalled, &v); err != nil {
+			t.Error(err)
+		}
+		if err := checkEqual(x, v); err != nil {
+			t.Error(err)
+		}
+		vp := reflect.New(reflect.TypeOf(x))
+		if err := checkUnmarshal(marshalled, vp.Interface()); err != nil {
+			t.Error(err)
+		}
+		if err := checkEqual(x, vp.Elem().Interface()); err != nil {
+			t.Error(err)
+		}
+	}
+	// A char can also unmarshal into a wide enough integer.
+	marshalled, _ := Marshal(Char(0x10FFFF), nil)
+	var i int32
+	if err := checkUnmarshal(marshalled, &i); err != nil {
+		t.Error(err)
+	}
+	if err := checkEqual(int32(0x10FFFF), i); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestArray(t *testing.T) {
+	for _, a := range []Array{
+		{SymbolType, []interface{}{Symbol("a"), Symbol("b")}},
+		{IntType, []interface{}{int32(1), int32(2), int32(3)}},
+		{ListType, []interface{}{List{"x"}, List{int64(1), true}}},
+		{NullType, []interface{}{nil, nil}},
+		{StringType, []interface{}{}},
+	} {
+		bytes, err := Marshal(a, nil)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if bytes[0] != 0xe0 && bytes[0] != 0xf0 {
+			t.Errorf("%v: not encoded as an array: %x", a, bytes)
+		}
+		var v interface{}
+		if err := checkUnmarshal(bytes, &v); err != nil {
+			t.Error(err)
+		}
+		if err := checkEqual(a, v); err != nil {
+			t.Error(err)
+		}
+	}
+	// A list stays a list
+	bytes, err := Marshal(List{Symbol("a")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v interface{}
+	if err := checkUnmarshal(bytes, &v); err != nil {
+		t.Error(err)
+	}
+	if err := checkEqual(List{Symbol("a")}, v); err != nil {
+		t.Error(err)
+	}
+	// An array unmarshals into a slice
+	bytes, err = Marshal(Array{SymbolType, []interface{}{Symbol("a"), Symbol("b")}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var symbols []Symbol
+	if err := checkUnmarshal(bytes, &symbols); err != nil {
+		t.Error(err)
+	}
+	if err := checkEqual([]Symbol{"a", "b"}, symbols); err != nil {
+		t.Error(err)
+	}
+	// Values must match the element type
+	if _, err := Marshal(Array{SymbolType, []interface{}{Symbol("a"), "b"}}, nil); err == nil {
+		t.Error("expected error for string in array of symbol")
+	}
+	if err := checkEqual("symbol", SymbolType.String()); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestTypesPrint(t *testing.T) {
 	// Default %v representations of rtValues and oddValues
 	for i, x := range allValues {
@@ -195,3 +304,108 @@ func TestDescribed(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestDescribedDescriptorTypes(t *testing.T) {
+	for _, want := range []Described{
+		{Symbol("x-opt-jms-msg-type"), int8(1)},
+		{uint64(0x77), Map{Symbol("k"): "v"}},
+	} {
+		marshalled, err := Marshal(want, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var d Described
+		if err := checkUnmarshal(marshalled, &d); err != nil {
+			t.Error(err)
+		}
+		if err := checkEqual(want, d); err != nil {
+			t.Error(err)
+		}
+		var i interface{}
+		if err := checkUnmarshal(marshalled, &i); err != nil {
+			t.Error(err)
+		}
+		if err := checkEqual(want, i); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestDescribedComposite(t *testing.T) {
+	// A source: address, durable, expiry-policy, timeout, dynamic,
+	// dynamic-node-properties, distribution-mode, filter, default-outcome,
+	// outcomes, capabilities.
+	want := Described{uint64(0x28), List{
+		"queue", uint32(0), Symbol("session-end"), uint32(0), false,
+		nil, Symbol("move"), nil, nil, nil,
+		Array{SymbolType, []interface{}{Symbol("queue")}},
+	}}
+	marshalled, err := Marshal(want, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d Described
+	if err := checkUnmarshal(marshalled, &d); err != nil {
+		t.Error(err)
+	}
+	if err := checkEqual(want, d); err != nil {
+		t.Error(err)
+	}
+	// A nested composite: a rejected outcome with an error.
+	want = Described{uint64(0x25), List{
+		Described{uint64(0x1d), List{Symbol("amqp:not-found"), "no such node", nil}},
+	}}
+	marshalled, err = Marshal(want, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var i interface{}
+	if err := checkUnmarshal(marshalled, &i); err != nil {
+		t.Error(err)
+	}
+	if err := checkEqual(want, i); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecimalNotFloat(t *testing.T) {
+	marshalled, _ := Marshal(Decimal64(0x2238000000000001), nil)
+	var f float64
+	if _, err := Unmarshal(marshalled, &f); err == nil {
+		t.Errorf("decimal64 unmarshaled to float64: %v", f)
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	now := time.Unix(1500000000, 42*int64(time.Millisecond))
+	marshalled, err := Marshal(now, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got time.Time
+	if err := checkUnmarshal(marshalled, &got); err != nil {
+		t.Error(err)
+	}
+	if !got.Equal(now) {
+		t.Errorf("%v != %v", now, got)
+	}
+	var i interface{}
+	if err := checkUnmarshal(marshalled, &i); err != nil {
+		t.Error(err)
+	}
+	if got, ok := i.(time.Time); !ok || !got.Equal(now) {
+		t.Errorf("%v != %#v", now, i)
+	}
+	var n int64
+	if _, err := Unmarshal(marshalled, &n); err == nil {
+		t.Errorf("timestamp unmarshaled to int64: %v", n)
+	}
+	// Zero time round trips
+	marshalled, _ = Marshal(time.Time{}, nil)
+	if err := checkUnmarshal(marshalled, &got); err != nil {
+		t.Error(err)
+	}
+	if !got.IsZero() {
+		t.Errorf("expected zero time, got %v", got)
+	}
+}
@@ -28,6 +28,7 @@ import (
 	"io"
 	"reflect"
 	"strings"
+	"time"
 	"unsafe"
 )
 
@@ -113,6 +114,24 @@ func (d *Decoder) Buffered() io.Reader {
 	return bytes.NewReader(d.buffer.Bytes())
 }
 
+// More returns true if there is more data to decode. It reads from the
+// underlying Reader if the buffer is empty, so it may block.
+//
+// To decode a sequence of AMQP values packed in a byte slice:
+//
+//	d := NewDecoder(bytes.NewReader(data))
+//	for d.More() {
+//	    var v interface{}
+//	    if err := d.Decode(&v); err != nil { ... }
+//	}
+//
+func (d *Decoder) More() bool {
+	if d.buffer.Len() == 0 {
+		_ = d.more()
+	}
+	return d.buffer.Len() > 0
+}
+
 // Decode reads the next AMQP value from the Reader and stores it in the value pointed to by v.
 //
 // See the documentation for Unmarshal for details about the conversion of AMQP into a Go value.
@@ -158,13 +177,28 @@ Types are converted as follows:
  +------------------------+-------------------------------------------------+
  |Symbol                  |symbol                                           |
  +------------------------+-------------------------------------------------+
+ |Char                    |char                                             |
+ +------------------------+-------------------------------------------------+
  |map[K]T                 |map, provided all keys and values can unmarshal  |
  |                        |to types K,T                                     |
  +------------------------+-------------------------------------------------+
  |Map                     |map, any AMQP map                                |
  +------------------------+-------------------------------------------------+
+ |OrderedMap              |map, any AMQP map, entries in encoded order      |
+ +------------------------+-------------------------------------------------+
  |Described               |described type                                   |
  +------------------------+-------------------------------------------------+
+ |Array                   |array                                            |
+ +------------------------+-------------------------------------------------+
+ |[]T                     |list or array, provided all values can unmarshal |
+ |                        |to type T                                        |
+ +------------------------+-------------------------------------------------+
+ |struct                  |map with string or symbol keys, see Marshal      |
+ +------------------------+-------------------------------------------------+
+
+An AMQP map unmarshals into a struct by matching keys to field names or
+"amqp" field tags as described for Marshal. Map entries with no matching field
+are ignored, fields with no matching map entry are left unchanged.
 
 An AMQP described type can unmarshal into the corresponding plain type, discarding the descriptor.
 For example an AMQP described string can unmarshal into a plain go string.
@@ -187,6 +221,15 @@ Any AMQP type can unmarshal to an interface{}, the Go type used to unmarshal is
  +------------------------+-------------------------------------------------+
  |symbol                  |Symbol                                           |
  +------------------------+-------------------------------------------------+
+ |char                    |Char                                             |
+ +------------------------+-------------------------------------------------+
+ |decimal32, decimal64,   |Decimal32, Decimal64, Decimal128                 |
+ |decimal128              |                                                 |
+ +------------------------+-------------------------------------------------+
+ |timestamp               |time.Time                                        |
+ +------------------------+-------------------------------------------------+
+ |uuid                    |UUID                                             |
+ +------------------------+-------------------------------------------------+
  |binary                  |Binary                                           |
  +------------------------+-------------------------------------------------+
  |null                    |nil                                              |
@@ -195,14 +238,17 @@ Any AMQP type can unmarshal to an interface{}, the Go type used to unmarshal is
  +------------------------+-------------------------------------------------+
  |list                    |List                                             |
  +------------------------+-------------------------------------------------+
+ |array                   |Array                                            |
+ +------------------------+-------------------------------------------------+
  |described type          |Described                                        |
  +--------------------------------------------------------------------------+
 
-The following Go types cannot be unmarshaled: uintptr, function, interface, channel, array (use slice), struct
+The following Go types cannot be unmarshaled: uintptr, function, interface, channel, array (use slice)
 
-TODO: Not yet implemented:
+A timestamp of 0 unmarshals as the zero time.Time, and vice-versa for Marshal, since both
+are used to mean "not set".
 
-AMQP types: decimal32/64/128, char (round trip), timestamp, uuid.
+TODO: Not yet implemented:
 
 AMQP maps with mixed key types, or key types that are not legal Go map keys.
 */
@@ -381,6 +427,14 @@ func unmarshal(v interface{}, data *C.pn_data_t) {
 			panic(newUnmarshalError(pnType, v))
 		}
 
+	case *Char:
+		switch pnType {
+		case C.PN_CHAR:
+			*v = Char(C.pn_data_get_char(data))
+		default:
+			panic(newUnmarshalError(pnType, v))
+		}
+
 	case *uint:
 		switch pnType {
 		case C.PN_CHAR:
@@ -459,13 +513,62 @@ func unmarshal(v interface{}, data *C.pn_data_t) {
 			panic(newUnmarshalError(pnType, v))
 		}
 
+	case *Decimal32:
+		switch pnType {
+		case C.PN_DECIMAL32:
+			*v = Decimal32(C.pn_data_get_decimal32(data))
+		default:
+			panic(newUnmarshalError(pnType, v))
+		}
+
+	case *Decimal64:
+		switch pnType {
+		case C.PN_DECIMAL64:
+			*v = Decimal64(C.pn_data_get_decimal64(data))
+		default:
+			panic(newUnmarshalError(pnType, v))
+		}
+
+	case *Decimal128:
+		switch pnType {
+		case C.PN_DECIMAL128:
+			*v = goDecimal128(C.pn_data_get_decimal128(data))
+		default:
+			panic(newUnmarshalError(pnType, v))
+		}
+
+	case *time.Time:
+		switch pnType {
+		case C.PN_TIMESTAMP:
+			*v = goTime(C.pn_data_get_timestamp(data))
+		default:
+			panic(newUnmarshalError(pnType, v))
+		}
+
+	case *UUID:
+		switch pnType {
+		case C.PN_UUID:
+			*v = goUUID(C.pn_data_get_uuid(data))
+		default:
+			panic(newUnmarshalError(pnType, v))
+		}
+
 	case *interface{}:
 		getInterface(data, v)
 
+	case *Array:
+		getArray(data, v)
+
+	case *OrderedMap:
+		getOrderedMap(data, v)
+
 	case *AnnotationKey:
-		if pnType == C.PN_ULONG || pnType == C.PN_SYMBOL || pnType == C.PN_STRING {
+		switch pnType {
+		case C.PN_ULONG, C.PN_SYMBOL:
 			unmarshal(&v.value, data)
-		} else {
+		case C.PN_STRING: // Not allowed by the spec, treat as a symbol like AnnotationKeyString()
+			v.value = Symbol(goBytes(C.pn_data_get_string(data)))
+		default:
 			panic(newUnmarshalError(pnType, v))
 		}
 
@@ -478,6 +581,10 @@ func unmarshal(v interface{}, data *C.pn_data_t) {
 			getMap(data, v)
 		case reflect.Slice:
 			getList(data, v)
+		case reflect.Struct:
+			getStruct(data, v)
+		case reflect.Ptr:
+			getPointer(data, v)
 		default:
 			panic(newUnmarshalError(pnType, v))
 		}
@@ -514,7 +621,7 @@ func getInterface(data *C.pn_data_t, v *interface{}) {
 	case C.PN_INT:
 		*v = int32(C.pn_data_get_int(data))
 	case C.PN_CHAR:
-		*v = uint8(C.pn_data_get_char(data))
+		*v = Char(C.pn_data_get_char(data))
 	case C.PN_ULONG:
 		*v = uint64(C.pn_data_get_ulong(data))
 	case C.PN_LONG:
@@ -529,6 +636,16 @@ func getInterface(data *C.pn_data_t, v *interface{}) {
 		*v = goString(C.pn_data_get_string(data))
 	case C.PN_SYMBOL:
 		*v = Symbol(goString(C.pn_data_get_symbol(data)))
+	case C.PN_TIMESTAMP:
+		*v = goTime(C.pn_data_get_timestamp(data))
+	case C.PN_UUID:
+		*v = goUUID(C.pn_data_get_uuid(data))
+	case C.PN_DECIMAL32:
+		*v = Decimal32(C.pn_data_get_decimal32(data))
+	case C.PN_DECIMAL64:
+		*v = Decimal64(C.pn_data_get_decimal64(data))
+	case C.PN_DECIMAL128:
+		*v = goDecimal128(C.pn_data_get_decimal128(data))
 	case C.PN_MAP:
 		m := make(Map)
 		unmarshal(&m, data)
@@ -541,6 +658,10 @@ func getInterface(data *C.pn_data_t, v *interface{}) {
 		d := Described{}
 		unmarshal(&d, data)
 		*v = d
+	case C.PN_ARRAY:
+		a := Array{}
+		unmarshal(&a, data)
+		*v = a
 	case C.PN_NULL:
 		*v = nil
 	case C.PN_INVALID:
@@ -577,14 +698,122 @@ func getMap(data *C.pn_data_t, v interface{}) {
 	}
 }
 
-func getList(data *C.pn_data_t, v interface{}) {
+func getOrderedMap(data *C.pn_data_t, v *OrderedMap) {
 	pnType := C.pn_data_type(data)
-	if pnType != C.PN_LIST {
+	if pnType != C.PN_MAP {
 		panic(newUnmarshalError(pnType, v))
 	}
-	count := int(C.pn_data_get_list(data))
-	listValue := reflect.MakeSlice(reflect.TypeOf(v).Elem(), count, count)
+	count := int(C.pn_data_get_map(data))
+	m := make(OrderedMap, 0, count/2)
 	if bool(C.pn_data_enter(data)) {
+		defer C.pn_data_exit(data)
+		for i := 0; i < count/2; i++ {
+			var e MapEntry
+			if bool(C.pn_data_next(data)) {
+				unmarshal(&e.Key, data)
+				if bool(C.pn_data_next(data)) {
+					unmarshal(&e.Value, data)
+				}
+				m = append(m, e)
+			}
+		}
+	}
+	*v = m
+}
+
+// get into struct pointed at by v
+func getStruct(data *C.pn_data_t, v interface{}) {
+	pnType := C.pn_data_type(data)
+	if pnType != C.PN_MAP {
+		panic(newUnmarshalError(pnType, v))
+	}
+	structValue := reflect.ValueOf(v).Elem()
+	fields := make(map[string]int)
+	for _, f := range structFields(structValue.Type()) {
+		fields[f.name] = f.index
+	}
+	count := int(C.pn_data_get_map(data))
+	if bool(C.pn_data_enter(data)) {
+		defer C.pn_data_exit(data)
+		for i := 0; i < count/2; i++ {
+			if bool(C.pn_data_next(data)) {
+				var key string
+				switch keyType := C.pn_data_type(data); keyType {
+				case C.PN_STRING, C.PN_SYMBOL:
+					unmarshal(&key, data)
+				default:
+					panic(newUnmarshalErrorMsg(keyType, v, "map key is not a string or symbol"))
+				}
+				if bool(C.pn_data_next(data)) {
+					if index, ok := fields[key]; ok {
+						unmarshal(structValue.Field(index).Addr().Interface(), data)
+					}
+				}
+			}
+		}
+	}
+}
+
+// get into the pointer pointed at by v, allocate a new value if it is nil.
+// AMQP null sets the pointer to nil.
+func getPointer(data *C.pn_data_t, v interface{}) {
+	ptrValue := reflect.ValueOf(v).Elem()
+	if C.pn_data_type(data) == C.PN_NULL {
+		ptrValue.Set(reflect.Zero(ptrValue.Type()))
+		return
+	}
+	if ptrValue.IsNil() {
+		ptrValue.Set(reflect.New(ptrValue.Type().Elem()))
+	}
+	unmarshal(ptrValue.Interface(), data)
+}
+
+// enterArray enters an array and moves past the descriptor if it is
+// described, the next value is the first element of the array.
+func enterArray(data *C.pn_data_t) bool {
+	described := bool(C.pn_data_is_array_described(data))
+	if !bool(C.pn_data_enter(data)) {
+		return false
+	}
+	if described {
+		C.pn_data_next(data)
+	}
+	return true
+}
+
+// get an array into v, discarding the descriptor of a described array.
+func getArray(data *C.pn_data_t, v *Array) {
+	pnType := C.pn_data_type(data)
+	if pnType != C.PN_ARRAY {
+		panic(newUnmarshalError(pnType, v))
+	}
+	count := int(C.pn_data_get_array(data))
+	*v = Array{Type: Type(C.pn_data_get_array_type(data)), Values: make([]interface{}, count)}
+	if enterArray(data) {
+		for i := 0; i < count; i++ {
+			if bool(C.pn_data_next(data)) {
+				unmarshal(&v.Values[i], data)
+			}
+		}
+		C.pn_data_exit(data)
+	}
+}
+
+func getList(data *C.pn_data_t, v interface{}) {
+	var count int
+	var entered bool
+	switch pnType := C.pn_data_type(data); pnType {
+	case C.PN_LIST:
+		count = int(C.pn_data_get_list(data))
+		entered = bool(C.pn_data_enter(data))
+	case C.PN_ARRAY:
+		count = int(C.pn_data_get_array(data))
+		entered = enterArray(data)
+	default:
+		panic(newUnmarshalError(pnType, v))
+	}
+	listValue := reflect.MakeSlice(reflect.TypeOf(v).Elem(), count, count)
+	if entered {
 		for i := 0; i < count; i++ {
 			if bool(C.pn_data_next(data)) {
 				val := reflect.New(listValue.Type().Elem())
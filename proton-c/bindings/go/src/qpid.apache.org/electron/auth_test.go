@@ -22,6 +22,7 @@ package electron
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -85,6 +86,99 @@ func TestAuthBadUser(t *testing.T) {
 	}
 }
 
+func TestSASLMech(t *testing.T) {
+	accept := func(mech, user, password string) (bool, error) { return true, nil }
+	for _, c := range []struct {
+		copts, sopts []ConnectionOption
+		mech         string
+	}{
+		{[]ConnectionOption{SASLAllowedMechs("ANONYMOUS")},
+			[]ConnectionOption{SASLAllowInsecure(true), SASLAuthenticator("PLAIN ANONYMOUS", accept)},
+			"ANONYMOUS"},
+		{[]ConnectionOption{SASLAllowInsecure(true), SASLAllowedMechs("PLAIN"), User("fred"), Password([]byte("xxx"))},
+			[]ConnectionOption{SASLAllowInsecure(true), SASLAuthenticator("PLAIN ANONYMOUS", accept)},
+			"PLAIN"},
+	} {
+		mechs := make(chan string, 1)
+		client, server := newClientServerOpts(t, c.copts, c.sopts)
+		go func() {
+			for in := range server.Incoming() {
+				if in, ok := in.(*IncomingConnection); ok {
+					mechs <- in.SASLMech()
+				}
+				in.Accept()
+			}
+		}()
+		fatalIf(t, client.Sync())
+		errorIf(t, checkEqual(c.mech, client.Connection().SASLMech()))
+		errorIf(t, checkEqual(c.mech, server.SASLMech()))
+		closeClientServer(client, server)
+	}
+}
+
+func TestSASLAuthenticator(t *testing.T) {
+	type call struct{ mech, user, password string }
+	calls := make(chan call, 10)
+	authenticate := func(mech, user, password string) (bool, error) {
+		calls <- call{mech, user, password}
+		switch password {
+		case "xxx", "":
+			return true, nil
+		case "error":
+			return false, fmt.Errorf("no user database")
+		default:
+			return false, nil
+		}
+	}
+	sopts := []ConnectionOption{SASLAllowInsecure(true), SASLAuthenticator("PLAIN ANONYMOUS", authenticate)}
+
+	got, err := testAuthClientServer(t,
+		[]ConnectionOption{SASLAllowInsecure(true), SASLAllowedMechs("PLAIN"), User("fred"), Password([]byte("xxx"))},
+		sopts)
+	fatalIf(t, err)
+	errorIf(t, checkEqual(connectionSettings{user: "fred"}, got))
+	errorIf(t, checkEqual(call{"PLAIN", "fred", "xxx"}, <-calls))
+
+	got, err = testAuthClientServer(t,
+		[]ConnectionOption{SASLAllowedMechs("ANONYMOUS")},
+		sopts)
+	fatalIf(t, err)
+	errorIf(t, checkEqual(connectionSettings{user: "anonymous"}, got))
+	errorIf(t, checkEqual("ANONYMOUS", (<-calls).mech))
+
+	for _, password := range []string{"yyy", "error"} {
+		_, err = testAuthClientServer(t,
+			[]ConnectionOption{SASLAllowInsecure(true), SASLAllowedMechs("PLAIN"), User("fred"), Password([]byte(password))},
+			sopts)
+		if err == nil {
+			t.Errorf("expected auth failure for password %q", password)
+		}
+		errorIf(t, checkEqual(call{"PLAIN", "fred", password}, <-calls))
+	}
+
+	// PLAIN is not offered over an unencrypted connection by default.
+	_, err = testAuthClientServer(t,
+		[]ConnectionOption{SASLAllowInsecure(true), SASLAllowedMechs("PLAIN"), User("fred"), Password([]byte("xxx"))},
+		[]ConnectionOption{SASLAuthenticator("PLAIN", authenticate)})
+	if err == nil {
+		t.Error("expected auth failure for insecure PLAIN")
+	}
+	errorIf(t, checkEqual(0, len(calls)))
+
+	// Unsupported mechanisms and client connections are an error.
+	for _, opts := range [][]ConnectionOption{
+		{Server(), SASLAuthenticator("CRAM-MD5", authenticate)},
+		{SASLAuthenticator("PLAIN", authenticate)},
+	} {
+		cConn, sConn := net.Pipe()
+		if c, err := NewConnection(cConn, opts...); err == nil {
+			t.Error("expected error for bad SASLAuthenticator option")
+			c.Close(nil)
+		}
+		sConn.Close()
+	}
+}
+
 var confDir string
 var confErr error
 
@@ -0,0 +1,188 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package electron
+
+import (
+	"context"
+	"fmt"
+	"qpid.apache.org/amqp"
+	"sync"
+)
+
+// Client makes request-response calls on a Connection.
+//
+// All responses arrive on a single receiver with a dynamic source. Each request
+// is sent with the receiver's address as reply-to and a new correlation-id, the
+// response is returned to the caller that sent the matching correlation-id. A
+// Client is safe for concurrent use.
+//
+// The server must copy the request's correlation-id to its response and send
+// it to the request's reply-to address.
+type Client struct {
+	conn     Connection
+	receiver Receiver
+
+	lock    sync.Mutex
+	senders map[string]Sender
+	calls   map[interface{}]chan amqp.Message
+	nextId  uint64
+	err     error // Set when the Client can no longer receive responses
+}
+
+// NewClient creates a Client that makes calls on conn. It waits for the remote
+// peer to assign the reply-to address for responses.
+func NewClient(conn Connection) (*Client, error) {
+	r, err := conn.Receiver(SourceSettings(TerminusSettings{Dynamic: true}), Prefetch(true))
+	if err == nil {
+		err = r.Sync()
+	}
+	if err == nil && r.Source() == "" {
+		err = fmt.Errorf("no address assigned to dynamic receiver %s", r)
+	}
+	if err != nil {
+		if r != nil {
+			r.Close(nil)
+		}
+		return nil, err
+	}
+	c := &Client{
+		conn:     conn,
+		receiver: r,
+		senders:  make(map[string]Sender),
+		calls:    make(map[interface{}]chan amqp.Message),
+	}
+	go c.run()
+	return c, nil
+}
+
+// ReplyTo is the address the Client receives responses on.
+func (c *Client) ReplyTo() string { return c.receiver.Source() }
+
+// Call sends req to address and waits for the response, or until ctx is done.
+//
+// req is not modified, a copy is sent with the Client's reply-to address and a
+// new correlation-id.
+func (c *Client) Call(ctx context.Context, address string, req amqp.Message) (amqp.Message, error) {
+	m := amqp.NewMessage()
+	if err := m.Copy(req); err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	if c.err != nil {
+		c.lock.Unlock()
+		return nil, c.err
+	}
+	c.nextId++
+	id := c.nextId
+	response := make(chan amqp.Message, 1)
+	c.calls[id] = response
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.calls, id)
+		c.lock.Unlock()
+	}()
+
+	m.SetReplyTo(c.ReplyTo())
+	m.SetCorrelationId(id)
+	s, err := c.sender(address)
+	if err != nil {
+		return nil, err
+	}
+	if out := s.SendSyncContext(ctx, m); out.Error != nil {
+		return nil, out.Error
+	} else if out.Status != Accepted {
+		return nil, fmt.Errorf("request to %q was %s", address, out.Status)
+	}
+	select {
+	case res, ok := <-response:
+		if !ok {
+			return nil, c.error()
+		}
+		return res, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close closes the Client's links, calls in progress and later calls return
+// Closed. The Connection is not closed.
+func (c *Client) Close() {
+	c.lock.Lock()
+	if c.err == nil {
+		c.err = Closed
+	}
+	for _, s := range c.senders {
+		s.Close(nil)
+	}
+	c.lock.Unlock()
+	c.receiver.Close(nil)
+}
+
+func (c *Client) error() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// sender returns the Sender for address, opening one on the first call.
+func (c *Client) sender(address string) (Sender, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	if s := c.senders[address]; s != nil && s.Error() == nil {
+		return s, nil
+	}
+	s, err := c.conn.Sender(Target(address))
+	if err != nil {
+		return nil, err
+	}
+	c.senders[address] = s
+	return s, nil
+}
+
+// run receives responses and passes them to waiting calls. Responses that
+// don't match a call in progress are dropped.
+func (c *Client) run() {
+	for {
+		rm, err := c.receiver.Receive()
+		if err != nil {
+			c.lock.Lock()
+			if c.err == nil {
+				c.err = err
+			}
+			for id, response := range c.calls {
+				close(response)
+				delete(c.calls, id)
+			}
+			c.lock.Unlock()
+			return
+		}
+		_ = rm.Accept()
+		c.lock.Lock()
+		if response, ok := c.calls[rm.Message.CorrelationId()]; ok {
+			response <- rm.Message // Buffered, only one response per call.
+			delete(c.calls, rm.Message.CorrelationId())
+		}
+		c.lock.Unlock()
+	}
+}
@@ -23,7 +23,10 @@ package electron
 import "C"
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"qpid.apache.org/amqp"
 	"qpid.apache.org/proton"
 	"sync"
 	"time"
@@ -34,6 +37,13 @@ type ConnectionSettings interface {
 	// Authenticated user name associated with the connection.
 	User() string
 
+	// SASLMech is the SASL mechanism that authenticated the connection, for
+	// example "ANONYMOUS" or "PLAIN", or "" if the peer did not use SASL. Use
+	// SASLAllowedMechs("ANONYMOUS") to connect anonymously without credentials
+	// to a server that offers other mechanisms too. Available once the remote
+	// peer has opened the connection, for a client that means after Sync().
+	SASLMech() string
+
 	// The AMQP virtual host name for the connection.
 	//
 	// Optional, useful when the server has multiple names and provides different
@@ -50,8 +60,40 @@ type ConnectionSettings interface {
 	// has requested of us. If the interval expires an empty "heartbeat" frame
 	// will be sent automatically to keep the connection open.
 	Heartbeat() time.Duration
+
+	// RemoteContainer is the container-id of the remote peer, use it to identify
+	// the peer across re-connects. Available once the remote peer has opened the
+	// connection, for a client that means after Sync().
+	RemoteContainer() string
+
+	// RemoteHostname is the host name sent by the remote peer when it opened the
+	// connection. For a server this is the same as VirtualHost().
+	RemoteHostname() string
+
+	// RemoteProperties are the connection properties sent by the remote peer,
+	// nil if there are none. Available once the remote peer has opened the
+	// connection.
+	RemoteProperties() amqp.Map
+
+	// RemoteOfferedCapabilities are the capabilities the remote peer supports.
+	// Available once the remote peer has opened the connection.
+	RemoteOfferedCapabilities() []amqp.Symbol
+
+	// RemoteDesiredCapabilities are the capabilities the remote peer would like
+	// us to support. Available once the remote peer has opened the connection.
+	RemoteDesiredCapabilities() []amqp.Symbol
+
+	// RemoteAnonymousRelay is true if the remote peer offers the
+	// AnonymousRelayCapability, so a sender opened with the AnonymousRelay()
+	// option can send messages to any address. Available once the remote peer
+	// has opened the connection.
+	RemoteAnonymousRelay() bool
 }
 
+// AnonymousRelayCapability is the connection capability offered by a peer that
+// routes messages sent on a link with no target address, see AnonymousRelay().
+const AnonymousRelayCapability = amqp.Symbol("ANONYMOUS-RELAY")
+
 // Connection is an AMQP connection, created by a Container.
 type Connection interface {
 	Endpoint
@@ -76,12 +118,22 @@ type Connection interface {
 	// Disconnect the connection abruptly with an error.
 	Disconnect(error)
 
+	// CloseContext is like Close, it sends an AMQP close and waits for the remote
+	// peer to close the connection. If ctx is done first the connection is
+	// disconnected abruptly and ctx.Err() is returned. Returns nil if the remote
+	// peer closed the connection.
+	CloseContext(ctx context.Context, err error) error
+
 	// Wait waits for the connection to be disconnected.
 	Wait() error
 
 	// WaitTimeout is like Wait but returns Timeout if the timeout expires.
 	WaitTimeout(time.Duration) error
 
+	// WaitContext is like Wait but returns ctx.Err() if ctx is done first.
+	// The connection is not affected.
+	WaitContext(ctx context.Context) error
+
 	// Incoming returns a channel for incoming endpoints opened by the remote peer.
 	// See the Incoming interface for more.
 	//
@@ -92,13 +144,34 @@ type Connection interface {
 }
 
 type connectionSettings struct {
-	user, virtualHost string
-	heartbeat         time.Duration
+	user, virtualHost, saslMech                          string
+	remoteContainer, remoteHostname                      string
+	heartbeat                                            time.Duration
+	remoteProperties                                     amqp.Map
+	remoteOfferedCapabilities, remoteDesiredCapabilities []amqp.Symbol
 }
 
-func (c connectionSettings) User() string             { return c.user }
-func (c connectionSettings) VirtualHost() string      { return c.virtualHost }
-func (c connectionSettings) Heartbeat() time.Duration { return c.heartbeat }
+func (c connectionSettings) User() string               { return c.user }
+func (c connectionSettings) SASLMech() string           { return c.saslMech }
+func (c connectionSettings) VirtualHost() string        { return c.virtualHost }
+func (c connectionSettings) Heartbeat() time.Duration   { return c.heartbeat }
+func (c connectionSettings) RemoteContainer() string    { return c.remoteContainer }
+func (c connectionSettings) RemoteHostname() string     { return c.remoteHostname }
+func (c connectionSettings) RemoteProperties() amqp.Map { return c.remoteProperties }
+func (c connectionSettings) RemoteOfferedCapabilities() []amqp.Symbol {
+	return c.remoteOfferedCapabilities
+}
+func (c connectionSettings) RemoteDesiredCapabilities() []amqp.Symbol {
+	return c.remoteDesiredCapabilities
+}
+func (c connectionSettings) RemoteAnonymousRelay() bool {
+	for _, name := range c.remoteOfferedCapabilities {
+		if name == AnonymousRelayCapability {
+			return true
+		}
+	}
+	return false
+}
 
 // ConnectionOption can be passed when creating a connection to configure various options
 type ConnectionOption func(*connection)
@@ -148,12 +221,78 @@ func AllowIncoming() ConnectionOption {
 	return func(c *connection) { c.incoming = make(chan Incoming) }
 }
 
+// MaxSessions returns a ConnectionOption to limit the number of sessions open
+// on the connection to n, 0 means no limit. A session opened by the remote
+// peer beyond the limit is ended with an amqp:resource-limit-exceeded error,
+// the connection stays open.
+func MaxSessions(n int) ConnectionOption {
+	return func(c *connection) { c.maxSessions = n }
+}
+
+// MaxLinksPerSession returns a ConnectionOption to limit the number of links
+// open on each session of the connection to n, 0 means no limit. A link
+// attached by the remote peer beyond the limit is detached with an
+// amqp:resource-limit-exceeded error, the session stays open.
+func MaxLinksPerSession(n int) ConnectionOption {
+	return func(c *connection) { c.maxLinksPerSession = n }
+}
+
+// ContainerId returns a ConnectionOption to set the AMQP container-id sent to
+// the remote peer, overriding the Id() of the connection's Container. A stable
+// container-id lets the remote peer recognise us when we re-connect.
+func ContainerId(id string) ConnectionOption {
+	return func(c *connection) {
+		c.containerId = id
+		c.pConnection.SetContainer(id)
+	}
+}
+
+// Properties returns a ConnectionOption to set the connection properties sent
+// to the remote peer. Connection creation fails if the properties cannot be
+// encoded as AMQP.
+func Properties(properties amqp.Map) ConnectionOption {
+	return func(c *connection) {
+		if err := c.pConnection.SetProperties(properties); err != nil && c.optionErr == nil {
+			c.optionErr = err
+		}
+	}
+}
+
+// OfferedCapabilities returns a ConnectionOption to set the capabilities
+// offered to the remote peer, for example "sole-connection-for-container".
+func OfferedCapabilities(capabilities ...amqp.Symbol) ConnectionOption {
+	return func(c *connection) { c.pConnection.SetOfferedCapabilities(capabilities) }
+}
+
+// DesiredCapabilities returns a ConnectionOption to set the capabilities we
+// would like the remote peer to offer.
+func DesiredCapabilities(capabilities ...amqp.Symbol) ConnectionOption {
+	return func(c *connection) { c.pConnection.SetDesiredCapabilities(capabilities) }
+}
+
 // Parent returns a ConnectionOption that associates the Connection with it's Container
 // If not set a connection will create its own default container.
 func Parent(cont Container) ConnectionOption {
 	return func(c *connection) { c.container = cont.(*container) }
 }
 
+// SSL returns a ConnectionOption to encrypt the connection using the SSL
+// configuration in domain, see proton.Transport.SetSSL().
+//
+// SSL must be set up before any data is exchanged, so this option can only be
+// passed to NewConnection(), Dial() or Container.Connection(). NewConnection()
+// returns an error if SSL cannot be enabled, the connection never runs
+// unencrypted. Passing it to IncomingConnection.AcceptConnection() closes the
+// connection with an error.
+func SSL(domain proton.SSLDomain, peerHostname string) ConnectionOption {
+	return func(c *connection) { c.ssl = &sslSettings{domain, peerHostname} }
+}
+
+type sslSettings struct {
+	domain       proton.SSLDomain
+	peerHostname string
+}
+
 type connection struct {
 	endpoint
 	connectionSettings
@@ -161,12 +300,17 @@ type connection struct {
 	defaultSessionOnce, closeOnce sync.Once
 
 	container   *container
+	containerId string
+	ssl         *sslSettings
+	optionErr   error // First error from a ConnectionOption
 	conn        net.Conn
 	server      bool
 	incoming    chan Incoming
-	handler     *handler
-	engine      *proton.Engine
-	pConnection proton.Connection
+
+	maxSessions, maxLinksPerSession int // 0 means no limit
+	handler                         *handler
+	engine                          *proton.Engine
+	pConnection                     proton.Connection
 
 	defaultSession Session
 }
@@ -189,11 +333,21 @@ func NewConnection(conn net.Conn, opts ...ConnectionOption) (*connection, error)
 	if c.container == nil {
 		c.container = NewContainer("").(*container)
 	}
-	c.pConnection.SetContainer(c.container.Id())
+	if c.containerId == "" {
+		c.pConnection.SetContainer(c.container.Id())
+	}
 	globalSASLInit(c.engine)
+	err = c.optionErr
+	if err == nil && c.ssl != nil {
+		_, err = c.engine.Transport().SetSSL(c.ssl.domain, c.ssl.peerHostname)
+	}
 
 	c.endpoint.init(c.engine.String())
 	go c.run()
+	if err != nil {
+		c.Disconnect(err) // Run the engine to completion to free it
+		return nil, err
+	}
 	return c, nil
 }
 
@@ -218,6 +372,18 @@ func (c *connection) Disconnect(err error) {
 	c.engine.Disconnect(err)
 }
 
+func (c *connection) CloseContext(ctx context.Context, err error) error {
+	c.err.Set(err)
+	_ = c.engine.Inject(func() { proton.CloseError(c.pConnection, err) })
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		c.Disconnect(ctx.Err())
+		return ctx.Err()
+	}
+}
+
 func (c *connection) Session(opts ...SessionOption) (Session, error) {
 	var s Session
 	err := c.engine.InjectWait(func() error {
@@ -275,6 +441,13 @@ func (c *connection) WaitTimeout(timeout time.Duration) error {
 	return c.Error()
 }
 
+func (c *connection) WaitContext(ctx context.Context) error {
+	if _, err := contextReceive(ctx, c.done); err != Closed {
+		return err
+	}
+	return c.Error()
+}
+
 func (c *connection) Incoming() <-chan Incoming {
 	assert(c.incoming != nil, "Incoming() is only allowed for a Connection created with the Server() option: %s", c)
 	return c.incoming
@@ -298,13 +471,19 @@ func newIncomingConnection(c *connection) *IncomingConnection {
 // AcceptConnection is like Accept() but takes ConnectionOption s
 // For example you can set the Heartbeat() for the accepted connection.
 func (in *IncomingConnection) AcceptConnection(opts ...ConnectionOption) Connection {
-	return in.accept(func() Endpoint {
+	done := make(chan Connection)
+	in.acceptCh <- func() error {
+		defer func() { done <- in.c }()
 		for _, opt := range opts {
 			opt(in.c)
 		}
-		in.c.pConnection.Open()
-		return in.c
-	}).(Connection)
+		if in.c.ssl != nil { // Too late, the engine is already reading from the connection.
+			in.c.ssl = nil
+			return fmt.Errorf("SSL option is not allowed for AcceptConnection, use it with NewConnection")
+		}
+		return in.c.optionErr // Connection is opened by the handler
+	}
+	return <-done
 }
 
 func (in *IncomingConnection) Accept() Endpoint {
@@ -341,6 +520,23 @@ func SASLAllowInsecure(b bool) ConnectionOption {
 	return func(c *connection) { sasl(c).SetAllowInsecureMechs(b) }
 }
 
+// SASLAuthenticator returns a ConnectionOption for a Server() connection that
+// offers the SASL mechanisms mechs and calls authenticate to check the
+// credentials of the client, instead of using the SASL configuration of the
+// proton library. mechs is a space-separated list of PLAIN and ANONYMOUS. A
+// client that is refused gets the SASL outcome chosen by authenticate, see
+// proton.SASLAuthenticator.
+//
+// Use it after the Server() option. PLAIN is only offered to an unencrypted
+// connection with SASLAllowInsecure(true).
+func SASLAuthenticator(mechs string, authenticate proton.SASLAuthenticator) ConnectionOption {
+	return func(c *connection) {
+		if err := c.engine.Transport().SetSASLAuthenticator(mechs, authenticate); err != nil && c.optionErr == nil {
+			c.optionErr = err
+		}
+	}
+}
+
 // Heartbeat returns a ConnectionOption that requests the maximum delay
 // between sending frames for the remote peer. If we don't receive any frames
 // within 2*delay we will close the connection.
@@ -37,6 +37,19 @@ links to Send() and Receive() messages. Connection.Incoming() lets you accept
 incoming links opened by the remote peer. You can open and accept multiple links
 in both directions on a single Connection.
 
+A Connection does not reconnect automatically. When a connection fails its
+Sessions, Senders and Receivers are closed with the connection error.
+Applications that need to survive a broker restart should create a new
+Connection and re-open their links, using the ContainerId() option so the
+broker recognises the container and DurableSubscription() for receivers that
+must not lose messages. Messages that were sent but not acknowledged have an
+Outcome with Status Unacknowledged and can be re-sent.
+
+Blocking methods have a *Timeout variant, and Sender.SendSyncContext,
+Receiver.ReceiveContext, Connection.WaitContext and Connection.CloseContext
+return ctx.Err() when a context.Context is done, so cancelling one context can
+unblock all the goroutines of a service on shutdown.
+
 Some of the documentation examples show client and server side by side in a
 single program, in separate goroutines. This is only for example purposes, real
 AMQP applications would run in separate processes on the network.
@@ -70,4 +83,10 @@ are still valid, for example a link may be remotely closed between the time a
 Sender function calls Inject and the time the injected function is execute by
 the handler goroutine.
 
+Automatic reconnect is not implemented. Endpoints are bound to the proton.Engine
+of their connection, re-attaching them to a new engine would mean replacing
+the engine under every Session, Sender and Receiver. Resuming unsettled
+deliveries also needs the unsettled map of the AMQP attach frame, which the
+proton-C engine does not send or decode.
+
 */
@@ -20,12 +20,18 @@ under the License.
 package electron
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"path"
 	"qpid.apache.org/amqp"
+	"qpid.apache.org/proton"
 	"reflect"
 	"runtime"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -369,6 +375,609 @@ func doDisposition(ack <-chan Outcome, results chan result) {
 }
 
 // Senders get credit immediately if receivers have prefetch set
+func TestContext(t *testing.T) {
+	rchan := make(chan Receiver, 1)
+	client, server := newClientServer(t)
+	go func() {
+		for i := range server.Incoming() {
+			switch i := i.(type) {
+			case *IncomingReceiver:
+				i.SetCapacity(1)
+				i.SetPrefetch(false)
+				rchan <- i.Accept().(Receiver) // Issue credit only on receive
+			default:
+				i.Accept()
+			}
+		}
+	}()
+	defer func() { closeClientServer(client, server) }()
+	snd, err := client.Sender(Target("test"))
+	fatalIf(t, err)
+	rcv := <-rchan
+	m := amqp.NewMessage()
+
+	// No credit, the context expires before the message is sent.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	out := snd.SendSyncContext(ctx, m)
+	errorIf(t, checkEqual(Outcome{Unsent, context.DeadlineExceeded, nil}, out))
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	out = snd.SendSyncContext(ctx, m)
+	errorIf(t, checkEqual(Outcome{Unsent, context.Canceled, nil}, out))
+
+	// Credit is issued by Receive, the outcome is the receiver's disposition.
+	go func() {
+		if rm, err := rcv.ReceiveContext(context.Background()); err == nil {
+			_ = rm.Reject()
+		}
+	}()
+	out = snd.SendSyncContext(context.Background(), m)
+	errorIf(t, checkEqual(Rejected, out.Status))
+
+	// Nothing to receive, the context expires.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	_, err = rcv.ReceiveContext(ctx)
+	errorIf(t, checkEqual(context.DeadlineExceeded, err))
+
+	// The connection is still open, the context expires.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	errorIf(t, checkEqual(context.DeadlineExceeded, client.Connection().WaitContext(ctx)))
+	closeClientServer(client, server)
+	errorIf(t, checkEqual(Closed, client.Connection().WaitContext(context.Background())))
+}
+
+func TestPriorityQueue(t *testing.T) {
+	rchan := make(chan Receiver, 1)
+	client, server := newClientServer(t)
+	go func() {
+		for i := range server.Incoming() {
+			switch i := i.(type) {
+			case *IncomingReceiver:
+				i.SetCapacity(1)
+				i.SetPrefetch(false)
+				rchan <- i.Accept().(Receiver) // Issue credit only on receive
+			default:
+				i.Accept()
+			}
+		}
+	}()
+	defer func() { closeClientServer(client, server) }()
+	snd, err := client.Sender(Target("test"), PriorityQueue())
+	fatalIf(t, err)
+	rcv := <-rchan
+
+	// Messages wait for credit without blocking the sender.
+	ack := make(chan Outcome, 10)
+	for i, p := range []uint8{1, 9, 1, 5} {
+		m := amqp.NewMessageWith(i)
+		m.SetPriority(p)
+		snd.SendAsync(m, ack, i)
+	}
+	for _, want := range []int64{1, 3, 0, 2} {
+		rm, err := rcv.Receive()
+		fatalIf(t, err)
+		errorIf(t, checkEqual(want, rm.Message.Body()))
+		fatalIf(t, rm.Accept())
+	}
+	for i := 0; i < 4; i++ {
+		errorIf(t, checkEqual(Accepted, (<-ack).Status))
+	}
+
+	// Queued messages are removed when the timeout or context expires.
+	out := snd.SendSyncTimeout(amqp.NewMessage(), time.Millisecond)
+	errorIf(t, checkEqual(Outcome{Unsent, Timeout, nil}, out))
+	out = snd.SendSyncTimeout(amqp.NewMessage(), 0)
+	errorIf(t, checkEqual(Outcome{Unsent, Timeout, nil}, out))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	out = snd.SendSyncContext(ctx, amqp.NewMessage())
+	errorIf(t, checkEqual(Outcome{Unsent, context.DeadlineExceeded, nil}, out))
+
+	// The timeout of a message stops when it is sent.
+	s := snd.(*sender)
+	qm := s.enqueue(amqp.NewMessageWith("timer"), ack, nil, time.Hour, "")
+	rm, err := rcv.Receive()
+	fatalIf(t, err)
+	fatalIf(t, rm.Accept())
+	errorIf(t, checkEqual(Accepted, (<-ack).Status))
+	var stopped bool
+	fatalIf(t, s.engine().InjectWait(func() error { stopped = qm.timer != nil && !qm.timer.Stop(); return nil }))
+	errorIf(t, checkEqual(true, stopped))
+
+	// Messages still queued when the sender closes are Unsent.
+	snd.SendAsync(amqp.NewMessage(), ack, "closed")
+	snd.Close(nil)
+	errorIf(t, checkEqual(Outcome{Unsent, Closed, "closed"}, <-ack))
+}
+
+func TestAnonymousRelay(t *testing.T) {
+	rchan := make(chan Receiver, 1)
+	hasAddress := make(chan bool, 1)
+	client, server := newClientServer(t)
+	go func() {
+		for in := range server.Incoming() {
+			switch in := in.(type) {
+			case *IncomingConnection:
+				in.AcceptConnection(OfferedCapabilities(AnonymousRelayCapability))
+			case *IncomingReceiver:
+				hasAddress <- in.pLink.RemoteTarget().HasAddress()
+				in.SetPrefetch(true)
+				rchan <- in.Accept().(Receiver)
+			default:
+				in.Accept()
+			}
+		}
+	}()
+	defer func() { closeClientServer(client, server) }()
+	fatalIf(t, client.Sync())
+	errorIf(t, checkEqual(true, client.Connection().RemoteAnonymousRelay()))
+	errorIf(t, checkEqual(false, server.RemoteAnonymousRelay()))
+
+	snd, err := client.Sender(Target("ignored"), AnonymousRelay())
+	fatalIf(t, err)
+	rcv := <-rchan
+	errorIf(t, checkEqual(false, <-hasAddress))
+	errorIf(t, checkEqual("", snd.Target()))
+	errorIf(t, checkEqual("", rcv.Target()))
+
+	// A message with no address is not sent.
+	out := snd.SendSync(amqp.NewMessageWith("lost"))
+	errorIf(t, checkEqual(Unsent, out.Status))
+	if out.Error == nil {
+		t.Error("expected error for message with no address")
+	}
+
+	m := amqp.NewMessageWith("routed")
+	m.SetAddress("queue-a")
+	outcome := snd.SendWaitable(m)
+	rm, err := rcv.Receive()
+	fatalIf(t, err)
+	errorIf(t, checkEqual("queue-a", rm.Message.Address()))
+	errorIf(t, checkEqual("routed", rm.Message.Body()))
+	fatalIf(t, rm.Accept())
+	errorIf(t, checkEqual(Accepted, (<-outcome).Status))
+}
+
+func TestDrainAndClose(t *testing.T) {
+	schan := make(chan Sender, 2)
+	client, server := newClientServer(t)
+	go func() {
+		for in := range server.Incoming() {
+			switch in := in.(type) {
+			case *IncomingSender:
+				schan <- in.Accept().(Sender)
+			default:
+				in.Accept()
+			}
+		}
+	}()
+	defer func() { closeClientServer(client, server) }()
+
+	// In-flight messages are received and settled before the link closes.
+	rcv, err := client.Receiver(Source("drain"), Capacity(5), Prefetch(true))
+	fatalIf(t, err)
+	snd := <-schan
+	outcomes := make(chan Outcome, 3)
+	for i := 0; i < 3; i++ {
+		snd.SendAsync(amqp.NewMessageWith(i), outcomes, i)
+	}
+	type result struct {
+		remaining []ReceivedMessage
+		err       error
+	}
+	done := make(chan result, 1)
+	go func() {
+		remaining, err := rcv.DrainAndClose(context.Background())
+		done <- result{remaining, err}
+	}()
+	// The sender gives up its unused credit.
+	s := snd.(*sender)
+	credit := func() (n int) {
+		_ = s.engine().InjectWait(func() error { n = s.pLink.Credit(); return nil })
+		return
+	}
+	for deadline := time.Now().Add(time.Second); credit() != 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	errorIf(t, checkEqual(0, credit()))
+	for i := 0; i < 3; i++ {
+		rm, err := rcv.Receive()
+		fatalIf(t, err)
+		errorIf(t, checkEqual(int64(i), rm.Message.Body()))
+		select {
+		case <-done:
+			t.Fatal("closed with unsettled messages")
+		default:
+		}
+		fatalIf(t, rm.Accept())
+	}
+	r := <-done
+	errorIf(t, r.err)
+	errorIf(t, checkEqual(0, len(r.remaining)))
+	for i := 0; i < 3; i++ {
+		errorIf(t, checkEqual(Accepted, (<-outcomes).Status))
+	}
+
+	// Messages that are not received are returned when ctx is done.
+	rcv, err = client.Receiver(Source("drain"), Capacity(5), Prefetch(true))
+	fatalIf(t, err)
+	snd = <-schan
+	for i := 0; i < 2; i++ {
+		snd.SendAsync(amqp.NewMessageWith(i), outcomes, i)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	remaining, err := rcv.DrainAndClose(ctx)
+	errorIf(t, checkEqual(context.DeadlineExceeded, err))
+	errorIf(t, checkEqual(2, len(remaining)))
+}
+
+func TestDrainBlockedSender(t *testing.T) {
+	rchan := make(chan Receiver, 1)
+	client, server := newClientServer(t)
+	go func() {
+		for in := range server.Incoming() {
+			switch in := in.(type) {
+			case *IncomingReceiver:
+				rchan <- in.Accept().(Receiver)
+			default:
+				in.Accept()
+			}
+		}
+	}()
+	defer func() { closeClientServer(client, server) }()
+	snd, err := client.Sender(Target("drain"), AtMostOnce())
+	fatalIf(t, err)
+	rcv := <-rchan
+
+	// A sender blocked on credit uses the credit of a drain.
+	outcomes := make(chan Outcome, 1)
+	go func() { outcomes <- snd.SendSync(amqp.NewMessageWith("x")) }()
+	s := snd.(*sender)
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&s.waiting) == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	r := rcv.(*receiver)
+	fatalIf(t, r.engine().InjectWait(func() error { return r.pLink.Drain(1) }))
+	select {
+	case out := <-outcomes:
+		errorIf(t, checkEqual(Accepted, out.Status))
+	case <-time.After(time.Second):
+		t.Fatal("blocked sender did not use drain credit")
+	}
+	rm, err := rcv.Receive()
+	fatalIf(t, err)
+	errorIf(t, checkEqual("x", rm.Message.Body()))
+}
+
+func TestTagFormat(t *testing.T) {
+	rchan := make(chan Receiver, 1)
+	client, server := newClientServer(t)
+	go func() {
+		for in := range server.Incoming() {
+			switch in := in.(type) {
+			case *IncomingReceiver:
+				in.SetPrefetch(true)
+				rchan <- in.Accept().(Receiver)
+			default:
+				in.Accept()
+			}
+		}
+	}()
+	defer func() { closeClientServer(client, server) }()
+	snd, err := client.Sender(Target("tags"), TagFormat(func(n uint64) []byte {
+		if n == 2 {
+			return make([]byte, proton.MaxTagSize+1)
+		}
+		tag := make([]byte, 16)
+		binary.BigEndian.PutUint64(tag[8:], n)
+		return tag
+	}))
+	fatalIf(t, err)
+	rcv := <-rchan
+	for i := 0; i < 2; i++ {
+		outcome := snd.SendWaitable(amqp.NewMessageWith(i))
+		rm, err := rcv.Receive()
+		fatalIf(t, err)
+		want := make([]byte, 16)
+		want[15] = byte(i)
+		errorIf(t, checkEqual(want, rm.pDelivery.Tag().Bytes()))
+		fatalIf(t, rm.Accept())
+		errorIf(t, checkEqual(Accepted, (<-outcome).Status))
+	}
+	out := snd.SendSync(amqp.NewMessageWith("too long"))
+	errorIf(t, checkEqual(Unsent, out.Status))
+	if out.Error == nil {
+		t.Error("expected error for tag longer than MaxTagSize")
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	rchan := make(chan Receiver, 1)
+	client, server := newClientServer(t)
+	go func() {
+		for in := range server.Incoming() {
+			switch in := in.(type) {
+			case *IncomingReceiver:
+				in.SetPrefetch(true)
+				rchan <- in.Accept().(Receiver)
+			default:
+				in.Accept()
+			}
+		}
+	}()
+	defer func() { closeClientServer(client, server) }()
+	snd, err := client.Sender(Target("timeout"), SendTimeout(100*time.Millisecond))
+	fatalIf(t, err)
+	rcv := <-rchan
+
+	// Not settled by the receiver, the sender gives up.
+	out := snd.SendSync(amqp.NewMessageWith("ignored"))
+	errorIf(t, checkEqual(Unacknowledged, out.Status))
+	errorIf(t, checkEqual(Timeout, out.Error))
+	_, err = rcv.Receive()
+	fatalIf(t, err)
+
+	// Settled in time.
+	outcome := snd.SendWaitable(amqp.NewMessageWith("accepted"))
+	rm, err := rcv.Receive()
+	fatalIf(t, err)
+	fatalIf(t, rm.Accept())
+	out = <-outcome
+	errorIf(t, checkEqual(Accepted, out.Status))
+	errorIf(t, out.Error)
+}
+
+func TestRejectError(t *testing.T) {
+	rchan := make(chan Receiver, 1)
+	client, server := newClientServer(t)
+	go func() {
+		for in := range server.Incoming() {
+			switch in := in.(type) {
+			case *IncomingReceiver:
+				in.SetPrefetch(true)
+				rchan <- in.Accept().(Receiver)
+			default:
+				in.Accept()
+			}
+		}
+	}()
+	defer func() { closeClientServer(client, server) }()
+	snd, err := client.Sender(Target("reject"))
+	fatalIf(t, err)
+	rcv := <-rchan
+	want := amqp.Error{Name: amqp.InvalidField, Description: "validation failed", Info: amqp.Map{"fields": amqp.List{"name", "age"}}}
+	outcome := snd.SendWaitable(amqp.NewMessageWith("x"))
+	rm, err := rcv.Receive()
+	fatalIf(t, err)
+	fatalIf(t, rm.RejectError(want))
+	out := <-outcome
+	errorIf(t, checkEqual(Rejected, out.Status))
+	errorIf(t, checkEqual(want, out.Error))
+
+	// Without info the error is a plain amqp.Error.
+	outcome = snd.SendWaitable(amqp.NewMessageWith("y"))
+	rm, err = rcv.Receive()
+	fatalIf(t, err)
+	fatalIf(t, rm.RejectError(amqp.Errorf(amqp.InvalidField, "bad")))
+	errorIf(t, checkEqual(amqp.Errorf(amqp.InvalidField, "bad"), (<-outcome).Error))
+}
+
+func TestRcvSecond(t *testing.T) {
+	schan := make(chan Sender, 1)
+	client, server := newClientServer(t)
+	go func() {
+		for in := range server.Incoming() {
+			switch in := in.(type) {
+			case *IncomingSender:
+				schan <- in.Accept().(Sender)
+			default:
+				in.Accept()
+			}
+		}
+	}()
+	defer func() { closeClientServer(client, server) }()
+	rcv, err := client.Receiver(Source("second"), RcvSettle(RcvSecond), Prefetch(true))
+	fatalIf(t, err)
+	errorIf(t, checkEqual(RcvSecond, rcv.RcvSettle()))
+	snd := <-schan
+	for _, want := range []SentStatus{Accepted, Rejected, Released} {
+		outcome := snd.SendWaitable(amqp.NewMessageWith(want.String()))
+		rm, err := rcv.Receive()
+		fatalIf(t, err)
+		switch want {
+		case Accepted:
+			fatalIf(t, rm.Accept())
+		case Rejected:
+			fatalIf(t, rm.Reject())
+		case Released:
+			fatalIf(t, rm.Release())
+		}
+		select {
+		case out := <-outcome:
+			errorIf(t, checkEqual(want, out.Status))
+		case <-time.After(time.Second):
+			t.Fatalf("%v: no outcome", want)
+		}
+	}
+	// The receiver settles its deliveries after the sender does.
+	r := rcv.(*receiver)
+	unsettled := -1
+	for i := 0; i < 100 && unsettled != 0; i++ {
+		fatalIf(t, r.engine().InjectWait(func() error {
+			unsettled = r.pLink.Unsettled()
+			return nil
+		}))
+		time.Sleep(10 * time.Millisecond)
+	}
+	errorIf(t, checkEqual(0, unsettled))
+}
+
+func TestSendable(t *testing.T) {
+	rchan := make(chan Receiver, 1)
+	client, server := newClientServer(t)
+	go func() {
+		for i := range server.Incoming() {
+			switch i := i.(type) {
+			case *IncomingReceiver:
+				i.SetCapacity(1)
+				i.SetPrefetch(false)
+				rchan <- i.Accept().(Receiver) // Issue credit only on receive
+			default:
+				i.Accept()
+			}
+		}
+	}()
+	defer func() { closeClientServer(client, server) }()
+	snd, err := client.Sender(Target("test"))
+	fatalIf(t, err)
+	rcv := <-rchan
+
+	select {
+	case <-snd.Sendable():
+		t.Error("sendable with no credit")
+	case <-time.After(10 * time.Millisecond):
+	}
+	received := make(chan error, 1)
+	go func() {
+		_, err := rcv.Receive() // Grants credit
+		received <- err
+	}()
+	select {
+	case _, ok := <-snd.Sendable():
+		errorIf(t, checkEqual(true, ok))
+	case <-time.After(time.Second):
+		t.Fatal("not sendable after credit")
+	}
+	snd.SendForget(amqp.NewMessageWith("x"))
+	fatalIf(t, <-received)
+
+	snd.Close(nil)
+	fatalIf(t, snd.Sync())
+	_, ok := <-snd.Sendable()
+	errorIf(t, checkEqual(false, ok))
+}
+
+func TestRedelivered(t *testing.T) {
+	client, server := newClientServer(t)
+	go func() {
+		for i := range server.Incoming() {
+			switch i := i.(type) {
+			case *IncomingSender:
+				s := i.Accept().(Sender)
+				s.SendForget(amqp.NewMessageWith("first"))
+				m := amqp.NewMessageWith("again")
+				m.SetDeliveryCount(1)
+				s.SendForget(m)
+			default:
+				i.Accept()
+			}
+		}
+	}()
+	defer func() { closeClientServer(client, server) }()
+	r, err := client.Receiver(Source("test"))
+	fatalIf(t, err)
+	for _, want := range []bool{false, true} {
+		rm, err := r.Receive()
+		fatalIf(t, err)
+		errorIf(t, checkEqual(want, rm.Redelivered()))
+		fatalIf(t, rm.Accept())
+	}
+}
+
+func TestReleaseExpired(t *testing.T) {
+	outcomes := make(chan Outcome, 2)
+	client, server := newClientServer(t)
+	go func() {
+		for i := range server.Incoming() {
+			switch i := i.(type) {
+			case *IncomingSender:
+				s := i.Accept().(Sender)
+				expired := amqp.NewMessageWith("expired")
+				expired.SetExpiryTime(time.Now().Add(-time.Second))
+				outcomes <- s.SendSync(expired)
+				outcomes <- s.SendSync(amqp.NewMessageWith("fresh"))
+			default:
+				i.Accept()
+			}
+		}
+	}()
+	defer func() { closeClientServer(client, server) }()
+	r, err := client.Receiver(Source("test"), ReleaseExpired())
+	fatalIf(t, err)
+	rm, err := r.Receive()
+	fatalIf(t, err)
+	errorIf(t, checkEqual("fresh", rm.Message.Body()))
+	fatalIf(t, rm.Accept())
+	errorIf(t, checkEqual(Released, (<-outcomes).Status))
+	errorIf(t, checkEqual(Accepted, (<-outcomes).Status))
+}
+
+func TestSessionWindow(t *testing.T) {
+	client, server := newClientServer(t)
+	defer closeClientServer(client, server)
+	go func() {
+		for in := range server.Incoming() {
+			in.Accept()
+		}
+	}()
+	windows := func(sn Session) (capacity, window uint) {
+		s := sn.(*session)
+		_ = s.engine().InjectWait(func() error {
+			capacity, window = s.pSession.IncomingCapacity(), s.pSession.OutgoingWindow()
+			return nil
+		})
+		return
+	}
+	// Unset options keep the proton defaults.
+	capacity, window := windows(client)
+	errorIf(t, checkEqual(uint(1024*1024), capacity))
+	errorIf(t, checkEqual(uint(2147483647), window))
+
+	sn, err := client.Connection().Session(IncomingCapacity(4096), OutgoingWindow(10))
+	fatalIf(t, err)
+	capacity, window = windows(sn)
+	errorIf(t, checkEqual(uint(4096), capacity))
+	errorIf(t, checkEqual(uint(10), window))
+}
+
+func TestCreditWindow(t *testing.T) {
+	client, server := newClientServer(t)
+	go func() {
+		for i := range server.Incoming() {
+			switch i := i.(type) {
+			case *IncomingSender:
+				s := i.Accept().(Sender)
+				for j := 0; j < 4; j++ {
+					s.SendForget(amqp.NewMessageWith(j))
+				}
+			default:
+				i.Accept()
+			}
+		}
+	}()
+	defer func() { closeClientServer(client, server) }()
+	r, err := client.Receiver(Source("test"), CreditWindow(4))
+	fatalIf(t, err)
+	credit := func() int {
+		c, err := r.(*receiver).Credit()
+		fatalIf(t, err)
+		return c
+	}
+	for credit() != 0 { // Wait for the window to be used up
+		time.Sleep(time.Millisecond)
+	}
+	for i, want := range []int{0, 2, 2, 4} { // Top up only when half the window is free
+		rm, err := r.Receive()
+		fatalIf(t, err)
+		errorIf(t, checkEqual(int64(i), rm.Message.Body()))
+		errorIf(t, checkEqual(want, credit()))
+	}
+}
+
 func TestSendReceivePrefetch(t *testing.T) {
 	pairs := newPairs(t, 1, true)
 	s, r := pairs.senderReceiver()
@@ -412,7 +1021,7 @@ func TestLinkCloseInterrupt(t *testing.T) {
 	snd, rcv := pairs.senderReceiver()
 	go doReceive(rcv, results)
 	rcv.Close(want)
-	if r := <-results; want != r.err {
+	if r := <-results; !reflect.DeepEqual(want, r.err) {
 		t.Errorf("want %#v got %#v", want, r)
 	}
 
@@ -420,7 +1029,7 @@ func TestLinkCloseInterrupt(t *testing.T) {
 	snd, rcv = pairs.senderReceiver()
 	go doReceive(rcv, results)
 	snd.Close(want)
-	if r := <-results; want != r.err {
+	if r := <-results; !reflect.DeepEqual(want, r.err) {
 		t.Errorf("want %#v got %#v", want, r)
 	}
 }
@@ -450,7 +1059,7 @@ func TestConnectionCloseInterrupt1(t *testing.T) {
 
 	pairs.server.Close(want)
 	for i := 0; i < 3; i++ {
-		if r := <-results; want != r.err {
+		if r := <-results; !reflect.DeepEqual(want, r.err) {
 			t.Errorf("want %v got %v", want, r)
 		}
 	}
@@ -478,12 +1087,46 @@ func TestConnectionCloseInterrupt2(t *testing.T) {
 
 	pairs.client.Connection().Close(want)
 	for i := 0; i < 3; i++ {
-		if r := <-results; want != r.err {
+		if r := <-results; !reflect.DeepEqual(want, r.err) {
 			t.Errorf("want %v got %v", want, r.err)
 		}
 	}
 }
 
+func TestResourceLimits(t *testing.T) {
+	client, server := newClientServerOpts(t, nil,
+		[]ConnectionOption{MaxSessions(1), MaxLinksPerSession(2)})
+	defer closeClientServer(client, server)
+	go func() {
+		for in := range server.Incoming() {
+			in.Accept()
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		s, err := client.Sender()
+		fatalIf(t, err)
+		fatalIf(t, s.Sync())
+	}
+	// The third link is detached, the session stays open.
+	s, err := client.Sender()
+	if err == nil {
+		err = s.Sync()
+	}
+	if !amqp.IsResourceLimitExceeded(err) {
+		t.Errorf("want %v, got %v", amqp.ResourceLimitExceeded, err)
+	}
+	// The second session is ended, the connection stays open.
+	sn, err := client.Connection().Session()
+	if err == nil {
+		err = sn.Sync()
+	}
+	if !amqp.IsResourceLimitExceeded(err) {
+		t.Errorf("want %v, got %v", amqp.ResourceLimitExceeded, err)
+	}
+	fatalIf(t, client.Connection().Sync())
+	errorIf(t, client.Connection().Error())
+}
+
 func heartbeat(c Connection) time.Duration {
 	return c.(*connection).engine.Transport().RemoteIdleTimeout()
 }
@@ -544,3 +1187,380 @@ func TestHeartbeat(t *testing.T) {
 		t.Error("bad timeout error:", server.Error())
 	}
 }
+
+func TestCloseContext(t *testing.T) {
+	// The remote peer closes in time.
+	client, server := newClientServer(t)
+	go func() {
+		for in := range server.Incoming() {
+			in.Accept()
+		}
+	}()
+	fatalIf(t, client.Sync())
+	fatalIf(t, client.Connection().CloseContext(context.Background(), nil))
+	server.Close(nil)
+
+	// The remote peer never answers, the connection is disconnected.
+	cConn, sConn := net.Pipe()
+	defer sConn.Close()
+	go func() { _, _ = io.Copy(ioutil.Discard, sConn) }()
+	c, err := NewConnection(cConn)
+	fatalIf(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	errorIf(t, checkEqual(context.DeadlineExceeded, c.CloseContext(ctx, nil)))
+	if err := c.WaitTimeout(time.Second); err == Timeout {
+		t.Error("connection not disconnected")
+	}
+}
+
+func TestRemoteContainer(t *testing.T) {
+	client, server := newClientServerOpts(t,
+		[]ConnectionOption{ContainerId("my-client"), VirtualHost("my-vhost")},
+		nil)
+	defer closeClientServer(client, server)
+	type remote struct{ container, hostname string }
+	remotes := make(chan remote, 1)
+	go func() {
+		for in := range server.Incoming() {
+			switch in := in.(type) {
+			case *IncomingConnection:
+				remotes <- remote{in.RemoteContainer(), in.RemoteHostname()}
+				in.AcceptConnection(VirtualHost("my-server"))
+			default:
+				in.Accept()
+			}
+		}
+	}()
+	fatalIf(t, client.Sync())
+	errorIf(t, checkEqual(remote{"my-client", "my-vhost"}, <-remotes))
+	errorIf(t, checkEqual("my-vhost", server.RemoteHostname()))
+	errorIf(t, checkEqual("test-server", client.Connection().RemoteContainer()))
+	errorIf(t, checkEqual("my-server", client.Connection().RemoteHostname()))
+}
+
+func TestConnectionProperties(t *testing.T) {
+	props := amqp.Map{amqp.Symbol("product"): "test-client"}
+	client, server := newClientServerOpts(t,
+		[]ConnectionOption{
+			Properties(props),
+			OfferedCapabilities("sole-connection-for-container"),
+			DesiredCapabilities("a", "b"),
+		},
+		nil)
+	defer closeClientServer(client, server)
+	type remote struct {
+		props            amqp.Map
+		offered, desired []amqp.Symbol
+	}
+	remotes := make(chan remote, 1)
+	go func() {
+		for in := range server.Incoming() {
+			switch in := in.(type) {
+			case *IncomingConnection:
+				remotes <- remote{in.RemoteProperties(), in.RemoteOfferedCapabilities(), in.RemoteDesiredCapabilities()}
+				in.AcceptConnection(OfferedCapabilities("a"))
+			default:
+				in.Accept()
+			}
+		}
+	}()
+	fatalIf(t, client.Sync())
+	// Capabilities only decode as []amqp.Symbol if they were sent as symbols.
+	errorIf(t, checkEqual(remote{props, []amqp.Symbol{"sole-connection-for-container"}, []amqp.Symbol{"a", "b"}}, <-remotes))
+	c := client.Connection()
+	errorIf(t, checkEqual([]amqp.Symbol{"a"}, c.RemoteOfferedCapabilities()))
+	errorIf(t, checkEqual([]amqp.Symbol(nil), c.RemoteDesiredCapabilities()))
+	errorIf(t, checkEqual(amqp.Map(nil), c.RemoteProperties()))
+
+	// Properties that can't be encoded are an error from NewConnection.
+	cConn, sConn := net.Pipe()
+	defer sConn.Close()
+	if c, err := NewConnection(cConn, Properties(amqp.Map{"bad": make(chan int)})); err == nil {
+		c.Close(nil)
+		t.Error("expected error from NewConnection with bad properties")
+	}
+}
+
+func TestSSLOption(t *testing.T) {
+	// An unusable domain is an error from NewConnection, the connection never
+	// runs unencrypted.
+	cConn, sConn := net.Pipe()
+	defer sConn.Close()
+	if c, err := NewConnection(cConn, SSL(proton.SSLDomain{}, "")); err == nil {
+		c.Close(nil)
+		t.Error("expected error from NewConnection with bad SSL domain")
+	}
+
+	// SSL is not allowed when accepting a connection that is already running.
+	client, server := newClientServer(t)
+	defer closeClientServer(client, server)
+	go func() {
+		for in := range server.Incoming() {
+			switch in := in.(type) {
+			case *IncomingConnection:
+				in.AcceptConnection(SSL(proton.SSLDomain{}, ""))
+			default:
+				in.Accept()
+			}
+		}
+	}()
+	if err := client.Sync(); err == nil {
+		t.Error("expected error from AcceptConnection with SSL option")
+	}
+}
+
+func TestClient(t *testing.T) {
+	client, server := newClientServer(t)
+	defer closeClientServer(client, server)
+	replies := make(chan Sender, 1)
+	go func() {
+		for in := range server.Incoming() {
+			switch in := in.(type) {
+			case *IncomingSender: // Dynamic reply-to receiver
+				in.SetSource("reply-to-1")
+				replies <- in.Accept().(Sender)
+			case *IncomingReceiver: // Echo requests back to the reply-to address
+				in.SetPrefetch(true)
+				r := in.Accept().(Receiver)
+				go func() {
+					reply := <-replies
+					for {
+						rm, err := r.Receive()
+						if err != nil {
+							return
+						}
+						if rm.Message.Body() == "reject" {
+							_ = rm.Reject()
+							continue
+						}
+						_ = rm.Accept()
+						if rm.Message.ReplyTo() != reply.Source() || rm.Message.Body() == "ignore" {
+							continue
+						}
+						res := amqp.NewMessageWith(rm.Message.Body())
+						res.SetCorrelationId(rm.Message.CorrelationId())
+						reply.SendForget(res)
+					}
+				}()
+			default:
+				in.Accept()
+			}
+		}
+	}()
+	c, err := NewClient(client.Connection())
+	fatalIf(t, err)
+	errorIf(t, checkEqual("reply-to-1", c.ReplyTo()))
+
+	// Concurrent calls each get their own response, the request is not modified.
+	const n = 10
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			req := amqp.NewMessageWith(fmt.Sprintf("hello%v", i))
+			res, err := c.Call(context.Background(), "service", req)
+			if err == nil {
+				err = checkEqual(req.Body(), res.Body())
+			}
+			if err == nil {
+				err = checkEqual(nil, req.CorrelationId())
+			}
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		errorIf(t, <-errs)
+	}
+
+	// No response before the context expires.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = c.Call(ctx, "service", amqp.NewMessageWith("ignore"))
+	errorIf(t, checkEqual(context.DeadlineExceeded, err))
+
+	// Rejected request.
+	if _, err = c.Call(context.Background(), "service", amqp.NewMessageWith("reject")); err == nil {
+		t.Error("expected error for rejected request")
+	}
+
+	// Calls fail once the client is closed.
+	c.Close()
+	if _, err = c.Call(context.Background(), "service", amqp.NewMessageWith("x")); err == nil {
+		t.Error("expected error calling a closed client")
+	}
+}
+
+// managementNode responds to management requests for entities of type "queue".
+func managementNode(r Receiver, reply Sender) {
+	queues := map[string]amqp.Map{}
+	for {
+		rm, err := r.Receive()
+		if err != nil {
+			return
+		}
+		_ = rm.Accept()
+		props := rm.Message.ApplicationProperties()
+		name, _ := props["name"].(string)
+		status, body := int32(200), interface{}(nil)
+		switch props["operation"] {
+		case "CREATE":
+			attrs := rm.Message.Body().(amqp.Map)
+			attrs["name"] = name
+			queues[name] = attrs
+			status, body = 201, attrs
+		case "READ":
+			if q, ok := queues[name]; ok {
+				body = q
+			} else {
+				status = 404
+			}
+		case "UPDATE":
+			for k, v := range rm.Message.Body().(amqp.Map) {
+				queues[name][k] = v
+			}
+			body = queues[name]
+		case "DELETE":
+			delete(queues, name)
+			status = 204
+		case "QUERY":
+			results := amqp.List{}
+			for n, q := range queues {
+				results = append(results, amqp.List{n, q["durable"]})
+			}
+			body = amqp.Map{"attributeNames": amqp.List{"name", "durable"}, "results": results}
+		}
+		res := amqp.NewMessageWith(body)
+		res.SetCorrelationId(rm.Message.CorrelationId())
+		res.SetApplicationProperties(map[string]interface{}{"statusCode": status, "statusDescription": "test"})
+		reply.SendForget(res)
+	}
+}
+
+func TestManagementClient(t *testing.T) {
+	client, server := newClientServer(t)
+	defer closeClientServer(client, server)
+	replies := make(chan Sender, 1)
+	go func() {
+		for in := range server.Incoming() {
+			switch in := in.(type) {
+			case *IncomingSender:
+				in.SetSource("reply-to-1")
+				replies <- in.Accept().(Sender)
+			case *IncomingReceiver:
+				in.SetPrefetch(true)
+				errorIf(t, checkEqual(ManagementAddress, in.Target()))
+				r := in.Accept().(Receiver)
+				go managementNode(r, <-replies)
+			default:
+				in.Accept()
+			}
+		}
+	}()
+	mc, err := NewManagementClient(client.Connection())
+	fatalIf(t, err)
+	defer mc.Close()
+	ctx := context.Background()
+
+	attrs, err := mc.CreateEntity(ctx, "queue", "q1", amqp.Map{"durable": true})
+	fatalIf(t, err)
+	errorIf(t, checkEqual(amqp.Map{"name": "q1", "durable": true}, attrs))
+	attrs, err = mc.UpdateEntity(ctx, "queue", "q1", amqp.Map{"durable": false})
+	fatalIf(t, err)
+	errorIf(t, checkEqual(amqp.Map{"name": "q1", "durable": false}, attrs))
+	attrs, err = mc.ReadEntity(ctx, "queue", "q1")
+	fatalIf(t, err)
+	errorIf(t, checkEqual(amqp.Map{"name": "q1", "durable": false}, attrs))
+
+	entities, err := mc.Query(ctx, "queue")
+	fatalIf(t, err)
+	errorIf(t, checkEqual([]amqp.Map{{"name": "q1", "durable": false}}, entities))
+
+	fatalIf(t, mc.DeleteEntity(ctx, "queue", "q1"))
+	_, err = mc.ReadEntity(ctx, "queue", "q1")
+	errorIf(t, checkEqual(ManagementError{404, "test"}, err))
+	entities, err = mc.Query(ctx, "queue")
+	fatalIf(t, err)
+	errorIf(t, checkEqual(0, len(entities)))
+}
+
+func TestTransaction(t *testing.T) {
+	client, server := newClientServer(t)
+	defer closeClientServer(client, server)
+	states := make(chan amqp.List, 10) // Transactional state of messages received by the server
+	serve := func(r Receiver, coordinator bool) {
+		for {
+			rm, err := r.Receive()
+			if err != nil {
+				return
+			}
+			_ = r.(*receiver).engine().InjectWait(func() error {
+				d := rm.pDelivery
+				if coordinator {
+					body := rm.Message.Body().(amqp.Described)
+					switch {
+					case body.Descriptor == declareCode:
+						_ = d.Local().Data().Marshal(amqp.List{amqp.Binary("txn-1")})
+						d.SettleAs(declaredCode)
+					case body.Value.(amqp.List)[1] == false: // Commit
+						d.Local().Condition().SetError(amqp.Errorf("amqp:transaction:rollback", "cannot commit"))
+						d.SettleAs(proton.Rejected)
+					default: // Rollback
+						d.SettleAs(proton.Accepted)
+					}
+					return nil
+				}
+				var state amqp.List
+				if d.Remote().Type() == transactionalStateCode {
+					_ = d.Remote().Data().Unmarshal(&state)
+				}
+				states <- state
+				if state == nil {
+					d.SettleAs(proton.Accepted)
+					return nil
+				}
+				outcome := amqp.Described{Descriptor: uint64(proton.Accepted), Value: amqp.List{}}
+				if rm.Message.Body() == "bad" {
+					cond := amqp.Described{Descriptor: errorCode, Value: amqp.List{amqp.Symbol("amqp:invalid-field"), "bad"}}
+					outcome = amqp.Described{Descriptor: uint64(proton.Rejected), Value: amqp.List{cond}}
+				}
+				_ = d.Local().Data().Marshal(amqp.List{state[0], outcome})
+				d.SettleAs(transactionalStateCode)
+				return nil
+			})
+		}
+	}
+	go func() {
+		for in := range server.Incoming() {
+			if ir, ok := in.(*IncomingReceiver); ok {
+				coordinator := ir.pLink.RemoteTarget().Type() == proton.Coordinator
+				go serve(ir.Accept().(Receiver), coordinator)
+			} else {
+				in.Accept()
+			}
+		}
+	}()
+
+	txn, err := client.Transaction()
+	fatalIf(t, err)
+	errorIf(t, checkEqual(amqp.Binary("txn-1"), txn.Id()))
+	s, err := client.Sender(Target("q"))
+	fatalIf(t, err)
+
+	out := txn.Send(s, amqp.NewMessageWith("hello"))
+	errorIf(t, checkEqual(Accepted, out.Status))
+	errorIf(t, checkEqual(nil, out.Error))
+	errorIf(t, checkEqual(amqp.List{amqp.Binary("txn-1")}, <-states))
+	out = txn.Send(s, amqp.NewMessageWith("bad"))
+	errorIf(t, checkEqual(Rejected, out.Status))
+	errorIf(t, checkEqual(amqp.Errorf("amqp:invalid-field", "bad"), out.Error))
+	<-states
+
+	// Messages sent outside the transaction have no transactional state.
+	errorIf(t, checkEqual(Accepted, s.SendSync(amqp.NewMessageWith("plain")).Status))
+	errorIf(t, checkEqual(amqp.List(nil), <-states))
+
+	errorIf(t, txn.Rollback())
+	txn, err = client.Transaction() // Re-uses the coordinator link
+	fatalIf(t, err)
+	errorIf(t, checkEqual(amqp.Errorf("amqp:transaction:rollback", "cannot commit"), txn.Commit()))
+}
@@ -66,9 +66,22 @@ func (h *handler) HandleMessagingEvent(t proton.MessagingEvent, e proton.Event)
 
 	case proton.MSettled:
 		if sm, ok := h.sentMessages[e.Delivery()]; ok {
-			d := e.Delivery().Remote()
-			sm.ack <- Outcome{sentStatus(d.Type()), d.Condition().Error(), sm.value}
-			delete(h.sentMessages, e.Delivery())
+			h.outcome(e.Delivery(), sm)
+		} else if e.Link().IsReceiver() && e.Delivery().LocalState() != 0 {
+			// RcvSecond: the receiver already sent its outcome, settle after the sender.
+			e.Delivery().Settle()
+		}
+
+	case proton.MAccepted, proton.MRejected, proton.MReleased:
+		// RcvSecond: the receiver does not settle until the sender does.
+		if sm, ok := h.sentMessages[e.Delivery()]; ok && e.Link().RemoteRcvSettleMode() == proton.RcvSecond {
+			h.outcome(e.Delivery(), sm)
+			e.Delivery().Settle()
+		}
+
+	case proton.MDrained:
+		if r, ok := h.links[e.Link()].(*receiver); ok {
+			r.checkDrained()
 		}
 
 	case proton.MSendable:
@@ -80,6 +93,17 @@ func (h *handler) HandleMessagingEvent(t proton.MessagingEvent, e proton.Event)
 
 	case proton.MConnectionOpening:
 		h.connection.heartbeat = e.Transport().RemoteIdleTimeout()
+		h.connection.remoteContainer = e.Connection().RemoteContainer()
+		h.connection.remoteHostname = e.Connection().RemoteHostname()
+		if e.Transport().IsAuthenticated() { // SASL succeeded, so SASL() does not enable it.
+			h.connection.saslMech = e.Transport().SASL().Mech()
+		}
+		// Fields that are absent or can't be decoded are left nil.
+		if props := e.Connection().RemoteProperties(); !props.Empty() {
+			_ = props.Unmarshal(&h.connection.remoteProperties)
+		}
+		h.connection.remoteOfferedCapabilities, _ = e.Connection().RemoteOfferedCapabilities().Symbols()
+		h.connection.remoteDesiredCapabilities, _ = e.Connection().RemoteDesiredCapabilities().Symbols()
 		if e.Connection().State().LocalUninit() { // Remotely opened
 			h.incoming(newIncomingConnection(h.connection))
 		}
@@ -87,6 +111,11 @@ func (h *handler) HandleMessagingEvent(t proton.MessagingEvent, e proton.Event)
 
 	case proton.MSessionOpening:
 		if e.Session().State().LocalUninit() { // Remotely opened
+			if max := h.connection.maxSessions; max > 0 && len(h.sessions) >= max {
+				proton.CloseError(e.Session(), amqp.Errorf(amqp.ResourceLimitExceeded,
+					"session limit %v exceeded for %s", max, h.connection))
+				break
+			}
 			h.incoming(newIncomingSession(h, e.Session()))
 		}
 		h.sessions[e.Session()].wakeSync()
@@ -97,7 +126,13 @@ func (h *handler) HandleMessagingEvent(t proton.MessagingEvent, e proton.Event)
 	case proton.MLinkOpening:
 		l := e.Link()
 		if ss := h.sessions[l.Session()]; ss != nil {
-			if l.State().LocalUninit() { // Remotely opened.
+			remotelyOpened := l.State().LocalUninit()
+			if remotelyOpened {
+				if max := h.connection.maxLinksPerSession; max > 0 && h.sessionLinks(ss.pSession) >= max {
+					proton.CloseError(l, amqp.Errorf(amqp.ResourceLimitExceeded,
+						"link limit %v exceeded for %s", max, ss))
+					break
+				}
 				if l.IsReceiver() {
 					h.incoming(newIncomingReceiver(ss, l))
 				} else {
@@ -105,6 +140,9 @@ func (h *handler) HandleMessagingEvent(t proton.MessagingEvent, e proton.Event)
 				}
 			}
 			if ep, ok := h.links[l]; ok {
+				if lk, ok := ep.(interface{ remoteOpened() }); ok && !remotelyOpened {
+					lk.remoteOpened() // Accepting an incoming link doesn't make it locally opened.
+				}
 				ep.wakeSync()
 			} else {
 				h.linkError(l, "no link")
@@ -155,6 +193,26 @@ func (h *handler) addLink(pl proton.Link, el Endpoint) {
 	h.links[pl] = el
 }
 
+// sessionLinks returns the number of links on session ps.
+func (h *handler) sessionLinks(ps proton.Session) int {
+	n := 0
+	for l := range h.links {
+		if l.Session() == ps {
+			n++
+		}
+	}
+	return n
+}
+
+// outcome sends the remote outcome of delivery d to the sender waiting for it.
+func (h *handler) outcome(d proton.Delivery, sm sentMessage) {
+	if sm.timer != nil {
+		sm.timer.Stop()
+	}
+	sm.ack <- makeOutcome(d.Remote(), sm.value)
+	delete(h.sentMessages, d)
+}
+
 func (h *handler) linkClosed(l proton.Link, err error) {
 	if link, ok := h.links[l]; ok {
 		_ = link.closed(err)
@@ -29,13 +29,20 @@ import (
 // Settings associated with a link
 type LinkSettings interface {
 	// Source address that messages are coming from.
+	//
+	// For a link with a dynamic source (see TerminusSettings) this is the
+	// address assigned by the remote peer, available after Sync() returns.
 	Source() string
 
 	// Target address that messages are going to.
+	//
+	// For a link with a dynamic target this is the address assigned by the
+	// remote peer, available after Sync() returns.
 	Target() string
 
 	// Name is a unique name for the link among links between the same
-	// containers in the same direction. By default generated automatically.
+	// containers in the same direction. Set it with the LinkName() option, by
+	// default a name unique to the Container is generated.
 	LinkName() string
 
 	// IsSender is true if this is the sending end of the link.
@@ -72,7 +79,14 @@ func Source(s string) LinkOption { return func(l *linkSettings) { l.source = s }
 // Target returns a LinkOption that sets address that messages are going to.
 func Target(s string) LinkOption { return func(l *linkSettings) { l.target = s } }
 
-// LinkName returns a LinkOption that sets the link name.
+// LinkName returns a LinkOption that sets the link name. Use the same name
+// when re-opening a link after a reconnect to resume it, for example to
+// re-attach to a durable terminus.
+//
+// Without this option the name is generated as the container id, "@", and a
+// counter. It is unique among the links created by the Container, so it is
+// unique across containers if their ids are, but a new name is generated for
+// every link, including one opened again after a reconnect.
 func LinkName(s string) LinkOption { return func(l *linkSettings) { l.linkName = s } }
 
 // SndSettle returns a LinkOption that sets the send settle mode
@@ -87,6 +101,70 @@ func Capacity(n int) LinkOption { return func(l *linkSettings) { l.capacity = n
 // Prefetch returns a LinkOption that sets a receivers pre-fetch flag. Not relevant for a sender.
 func Prefetch(p bool) LinkOption { return func(l *linkSettings) { l.prefetch = p } }
 
+// CreditWindow returns a LinkOption that makes a receiver keep up to target
+// messages of credit outstanding, like Capacity(target) with Prefetch(true),
+// but only top up when at least half of the window can be issued. This sends
+// fewer flow frames than topping up after every message. Not relevant for a
+// sender.
+func CreditWindow(target int) LinkOption {
+	return func(l *linkSettings) {
+		l.capacity = target
+		l.prefetch = true
+		l.flowBatch = target / 2
+	}
+}
+
+// ReleaseExpired returns a LinkOption that makes a receiver release messages
+// that have expired, see amqp.Message.Expired(), instead of returning them
+// from Receive(). Not relevant for a sender.
+func ReleaseExpired() LinkOption { return func(l *linkSettings) { l.releaseExpired = true } }
+
+// AnonymousRelay returns a LinkOption that opens a sender with no target
+// address, for a peer that offers the anonymous relay capability, see
+// ConnectionSettings.RemoteAnonymousRelay(). The peer routes each message by
+// its amqp.Message.Address(), so one sender can send to many destinations.
+// Sending a message with no address gives an Unsent Outcome with an error.
+// Overrides the Target() option. Not relevant for a receiver.
+func AnonymousRelay() LinkOption { return func(l *linkSettings) { l.anonymousRelay = true } }
+
+// TagFormat returns a LinkOption that makes a sender generate the delivery tag
+// of the n'th message it sends, counting from 0, with format(n) instead of the
+// default short tags. For example fixed size 16 byte big-endian tags:
+//
+//	TagFormat(func(n uint64) []byte {
+//		tag := make([]byte, 16)
+//		binary.BigEndian.PutUint64(tag[8:], n)
+//		return tag
+//	})
+//
+// Tags must be unique among the unsettled deliveries of the link. A message
+// with a tag that is empty or longer than proton.MaxTagSize is not sent, it
+// gets an Unsent Outcome with an error. Not relevant for a receiver.
+func TagFormat(format func(n uint64) []byte) LinkOption {
+	return func(l *linkSettings) { l.tagFormat = format }
+}
+
+// SendTimeout returns a LinkOption that makes a sender give up on a message
+// the remote receiver has not settled within timeout after it was sent. The
+// delivery is settled locally, so the sender no longer tracks it, and the
+// message gets an Unacknowledged Outcome with Error == Timeout. The receiver
+// may or may not have received the message, re-send it if necessary. Not
+// relevant for a receiver.
+func SendTimeout(timeout time.Duration) LinkOption {
+	return func(l *linkSettings) { l.sendTimeout = timeout }
+}
+
+// PriorityQueue returns a LinkOption that makes a sender queue messages while
+// it is waiting for credit and send them in order of their header priority,
+// highest first, when credit is available. Messages with the same priority are
+// sent in the order they were queued. Not relevant for a receiver.
+//
+// Without this option messages are sent in the order the Send calls get
+// credit. With it the Send* methods do not block waiting for credit, a message
+// waits in the queue until it is sent, the link closes, or the timeout or
+// context of the Send call expires, then it is removed with an Unsent Outcome.
+func PriorityQueue() LinkOption { return func(l *linkSettings) { l.priorityQueue = true } }
+
 // DurableSubscription returns a LinkOption that configures a Receiver as a named durable
 // subscription.  The name overrides (and is overridden by) LinkName() so you should normally
 // only use one of these options.
@@ -125,6 +203,17 @@ func Filter(m map[amqp.Symbol]interface{}) LinkOption {
 	return func(l *linkSettings) { l.filter = m }
 }
 
+// SelectorDescriptor is the descriptor for a JMS-style selector filter, see Selector()
+const SelectorDescriptor = amqp.Symbol("apache.org:selector-filter:string")
+
+// Selector returns a LinkOption that adds a JMS-style selector filter to a
+// receiver's source, so the sender only sends messages matching the selector
+// expression, for example "color = 'red'". Can be combined with Filter(), in
+// any order, the selector is added as the "selector" entry of the filter.
+func Selector(expression string) LinkOption {
+	return func(l *linkSettings) { l.selector = expression }
+}
+
 // SourceSettings returns a LinkOption that sets all the SourceSettings.
 // Note: it will override the source address set by a Source() option
 func SourceSettings(ts TerminusSettings) LinkOption {
@@ -155,7 +244,9 @@ type RcvSettleMode proton.RcvSettleMode
 const (
 	// Receiver settles first.
 	RcvFirst = RcvSettleMode(proton.RcvFirst)
-	// Receiver waits for sender to settle before settling.
+	// Receiver waits for sender to settle before settling. A Receiver sends
+	// the outcome of Accept(), Reject() or Release() at once, and settles when
+	// the Sender settles on receiving the outcome.
 	RcvSecond = RcvSettleMode(proton.RcvSecond)
 )
 
@@ -170,7 +261,15 @@ type linkSettings struct {
 	rcvSettle      RcvSettleMode
 	capacity       int
 	prefetch       bool
+	priorityQueue  bool
+	releaseExpired bool
+	flowBatch      int // Minimum credit to issue when topping up, see CreditWindow()
+	coordinator    bool // Target is a transaction coordinator, see Session.Transaction()
+	anonymousRelay bool // Target has no address, see AnonymousRelay()
+	tagFormat      func(n uint64) []byte
+	sendTimeout    time.Duration // Give up on unsettled messages, see SendTimeout()
 	filter         map[amqp.Symbol]interface{}
+	selector       string
 	session        *session
 	pLink          proton.Link
 }
@@ -182,15 +281,19 @@ type TerminusSettings struct {
 	Durability proton.Durability
 	Expiry     proton.ExpiryPolicy
 	Timeout    time.Duration
-	Dynamic    bool
+	// Dynamic requests the remote peer to create a node and assign its address.
+	Dynamic bool
+	// DistributionMode is only meaningful for a source: move or copy messages.
+	DistributionMode proton.DistributionMode
 }
 
 func makeTerminusSettings(t proton.Terminus) TerminusSettings {
 	return TerminusSettings{
-		Durability: t.Durability(),
-		Expiry:     t.ExpiryPolicy(),
-		Timeout:    t.Timeout(),
-		Dynamic:    t.IsDynamic(),
+		Durability:       t.Durability(),
+		Expiry:           t.ExpiryPolicy(),
+		Timeout:          t.Timeout(),
+		Dynamic:          t.IsDynamic(),
+		DistributionMode: t.DistributionMode(),
 	}
 }
 
@@ -239,6 +342,17 @@ func makeLocalLink(sn *session, isSender bool, setting ...LinkOption) (linkSetti
 	}
 	l.pLink.Source().SetAddress(l.source)
 
+	if l.selector != "" { // Copy the filter, don't modify the caller's map.
+		filter := map[amqp.Symbol]interface{}{
+			"selector": amqp.Described{Descriptor: SelectorDescriptor, Value: l.selector},
+		}
+		for k, v := range l.filter {
+			if k != "selector" {
+				filter[k] = v
+			}
+		}
+		l.filter = filter
+	}
 	if len(l.filter) > 0 {
 		if err := l.pLink.Source().Filter().Marshal(l.filter); err != nil {
 			panic(err) // Shouldn't happen
@@ -248,12 +362,22 @@ func makeLocalLink(sn *session, isSender bool, setting ...LinkOption) (linkSetti
 	l.pLink.Source().SetExpiryPolicy(l.sourceSettings.Expiry)
 	l.pLink.Source().SetTimeout(l.sourceSettings.Timeout)
 	l.pLink.Source().SetDynamic(l.sourceSettings.Dynamic)
+	l.pLink.Source().SetDistributionMode(l.sourceSettings.DistributionMode)
 
-	l.pLink.Target().SetAddress(l.target)
+	if l.anonymousRelay && l.IsSender() {
+		l.target = ""
+		l.pLink.Target().ClearAddress()
+	} else {
+		l.pLink.Target().SetAddress(l.target)
+	}
 	l.pLink.Target().SetDurability(l.targetSettings.Durability)
 	l.pLink.Target().SetExpiryPolicy(l.targetSettings.Expiry)
 	l.pLink.Target().SetTimeout(l.targetSettings.Timeout)
 	l.pLink.Target().SetDynamic(l.targetSettings.Dynamic)
+	if l.coordinator {
+		l.pLink.Target().SetType(proton.Coordinator)
+		l.pLink.Target().Capabilities().SetSymbols([]amqp.Symbol{localTransactions})
+	}
 
 	l.pLink.SetSndSettleMode(proton.SndSettleMode(l.sndSettle))
 	l.pLink.SetRcvSettleMode(proton.RcvSettleMode(l.rcvSettle))
@@ -283,6 +407,18 @@ func makeIncomingLinkSettings(pLink proton.Link, sn *session) linkSettings {
 	return l
 }
 
+// Called in proton goroutine when the remote peer confirms a locally opened link.
+// Update settings that the remote peer may have assigned.
+func (l *link) remoteOpened() {
+	if l.sourceSettings.Dynamic {
+		l.source = l.pLink.RemoteSource().Address()
+	}
+	if l.targetSettings.Dynamic {
+		l.target = l.pLink.RemoteTarget().Address()
+	}
+	l.sourceSettings.DistributionMode = l.pLink.RemoteSource().DistributionMode()
+}
+
 // Not part of Link interface but use by Sender and Receiver.
 func (l *link) Credit() (credit int, err error) {
 	err = l.engine().InjectWait(func() error {
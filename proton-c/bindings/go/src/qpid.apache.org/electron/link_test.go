@@ -24,6 +24,7 @@ import (
 	"net"
 	"qpid.apache.org/amqp"
 	"qpid.apache.org/proton"
+	"strings"
 	"testing"
 	"time"
 )
@@ -64,3 +65,80 @@ func TestLinkSettings(t *testing.T) {
 	c.Close(nil)
 	<-done
 }
+
+func TestLinkNames(t *testing.T) {
+	client, server := newClientServer(t)
+	defer closeClientServer(client, server)
+	names := make(chan string, 10)
+	go func() {
+		for in := range server.Incoming() {
+			if in, ok := in.(*IncomingReceiver); ok {
+				names <- in.LinkName()
+			}
+			in.Accept()
+		}
+	}()
+	s1, err := client.Sender()
+	fatalIf(t, err)
+	s2, err := client.Sender()
+	fatalIf(t, err)
+	s3, err := client.Sender(LinkName("resume"))
+	fatalIf(t, err)
+	if s1.LinkName() == s2.LinkName() || !strings.HasPrefix(s1.LinkName(), "test-client@") {
+		t.Errorf("want unique generated names, got %q %q", s1.LinkName(), s2.LinkName())
+	}
+	for _, want := range []string{s1.LinkName(), s2.LinkName(), s3.LinkName()} {
+		errorIf(t, checkEqual(want, <-names))
+	}
+	errorIf(t, checkEqual("resume", s3.LinkName()))
+}
+
+func TestDynamicSource(t *testing.T) {
+	client, server := newClientServer(t)
+	defer closeClientServer(client, server)
+	go func() {
+		for in := range server.Incoming() {
+			switch in := in.(type) {
+			case *IncomingSender:
+				errorIf(t, checkEqual(true, in.SourceSettings().Dynamic))
+				errorIf(t, checkEqual(proton.DistModeCopy, in.SourceSettings().DistributionMode))
+				in.SetSource("dynamic-address")
+				in.Accept()
+			default:
+				in.Accept()
+			}
+		}
+	}()
+	r, err := client.Receiver(SourceSettings(TerminusSettings{Dynamic: true, DistributionMode: proton.DistModeCopy}))
+	fatalIf(t, err)
+	fatalIf(t, r.Sync())
+	errorIf(t, checkEqual("dynamic-address", r.Source()))
+	errorIf(t, checkEqual(proton.DistModeCopy, r.SourceSettings().DistributionMode))
+}
+
+func TestSelector(t *testing.T) {
+	client, server := newClientServer(t)
+	defer closeClientServer(client, server)
+	filters := make(chan map[amqp.Symbol]interface{}, 1)
+	go func() {
+		for in := range server.Incoming() {
+			if in, ok := in.(*IncomingSender); ok {
+				filters <- in.Filter()
+			}
+			in.Accept()
+		}
+	}()
+	want := map[amqp.Symbol]interface{}{
+		"other":    "x",
+		"selector": amqp.Described{Descriptor: SelectorDescriptor, Value: "color = 'red'"},
+	}
+	// Option order doesn't matter and the caller's filter map is not modified.
+	filter := map[amqp.Symbol]interface{}{"other": "x"}
+	_, err := client.Receiver(Source("foo"), Filter(filter), Selector("color = 'red'"))
+	fatalIf(t, err)
+	errorIf(t, checkEqual(want, <-filters))
+	_, err = client.Receiver(Source("foo"), Selector("color = 'red'"), Filter(filter))
+	fatalIf(t, err)
+	errorIf(t, checkEqual(want, <-filters))
+	errorIf(t, checkEqual(map[amqp.Symbol]interface{}{"other": "x"}, filter))
+}
@@ -0,0 +1,185 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package electron
+
+import (
+	"context"
+	"fmt"
+	"qpid.apache.org/amqp"
+)
+
+// ManagementAddress is the address of the standard AMQP management node.
+const ManagementAddress = "$management"
+
+// ManagementError is returned by ManagementClient methods when the management
+// node responds with a status code that is not a 2xx success code, for
+// example 404 if the entity does not exist.
+type ManagementError struct {
+	StatusCode  int
+	Description string
+}
+
+func (e ManagementError) Error() string {
+	return fmt.Sprintf("management status %d: %s", e.StatusCode, e.Description)
+}
+
+// ManagementClient makes AMQP management requests to a management node, for
+// example to create, read, update, delete or query the queues of a broker. It
+// uses a Client to send requests and correlate responses, and is safe for
+// concurrent use.
+//
+// Entity attributes are amqp.Map values with string keys.
+type ManagementClient struct {
+	client  *Client
+	address string
+}
+
+// NewManagementClient creates a ManagementClient for the management node at
+// ManagementAddress on conn.
+func NewManagementClient(conn Connection) (*ManagementClient, error) {
+	c, err := NewClient(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &ManagementClient{client: c, address: ManagementAddress}, nil
+}
+
+// CreateEntity creates an entity of entityType called name with attributes,
+// and returns the attributes of the new entity.
+func (mc *ManagementClient) CreateEntity(ctx context.Context, entityType, name string, attributes amqp.Map) (amqp.Map, error) {
+	return mc.entity(ctx, "CREATE", entityType, name, attributes)
+}
+
+// ReadEntity returns the attributes of the entity of entityType called name.
+func (mc *ManagementClient) ReadEntity(ctx context.Context, entityType, name string) (amqp.Map, error) {
+	return mc.entity(ctx, "READ", entityType, name, nil)
+}
+
+// UpdateEntity sets attributes of the entity of entityType called name, and
+// returns the updated attributes.
+func (mc *ManagementClient) UpdateEntity(ctx context.Context, entityType, name string, attributes amqp.Map) (amqp.Map, error) {
+	return mc.entity(ctx, "UPDATE", entityType, name, attributes)
+}
+
+// DeleteEntity deletes the entity of entityType called name.
+func (mc *ManagementClient) DeleteEntity(ctx context.Context, entityType, name string) error {
+	_, err := mc.entity(ctx, "DELETE", entityType, name, nil)
+	return err
+}
+
+// Query returns the attributes of all entities of entityType, one map per
+// entity. If attributeNames are given only those attributes are returned.
+func (mc *ManagementClient) Query(ctx context.Context, entityType string, attributeNames ...string) ([]amqp.Map, error) {
+	names := amqp.List{}
+	for _, n := range attributeNames {
+		names = append(names, n)
+	}
+	res, err := mc.call(ctx, "QUERY",
+		map[string]interface{}{"entityType": entityType},
+		amqp.Map{"attributeNames": names})
+	if err != nil {
+		return nil, err
+	}
+	body, ok := res.Body().(amqp.Map)
+	if !ok {
+		return nil, fmt.Errorf("management QUERY: invalid response body %v", res.Body())
+	}
+	names, _ = body["attributeNames"].(amqp.List)
+	results, _ := body["results"].(amqp.List)
+	entities := make([]amqp.Map, 0, len(results))
+	for _, r := range results {
+		values, ok := r.(amqp.List)
+		if !ok || len(values) != len(names) {
+			return nil, fmt.Errorf("management QUERY: invalid result %v", r)
+		}
+		entity := make(amqp.Map, len(names))
+		for i, n := range names {
+			entity[n] = values[i]
+		}
+		entities = append(entities, entity)
+	}
+	return entities, nil
+}
+
+// Close closes the ManagementClient's links, the Connection is not closed.
+func (mc *ManagementClient) Close() { mc.client.Close() }
+
+// entity makes a request for a single named entity, returns the attributes in
+// the response body if there are any.
+func (mc *ManagementClient) entity(ctx context.Context, operation, entityType, name string, attributes amqp.Map) (amqp.Map, error) {
+	var body interface{}
+	if attributes != nil {
+		body = attributes
+	}
+	res, err := mc.call(ctx, operation,
+		map[string]interface{}{"type": entityType, "name": name}, body)
+	if err != nil || res.Body() == nil {
+		return nil, err
+	}
+	m, ok := res.Body().(amqp.Map)
+	if !ok {
+		return nil, fmt.Errorf("management %s: invalid response body %v", operation, res.Body())
+	}
+	return m, nil
+}
+
+// call sends a management request and checks the response has a success status.
+func (mc *ManagementClient) call(ctx context.Context, operation string, props map[string]interface{}, body interface{}) (amqp.Message, error) {
+	req := amqp.NewMessageWith(body)
+	props["operation"] = operation
+	req.SetApplicationProperties(props)
+	res, err := mc.client.Call(ctx, mc.address, req)
+	if err != nil {
+		return nil, err
+	}
+	props = res.ApplicationProperties()
+	code, ok := statusCode(props["statusCode"])
+	if !ok {
+		return nil, fmt.Errorf("management %s: invalid status code %v", operation, props["statusCode"])
+	}
+	if code < 200 || code >= 300 {
+		description, _ := props["statusDescription"].(string)
+		return nil, ManagementError{code, description}
+	}
+	return res, nil
+}
+
+// statusCode converts an integer status code of any AMQP integer type to int.
+func statusCode(v interface{}) (int, bool) {
+	switch v := v.(type) {
+	case int8:
+		return int(v), true
+	case int16:
+		return int(v), true
+	case int32:
+		return int(v), true
+	case int64:
+		return int(v), true
+	case uint8:
+		return int(v), true
+	case uint16:
+		return int(v), true
+	case uint32:
+		return int(v), true
+	case uint64:
+		return int(v), true
+	}
+	return 0, false
+}
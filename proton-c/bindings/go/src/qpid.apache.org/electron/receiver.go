@@ -20,6 +20,7 @@ under the License.
 package electron
 
 import (
+	"context"
 	"fmt"
 	"qpid.apache.org/amqp"
 	"qpid.apache.org/proton"
@@ -42,6 +43,11 @@ type Receiver interface {
 	// Receive remains on the link. It will be used by the next call to Receive.
 	ReceiveTimeout(timeout time.Duration) (ReceivedMessage, error)
 
+	// ReceiveContext is like Receive but gives up when ctx is done, returning
+	// ctx.Err(). As for ReceiveTimeout, credit issued when Prefetch is false
+	// remains on the link.
+	ReceiveContext(ctx context.Context) (ReceivedMessage, error)
+
 	// Prefetch==true means the Receiver will automatically issue credit to the
 	// remote sender to keep its buffer as full as possible, i.e. it will
 	// "pre-fetch" messages independently of the application calling
@@ -63,6 +69,20 @@ type Receiver interface {
 	// Capacity is the size (number of messages) of the local message buffer
 	// These are messages received but not yet returned to the application by a call to Receive()
 	Capacity() int
+
+	// DrainAndClose shuts the receiver down without losing messages that are in
+	// flight. The receiver stops issuing credit and asks the sender to drain
+	// the link: send what it can with the credit already issued and give up the
+	// rest. Once the drain is complete, DrainAndClose waits for all the
+	// messages received on the link to be settled, so other goroutines can
+	// continue to Receive() and acknowledge buffered messages, then closes the
+	// link.
+	//
+	// If ctx is done first the link is closed at once and ctx.Err() is returned.
+	// Returns the messages left in the buffer when the link closed. They were not
+	// returned by Receive() and can no longer be acknowledged, the sender will
+	// deliver them again.
+	DrainAndClose(ctx context.Context) ([]ReceivedMessage, error)
 }
 
 // Receiver implementation
@@ -70,6 +90,8 @@ type receiver struct {
 	link
 	buffer  chan ReceivedMessage
 	callers int
+	stopped bool          // No more credit is issued, see DrainAndClose()
+	drained chan struct{} // Closed when draining is done, see DrainAndClose()
 }
 
 func (r *receiver) Capacity() int  { return cap(r.buffer) }
@@ -95,7 +117,7 @@ func newReceiver(ls linkSettings) *receiver {
 func (r *receiver) maxFlow() int { return cap(r.buffer) - len(r.buffer) - r.pLink.Credit() }
 
 func (r *receiver) flow(credit int) {
-	if credit > 0 {
+	if credit > 0 && !r.stopped {
 		r.pLink.Flow(credit)
 	}
 }
@@ -105,19 +127,32 @@ func (r *receiver) flow(credit int) {
 func (r *receiver) caller(inc int) {
 	_ = r.engine().Inject(func() {
 		r.callers += inc
-		need := r.callers - (len(r.buffer) + r.pLink.Credit())
-		max := r.maxFlow()
-		if need > max {
-			need = max
-		}
-		r.flow(need)
+		r.flow(r.neededFlow())
 	})
 }
 
+// Call in proton goroutine. Credit needed for waiting callers, or to fill the
+// buffer if prefetch is enabled.
+func (r *receiver) neededFlow() int {
+	max := r.maxFlow()
+	if r.prefetch {
+		return max
+	}
+	need := r.callers - (len(r.buffer) + r.pLink.Credit())
+	if need > max {
+		need = max
+	}
+	return need
+}
+
 // Inject flow top-up if prefetch is enabled
 func (r *receiver) flowTopUp() {
 	if r.prefetch {
-		_ = r.engine().Inject(func() { r.flow(r.maxFlow()) })
+		_ = r.engine().Inject(func() {
+			if n := r.maxFlow(); n >= r.flowBatch {
+				r.flow(n)
+			}
+		})
 	}
 }
 
@@ -126,6 +161,15 @@ func (r *receiver) Receive() (rm ReceivedMessage, err error) {
 }
 
 func (r *receiver) ReceiveTimeout(timeout time.Duration) (rm ReceivedMessage, err error) {
+	return r.receive(func() (interface{}, error) { return timedReceive(r.buffer, timeout) })
+}
+
+func (r *receiver) ReceiveContext(ctx context.Context) (rm ReceivedMessage, err error) {
+	return r.receive(func() (interface{}, error) { return contextReceive(ctx, r.buffer) })
+}
+
+// receive calls wait to receive from r.buffer if a message is not immediately available.
+func (r *receiver) receive(wait func() (interface{}, error)) (rm ReceivedMessage, err error) {
 	assert(r.buffer != nil, "Receiver is not open: %s", r)
 	if !r.prefetch { // Per-caller flow control
 		select { // Check for immediate availability, avoid caller() inject
@@ -141,7 +185,7 @@ func (r *receiver) ReceiveTimeout(timeout time.Duration) (rm ReceivedMessage, er
 			defer r.caller(-1)
 		}
 	}
-	rmi, err := timedReceive(r.buffer, timeout)
+	rmi, err := wait()
 	switch err {
 	case nil:
 		r.flowTopUp()
@@ -160,12 +204,25 @@ func (r *receiver) message(delivery proton.Delivery) {
 	}
 	if delivery.HasMessage() {
 		m, err := delivery.Message()
+		if err == amqp.ErrAborted {
+			// Discard the aborted delivery and replace the credit it used.
+			delivery.Settle()
+			r.pLink.Advance()
+			r.flow(r.neededFlow())
+			return
+		}
 		if err != nil {
 			localClose(r.pLink, err)
 			return
 		}
 		assert(m != nil)
 		r.pLink.Advance()
+		if r.releaseExpired && m.Expired() {
+			// Give the message back and replace the credit it used.
+			settleAs(delivery, proton.Released)
+			r.flow(r.neededFlow())
+			return
+		}
 		if r.pLink.Credit() < 0 {
 			localClose(r.pLink, fmt.Errorf("received message in excess of credit limit"))
 		} else {
@@ -175,8 +232,50 @@ func (r *receiver) message(delivery proton.Delivery) {
 	}
 }
 
+func (r *receiver) DrainAndClose(ctx context.Context) ([]ReceivedMessage, error) {
+	drained := make(chan struct{})
+	err := r.engine().InjectWait(func() error {
+		if r.Error() != nil {
+			return r.Error()
+		}
+		r.stopped = true
+		r.drained = drained
+		_ = r.pLink.Drain(0)
+		r.checkDrained()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-drained:
+		err = r.Error() // Set if the link closed while draining.
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	r.Close(nil)
+	var remaining []ReceivedMessage
+	for rm := range r.buffer { // Closed when the link closes.
+		remaining = append(remaining, rm)
+	}
+	return remaining, err
+}
+
+// checkDrained signals DrainAndClose if the link is drained and has no
+// unsettled messages. Call in proton goroutine.
+func (r *receiver) checkDrained() {
+	if r.drained != nil && !r.pLink.Draining() && r.pLink.Unsettled() == 0 {
+		close(r.drained)
+		r.drained = nil
+	}
+}
+
 func (r *receiver) closed(err error) error {
 	e := r.link.closed(err)
+	if r.drained != nil {
+		close(r.drained)
+		r.drained = nil
+	}
 	if r.buffer != nil {
 		close(r.buffer)
 	}
@@ -192,11 +291,33 @@ type ReceivedMessage struct {
 	receiver  Receiver
 }
 
+// Redelivered is true if the message may have been delivered before, i.e. its
+// delivery-count header is greater than 0. Brokers increment the count when
+// they deliver a message again, for example after it was released. Use it to
+// avoid repeating non-idempotent work.
+func (rm *ReceivedMessage) Redelivered() bool { return rm.Message.DeliveryCount() > 0 }
+
 // Acknowledge a ReceivedMessage with the given delivery status.
 func (rm *ReceivedMessage) acknowledge(status uint64) error {
+	return rm.settle(func() { settleAs(rm.pDelivery, status) })
+}
+
+// settleAs updates delivery to status and settles it. If the link uses
+// RcvSecond and the sender has not settled yet, the delivery is settled when
+// it does, see the MSettled handler.
+func settleAs(delivery proton.Delivery, status uint64) {
+	delivery.Update(status)
+	if delivery.Link().RcvSettleMode() != proton.RcvSecond || delivery.Settled() {
+		delivery.Settle()
+	}
+}
+
+// settle calls settle in the handler goroutine to settle the delivery.
+func (rm *ReceivedMessage) settle(settle func()) error {
 	return rm.receiver.(*receiver).engine().Inject(func() {
 		// Deliveries are valid as long as the connection is, unless settled.
-		rm.pDelivery.SettleAs(uint64(status))
+		settle()
+		rm.receiver.(*receiver).checkDrained()
 	})
 }
 
@@ -206,6 +327,17 @@ func (rm *ReceivedMessage) Accept() error { return rm.acknowledge(proton.Accepte
 // Reject tells the sender we consider the message invalid and unusable.
 func (rm *ReceivedMessage) Reject() error { return rm.acknowledge(proton.Rejected) }
 
+// RejectError is like Reject but sends err to the sender as the error
+// condition of the rejected outcome, see proton.Condition.SetError(). Set the
+// Info map of an amqp.Error to send details, for example the fields that
+// failed validation.
+func (rm *ReceivedMessage) RejectError(err error) error {
+	return rm.settle(func() {
+		rm.pDelivery.Local().Condition().SetError(err)
+		settleAs(rm.pDelivery, proton.Rejected)
+	})
+}
+
 // Release tells the sender we will not process the message but some other
 // receiver might.
 func (rm *ReceivedMessage) Release() error { return rm.acknowledge(proton.Released) }
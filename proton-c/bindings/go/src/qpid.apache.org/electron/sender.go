@@ -23,9 +23,12 @@ package electron
 import "C"
 
 import (
+	"container/heap"
+	"context"
 	"fmt"
 	"qpid.apache.org/amqp"
 	"qpid.apache.org/proton"
+	"sync/atomic"
 	"time"
 )
 
@@ -36,7 +39,7 @@ import (
 // A sender can buffer messages up to the credit limit provided by the remote receiver.
 // All the Send* methods will block if the buffer is full until there is space.
 // Send*Timeout methods will give up after the timeout and set Timeout as Outcome.Error.
-//
+// SendSyncContext gives up when the context is done and sets ctx.Err() as Outcome.Error.
 type Sender interface {
 	Endpoint
 	LinkSettings
@@ -78,6 +81,19 @@ type Sender interface {
 	SendForgetTimeout(m amqp.Message, timeout time.Duration)
 
 	SendSyncTimeout(m amqp.Message, timeout time.Duration) Outcome
+
+	// SendSyncContext is like SendSync but gives up when ctx is done. The
+	// Outcome.Status is Unsent if ctx was done before there was credit to send
+	// the message, Unacknowledged if it was done while waiting for the
+	// disposition.
+	SendSyncContext(ctx context.Context, m amqp.Message) Outcome
+
+	// Sendable returns a channel that receives a value when the remote
+	// receiver grants credit, so a message can be sent without waiting. At most
+	// one value is buffered, there may be no credit left by the time it is
+	// received if other goroutines are also sending. The channel is closed
+	// when the sender is closed.
+	Sendable() <-chan struct{}
 }
 
 // Outcome provides information about the outcome of sending a message.
@@ -134,6 +150,18 @@ func (s SentStatus) String() string {
 	}
 }
 
+// makeOutcome makes the Outcome of a sent message from its remote disposition.
+func makeOutcome(d proton.Disposition, v interface{}) Outcome {
+	switch d.Type() {
+	case declaredCode:
+		return declaredOutcome(d, v)
+	case transactionalStateCode:
+		return transactionalOutcome(d, v)
+	default:
+		return Outcome{sentStatus(d.Type()), d.Condition().Error(), v}
+	}
+}
+
 // Convert proton delivery state code to SentStatus value
 func sentStatus(d uint64) SentStatus {
 	switch d {
@@ -151,54 +179,200 @@ func sentStatus(d uint64) SentStatus {
 // Sender implementation, held by handler.
 type sender struct {
 	link
-	credit chan struct{} // Signal available credit.
+	credit   chan struct{} // Signal available credit.
+	writable chan struct{} // Signal available credit to the application, see Sendable()
+	tags     uint64        // Number of tags generated with tagFormat
+	queue    *sendQueue    // Messages waiting for credit, if PriorityQueue() is set.
+	waiting  int32         // Number of senders waiting for credit or to send, atomic.
 }
 
 func (s *sender) SendAsyncTimeout(m amqp.Message, ack chan<- Outcome, v interface{}, t time.Duration) {
-	// wait for credit
-	if _, err := timedReceive(s.credit, t); err != nil {
+	if s.queue != nil {
+		s.enqueue(m, ack, v, t, "")
+		return
+	}
+	atomic.AddInt32(&s.waiting, 1)
+	_, err := timedReceive(s.credit, t) // wait for credit
+	s.sendAsync(m, ack, v, "", err)
+}
+
+// sendAsync sends m, or sends an Unsent Outcome if err from waiting for credit
+// is not nil. If txnId is not empty the message is sent as part of that transaction.
+// The caller must have counted itself in s.waiting before waiting for credit.
+func (s *sender) sendAsync(m amqp.Message, ack chan<- Outcome, v interface{}, txnId amqp.Binary, err error) {
+	if err != nil {
+		atomic.AddInt32(&s.waiting, -1)
 		if err == Closed && s.Error() != nil {
 			err = s.Error()
 		}
 		Outcome{Unsent, err, v}.send(ack)
+		_ = s.engine().Inject(func() { // A drain may be waiting for this sender to give up.
+			if s.Error() == nil {
+				s.drained()
+			}
+		})
 		return
 	}
 	// Send a message in handler goroutine
+	err = s.engine().Inject(func() {
+		atomic.AddInt32(&s.waiting, -1)
+		s.send(m, ack, v, txnId)
+		if s.pLink.Credit() > 0 { // Signal there is still credit
+			s.sendable()
+		}
+	})
+	if err != nil {
+		atomic.AddInt32(&s.waiting, -1)
+		Outcome{Unsent, err, v}.send(ack)
+	}
+}
+
+// Send a message now, handler goroutine.
+func (s *sender) send(m amqp.Message, ack chan<- Outcome, v interface{}, txnId amqp.Binary) {
+	if s.Error() != nil {
+		Outcome{Unsent, s.Error(), v}.send(ack)
+		return
+	}
+	if s.anonymousRelay && m.Address() == "" {
+		Outcome{Unsent, fmt.Errorf("message has no address for anonymous relay %s", s), v}.send(ack)
+		return
+	}
+
+	var delivery proton.Delivery
+	var err error
+	if s.tagFormat != nil {
+		delivery, err = s.pLink.SendWithTag(m, s.tagFormat(s.tags))
+		s.tags++
+	} else {
+		delivery, err = s.pLink.Send(m)
+	}
+	if err == nil && txnId != "" {
+		setTransactionalState(delivery, txnId)
+	}
+	switch {
+	case err != nil:
+		Outcome{Unsent, err, v}.send(ack)
+	case ack == nil || s.SndSettle() == SndSettled: // Pre-settled
+		if s.SndSettle() != SndUnsettled { // Not forced to send unsettled by link policy
+			delivery.Settle()
+		}
+		Outcome{Accepted, nil, v}.send(ack) // Assume accepted
+	default:
+		sm := sentMessage{ack: ack, value: v}
+		if s.sendTimeout > 0 {
+			sm.timer = s.expire(delivery, s.sendTimeout)
+		}
+		s.handler().sentMessages[delivery] = sm // Register with handler
+	}
+}
+
+// expire returns a timer that abandons delivery after timeout if it is still
+// unsettled, with an Unacknowledged Timeout outcome.
+func (s *sender) expire(delivery proton.Delivery, timeout time.Duration) (timer *time.Timer) {
+	h := s.handler()
+	timer = time.AfterFunc(timeout, func() {
+		_ = s.engine().Inject(func() {
+			// The delivery may have been settled and its memory re-used.
+			if sm, ok := h.sentMessages[delivery]; ok && sm.timer == timer {
+				delete(h.sentMessages, delivery)
+				delivery.Settle()
+				Outcome{Unacknowledged, Timeout, sm.value}.send(sm.ack)
+			}
+		})
+	})
+	return timer
+}
+
+// enqueue adds a message to the priority queue, it is sent in priority order
+// when there is credit. If it has not been sent after timeout it is removed with
+// an Unsent outcome. Returns nil if the message could not be queued.
+func (s *sender) enqueue(m amqp.Message, ack chan<- Outcome, v interface{}, t time.Duration, txnId amqp.Binary) *queuedMessage {
+	qm := &queuedMessage{m: m, ack: ack, value: v, txnId: txnId, index: -1}
 	err := s.engine().Inject(func() {
 		if s.Error() != nil {
 			Outcome{Unsent, s.Error(), v}.send(ack)
 			return
 		}
-
-		delivery, err2 := s.pLink.Send(m)
+		heap.Push(s.queue, qm)
+		s.drain()
 		switch {
-		case err2 != nil:
-			Outcome{Unsent, err2, v}.send(ack)
-		case ack == nil || s.SndSettle() == SndSettled: // Pre-settled
-			if s.SndSettle() != SndUnsettled { // Not forced to send unsettled by link policy
-				delivery.Settle()
-			}
-			Outcome{Accepted, nil, v}.send(ack) // Assume accepted
-		default:
-			s.handler().sentMessages[delivery] = sentMessage{ack, v} // Register with handler
-		}
-		if s.pLink.Credit() > 0 { // Signal there is still credit
-			s.sendable()
+		case t == 0: // Only send if there is credit now
+			s.dequeue(qm, Timeout)
+		case t != Forever && qm.index >= 0:
+			qm.timer = time.AfterFunc(t, func() { _ = s.engine().Inject(func() { s.dequeue(qm, Timeout) }) })
 		}
 	})
 	if err != nil {
 		Outcome{Unsent, err, v}.send(ack)
+		return nil
 	}
+	return qm
 }
 
-// Set credit flag if not already set. Non-blocking, any goroutine
-func (s *sender) sendable() {
-	select { // Non-blocking
-	case s.credit <- struct{}{}:
+// dequeue removes a message that has not been sent yet from the queue, with an
+// Unsent outcome. Returns false if the message is not queued. Handler goroutine.
+func (s *sender) dequeue(qm *queuedMessage, err error) bool {
+	if qm.index < 0 {
+		return false
+	}
+	heap.Remove(s.queue, qm.index)
+	Outcome{Unsent, err, qm.value}.send(qm.ack)
+	return true
+}
+
+// abandon stops waiting for the outcome of a queued message. If it has not been
+// sent it is removed from the queue and the outcome is Unsent, otherwise it is
+// Unacknowledged unless the outcome has already arrived.
+func (s *sender) abandon(qm *queuedMessage, ack <-chan Outcome, err error) Outcome {
+	_ = s.engine().InjectWait(func() error { s.dequeue(qm, err); return nil })
+	select {
+	case out := <-ack:
+		return out
 	default:
+		return Outcome{Unacknowledged, err, nil}
+	}
+}
+
+// drain sends queued messages while there is credit. Handler goroutine.
+func (s *sender) drain() {
+	for s.queue.Len() > 0 && s.pLink.Credit() > 0 {
+		qm := heap.Pop(s.queue).(*queuedMessage)
+		s.send(qm.m, qm.ack, qm.value, qm.txnId)
+	}
+}
+
+// drained gives up the credit that is left if the receiver asked to drain the
+// link and no sender is waiting to use it. Handler goroutine.
+func (s *sender) drained() {
+	if s.pLink.IsDrain() && atomic.LoadInt32(&s.waiting) == 0 {
+		s.pLink.Drained()
+	}
+}
+
+// Set credit flag if not already set, or send queued messages if there is a
+// priority queue. If the receiver asked to drain the link, give up the credit
+// that is left once no sender is waiting for it. Non-blocking, handler goroutine.
+func (s *sender) sendable() {
+	if s.queue != nil {
+		s.drain()
+	}
+	s.drained()
+	if s.pLink.Credit() > 0 {
+		if s.queue == nil {
+			select { // Non-blocking
+			case s.credit <- struct{}{}:
+			default:
+			}
+		}
+		select { // Non-blocking
+		case s.writable <- struct{}{}:
+		default:
+		}
 	}
 }
 
+func (s *sender) Sendable() <-chan struct{} { return s.writable }
+
 func (s *sender) SendWaitableTimeout(m amqp.Message, t time.Duration) <-chan Outcome {
 	out := make(chan Outcome, 1)
 	s.SendAsyncTimeout(m, out, nil, t)
@@ -210,6 +384,17 @@ func (s *sender) SendForgetTimeout(m amqp.Message, t time.Duration) {
 }
 
 func (s *sender) SendSyncTimeout(m amqp.Message, t time.Duration) Outcome {
+	if s.queue != nil {
+		ack := make(chan Outcome, 1)
+		qm := s.enqueue(m, ack, nil, t, "")
+		if qm == nil {
+			return <-ack // Unsent
+		}
+		if out, err := timedReceive(ack, t); err == nil {
+			return out.(Outcome)
+		}
+		return s.abandon(qm, ack, Timeout)
+	}
 	deadline := time.Now().Add(t)
 	ack := s.SendWaitableTimeout(m, t)
 	t = deadline.Sub(time.Now()) // Adjust for time already spent.
@@ -226,6 +411,34 @@ func (s *sender) SendSyncTimeout(m amqp.Message, t time.Duration) Outcome {
 	}
 }
 
+func (s *sender) SendSyncContext(ctx context.Context, m amqp.Message) Outcome {
+	ack := make(chan Outcome, 1)
+	if s.queue != nil {
+		qm := s.enqueue(m, ack, nil, Forever, "")
+		if qm == nil {
+			return <-ack // Unsent
+		}
+		if out, err := contextReceive(ctx, ack); err == nil {
+			return out.(Outcome)
+		}
+		return s.abandon(qm, ack, ctx.Err())
+	}
+	atomic.AddInt32(&s.waiting, 1)
+	_, err := contextReceive(ctx, s.credit) // wait for credit
+	s.sendAsync(m, ack, nil, "", err)
+	if err != nil {
+		return <-ack // Unsent
+	}
+	if out, err := contextReceive(ctx, ack); err == nil {
+		return out.(Outcome)
+	} else {
+		if err == Closed && s.Error() != nil {
+			err = s.Error()
+		}
+		return Outcome{Unacknowledged, err, nil}
+	}
+}
+
 func (s *sender) SendAsync(m amqp.Message, ack chan<- Outcome, v interface{}) {
 	s.SendAsyncTimeout(m, ack, v, Forever)
 }
@@ -245,11 +458,22 @@ func (s *sender) SendSync(m amqp.Message) Outcome {
 // handler goroutine
 func (s *sender) closed(err error) error {
 	close(s.credit)
-	return s.link.closed(err)
+	close(s.writable)
+	err = s.link.closed(err)
+	if s.queue != nil {
+		for s.queue.Len() > 0 {
+			qm := s.queue.Pop().(*queuedMessage)
+			Outcome{Unsent, s.Error(), qm.value}.send(qm.ack)
+		}
+	}
+	return err
 }
 
 func newSender(ls linkSettings) *sender {
-	s := &sender{link: link{linkSettings: ls}, credit: make(chan struct{}, 1)}
+	s := &sender{link: link{linkSettings: ls}, credit: make(chan struct{}, 1), writable: make(chan struct{}, 1)}
+	if ls.priorityQueue {
+		s.queue = &sendQueue{}
+	}
 	s.endpoint.init(s.link.pLink.String())
 	s.handler().addLink(s.pLink, s)
 	s.link.pLink.Open()
@@ -260,6 +484,7 @@ func newSender(ls linkSettings) *sender {
 type sentMessage struct {
 	ack   chan<- Outcome
 	value interface{}
+	timer *time.Timer // Set by the SendTimeout() option
 }
 
 // IncomingSender is sent on the Connection.Incoming() channel when there is
@@ -276,9 +501,17 @@ func newIncomingSender(sn *session, pLink proton.Link) *IncomingSender {
 	}
 }
 
+// SetSource sets the source address of the incoming sender, call before
+// Accept(). Use it to assign an address when the remote receiver requested a
+// dynamic source.
+func (in *IncomingSender) SetSource(address string) { in.source = address }
+
 // Accept accepts an incoming sender endpoint
 func (in *IncomingSender) Accept() Endpoint {
-	return in.accept(func() Endpoint { return newSender(in.linkSettings) })
+	return in.accept(func() Endpoint {
+		in.pLink.Source().SetAddress(in.source)
+		return newSender(in.linkSettings)
+	})
 }
 
 // Call in injected functions to check if the sender is valid.
@@ -286,3 +519,57 @@ func (s *sender) valid() bool {
 	s2, ok := s.handler().links[s.pLink].(*sender)
 	return ok && s2 == s
 }
+
+// queuedMessage is a message waiting for credit in a sendQueue.
+type queuedMessage struct {
+	m     amqp.Message
+	ack   chan<- Outcome
+	value interface{}
+	txnId amqp.Binary // Transaction, empty if none
+	seq   uint64      // Order of arrival in the queue
+	index int         // Index in the queue, -1 if not queued
+	timer *time.Timer // Removes the message after its timeout, nil if none
+}
+
+// sendQueue orders messages by priority, highest first, and then by order of
+// arrival. It implements heap.Interface, used in the handler goroutine.
+type sendQueue struct {
+	messages []*queuedMessage
+	seq      uint64
+}
+
+func (q *sendQueue) Len() int { return len(q.messages) }
+
+func (q *sendQueue) Less(i, j int) bool {
+	a, b := q.messages[i], q.messages[j]
+	if pa, pb := a.m.Priority(), b.m.Priority(); pa != pb {
+		return pa > pb
+	}
+	return a.seq < b.seq
+}
+
+func (q *sendQueue) Swap(i, j int) {
+	q.messages[i], q.messages[j] = q.messages[j], q.messages[i]
+	q.messages[i].index = i
+	q.messages[j].index = j
+}
+
+func (q *sendQueue) Push(x interface{}) {
+	qm := x.(*queuedMessage)
+	qm.index = len(q.messages)
+	qm.seq = q.seq
+	q.seq++
+	q.messages = append(q.messages, qm)
+}
+
+func (q *sendQueue) Pop() interface{} {
+	n := len(q.messages) - 1
+	qm := q.messages[n]
+	q.messages[n] = nil
+	q.messages = q.messages[:n]
+	qm.index = -1
+	if qm.timer != nil {
+		qm.timer.Stop()
+	}
+	return qm
+}
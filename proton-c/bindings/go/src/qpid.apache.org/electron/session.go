@@ -32,6 +32,11 @@ type Session interface {
 
 	// Receiver opens a new Receiver.
 	Receiver(...LinkOption) (Receiver, error)
+
+	// Transaction declares a new transaction with the remote transaction
+	// coordinator. The first call opens a coordinator link on the session,
+	// later calls re-use it.
+	Transaction() (Txn, error)
 }
 
 type session struct {
@@ -39,18 +44,23 @@ type session struct {
 	pSession                         proton.Session
 	connection                       *connection
 	incomingCapacity, outgoingWindow uint
+	coordinator                      *sender // Transaction coordinator link, created on demand
 }
 
 // SessionOption can be passed when creating a Session
 type SessionOption func(*session)
 
 // IncomingCapacity returns a Session Option that sets the size (in bytes) of
-// the session's incoming data buffer.
+// the session's incoming data buffer. The incoming window advertised to the
+// remote peer is the capacity divided by the transport's maximum frame size,
+// so the capacity must be at least one frame. If not set, or 0, the proton
+// default of 1MB is used.
 func IncomingCapacity(bytes uint) SessionOption {
 	return func(s *session) { s.incomingCapacity = bytes }
 }
 
-// OutgoingWindow returns a Session Option that sets the outgoing window size (in frames).
+// OutgoingWindow returns a Session Option that sets the outgoing window size
+// (in frames). If not set, or 0, the window is the maximum allowed by AMQP.
 func OutgoingWindow(frames uint) SessionOption {
 	return func(s *session) { s.outgoingWindow = frames }
 }
@@ -66,8 +76,12 @@ func newSession(c *connection, es proton.Session, setting ...SessionOption) *ses
 		set(s)
 	}
 	c.handler.sessions[s.pSession] = s
-	s.pSession.SetIncomingCapacity(s.incomingCapacity)
-	s.pSession.SetOutgoingWindow(s.outgoingWindow)
+	if s.incomingCapacity > 0 {
+		s.pSession.SetIncomingCapacity(s.incomingCapacity)
+	}
+	if s.outgoingWindow > 0 {
+		s.pSession.SetOutgoingWindow(s.outgoingWindow)
+	}
 	s.pSession.Open()
 	return s
 }
@@ -20,6 +20,7 @@ under the License.
 package electron
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"reflect"
@@ -72,6 +73,25 @@ func timedReceive(channel interface{}, timeout time.Duration) (interface{}, erro
 	}
 }
 
+// contextReceive is like timedReceive but waits until ctx is done.
+//
+// Returns ctx.Err() if ctx is done first, Closed on channel close.
+func contextReceive(ctx context.Context, channel interface{}) (interface{}, error) {
+	cases := []reflect.SelectCase{
+		reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(channel)},
+		reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+	}
+	chosen, value, ok := reflect.Select(cases)
+	switch {
+	case chosen == 0 && ok:
+		return value.Interface(), nil
+	case chosen == 0 && !ok:
+		return nil, Closed
+	default:
+		return nil, ctx.Err()
+	}
+}
+
 // After is like time.After but returns a nil channel if timeout == Forever
 // since selecting on a nil channel will never return.
 func After(timeout time.Duration) <-chan time.Time {
@@ -0,0 +1,192 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package electron
+
+import (
+	"fmt"
+	"qpid.apache.org/amqp"
+	"qpid.apache.org/proton"
+	"sync/atomic"
+)
+
+// Descriptors of the AMQP transaction types.
+const (
+	declareCode            uint64 = 0x31
+	dischargeCode          uint64 = 0x32
+	declaredCode           uint64 = 0x33
+	transactionalStateCode uint64 = 0x34
+
+	errorCode uint64 = 0x1d
+)
+
+// localTransactions is the coordinator capability for local transactions.
+const localTransactions = amqp.Symbol("amqp:local-transactions")
+
+// Txn is a transaction declared with a remote transaction coordinator, see
+// Session.Transaction().
+//
+// Messages sent with Txn.Send() only take effect when the transaction is
+// committed, and are discarded if it is rolled back.
+type Txn interface {
+	// Id is the transaction identifier assigned by the coordinator.
+	Id() amqp.Binary
+
+	// Send sends m on s as part of the transaction and blocks until the
+	// message is acknowledged, like Sender.SendSync(). s must belong to the
+	// same connection as the transaction.
+	Send(s Sender, m amqp.Message) Outcome
+
+	// Commit discharges the transaction so that its work takes effect.
+	// If the coordinator rejects the commit, returns the rejection condition.
+	Commit() error
+
+	// Rollback discharges the transaction so that its work is discarded.
+	Rollback() error
+}
+
+type txn struct {
+	id          amqp.Binary
+	coordinator *sender
+}
+
+func (s *session) Transaction() (Txn, error) {
+	var c *sender
+	err := s.engine().InjectWait(func() error {
+		if s.Error() != nil {
+			return s.Error()
+		}
+		if s.coordinator == nil || s.coordinator.Error() != nil {
+			l, err := makeLocalLink(s, true, func(l *linkSettings) { l.coordinator = true })
+			if err != nil {
+				return err
+			}
+			s.coordinator = newSender(l)
+		}
+		c = s.coordinator
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := c.SendSync(coordinatorMessage(declareCode, amqp.List{}))
+	if out.Status != Accepted {
+		return nil, txnError("declare", out)
+	}
+	return &txn{id: out.Value.(amqp.Binary), coordinator: c}, nil
+}
+
+func (t *txn) Id() amqp.Binary { return t.id }
+
+func (t *txn) Send(s Sender, m amqp.Message) Outcome {
+	snd, ok := s.(*sender)
+	if !ok || snd.session.connection != t.coordinator.session.connection {
+		return Outcome{Unsent, fmt.Errorf("transaction %x: sender is not on the transaction's connection", []byte(t.id)), nil}
+	}
+	ack := make(chan Outcome, 1)
+	if snd.queue != nil {
+		snd.enqueue(m, ack, nil, Forever, t.id)
+	} else {
+		atomic.AddInt32(&snd.waiting, 1)
+		_, err := timedReceive(snd.credit, Forever) // wait for credit
+		snd.sendAsync(m, ack, nil, t.id, err)
+	}
+	return <-ack
+}
+
+func (t *txn) Commit() error { return t.discharge(false) }
+
+func (t *txn) Rollback() error { return t.discharge(true) }
+
+func (t *txn) discharge(fail bool) error {
+	out := t.coordinator.SendSync(coordinatorMessage(dischargeCode, amqp.List{t.id, fail}))
+	if out.Status != Accepted {
+		if fail {
+			return txnError("rollback", out)
+		}
+		return txnError("commit", out)
+	}
+	return nil
+}
+
+// coordinatorMessage makes a message with a described control body for the coordinator.
+func coordinatorMessage(code uint64, fields amqp.List) amqp.Message {
+	m := amqp.NewMessage()
+	m.Marshal(amqp.Described{Descriptor: code, Value: fields})
+	return m
+}
+
+// txnError returns the error for an unsuccessful coordinator outcome.
+func txnError(op string, out Outcome) error {
+	if out.Error != nil {
+		return out.Error
+	}
+	return fmt.Errorf("transaction %s %s", op, out.Status)
+}
+
+// setTransactionalState marks an outgoing delivery as part of transaction id.
+// Handler goroutine.
+func setTransactionalState(d proton.Delivery, id amqp.Binary) {
+	_ = d.Local().Data().Marshal(amqp.List{id})
+	d.Update(transactionalStateCode)
+}
+
+// declaredOutcome is Accepted with the new transaction id as the Value.
+func declaredOutcome(d proton.Disposition, v interface{}) Outcome {
+	var fields amqp.List
+	if err := d.Data().Unmarshal(&fields); err == nil && len(fields) > 0 {
+		if id, ok := fields[0].(amqp.Binary); ok {
+			return Outcome{Accepted, nil, id}
+		}
+	}
+	return Outcome{Unknown, fmt.Errorf("invalid declared state: %v", d.Data()), v}
+}
+
+// transactionalOutcome is the outcome carried in a transactional-state.
+func transactionalOutcome(d proton.Disposition, v interface{}) Outcome {
+	var fields amqp.List
+	if err := d.Data().Unmarshal(&fields); err == nil && len(fields) > 1 {
+		if outcome, ok := fields[1].(amqp.Described); ok {
+			if code, ok := outcome.Descriptor.(uint64); ok {
+				return Outcome{sentStatus(code), describedError(outcome.Value), v}
+			}
+		}
+	}
+	return Outcome{Unknown, nil, v}
+}
+
+// describedError returns the error condition from the fields of a rejected
+// outcome, or nil if there is none.
+func describedError(v interface{}) error {
+	if fields, ok := v.(amqp.List); ok && len(fields) > 0 {
+		if d, ok := fields[0].(amqp.Described); ok && d.Descriptor == errorCode {
+			if cond, ok := d.Value.(amqp.List); ok && len(cond) > 0 {
+				var e amqp.Error
+				if name, ok := cond[0].(amqp.Symbol); ok {
+					e.Name = string(name)
+				}
+				if len(cond) > 1 {
+					e.Description, _ = cond[1].(string)
+				}
+				return e
+			}
+		}
+	}
+	return nil
+}
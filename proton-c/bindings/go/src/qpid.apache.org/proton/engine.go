@@ -20,11 +20,13 @@ under the License.
 package proton
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 	"unsafe"
 )
@@ -101,6 +103,7 @@ type Injecter interface {
 type Engine struct {
 	// Error is set on exit from Run() if there was an error.
 	err    ErrorHolder
+	ioErr  ErrorHolder
 	inject chan func()
 
 	conn       net.Conn
@@ -112,6 +115,7 @@ type Engine struct {
 	closeOnce  sync.Once
 	timer      *time.Timer
 	traceEvent bool
+	dispatched chan struct{} // Closed after events are dispatched, see nextDispatch()
 }
 
 const bufferSize = 4096
@@ -127,6 +131,32 @@ func NewEngine(conn net.Conn, handlers ...EventHandler) (*Engine, error) {
 	return eng, eng.Initialize(conn, handlers...)
 }
 
+// Pipe returns running client and server engines connected in memory by a
+// net.Pipe, with no network. It is intended for testing handlers: open
+// endpoints and send messages with Inject() or InjectWait() on the client, and
+// check what the server's handler receives.
+//
+// Each engine runs in its own goroutine, as for Run(). Use InjectWait() to wait
+// for work in an engine's goroutine to complete. Disconnect() both engines when
+// done.
+func Pipe(client, server EventHandler) (*Engine, *Engine, error) {
+	cConn, sConn := net.Pipe()
+	cEng, err := NewEngine(cConn, client)
+	if err == nil {
+		var sEng *Engine
+		if sEng, err = NewEngine(sConn, server); err == nil {
+			sEng.Server()
+			go cEng.Run()
+			go sEng.Run()
+			return cEng, sEng, nil
+		}
+		cEng.free() // Not running
+	}
+	cConn.Close()
+	sConn.Close()
+	return nil, nil, err
+}
+
 // Initialize an Engine with a connection and handlers. Start it with Run()
 func (eng *Engine) Initialize(conn net.Conn, handlers ...EventHandler) error {
 	eng.inject = make(chan func())
@@ -178,6 +208,28 @@ func (eng *Engine) Error() error {
 	return eng.err.Get()
 }
 
+// IOError returns the first error from reading, writing or closing the engine's
+// net.Conn while the engine was running, or nil if there was none.
+//
+// Transport().Condition() only keeps a name and description. For a proton
+// protocol failure the name is an AMQP condition such as amqp.ConnectionFramingError and
+// IOError() is nil. For an I/O failure the name is the Go type name of the error
+// and IOError() is the original error value, for example an io.EOF, a
+// *net.OpError or a crypto/tls error. Use Errno() to get the system error number.
+func (eng *Engine) IOError() error {
+	return eng.ioErr.Get()
+}
+
+// Errno returns the system error number underlying IOError(), or 0 if there is
+// none.
+func (eng *Engine) Errno() syscall.Errno {
+	var errno syscall.Errno
+	if errors.As(eng.IOError(), &errno) {
+		return errno
+	}
+	return 0
+}
+
 // Inject a function into the Engine's event loop.
 //
 // f() will be called in the same event-processing goroutine that calls Handler
@@ -224,8 +276,11 @@ func (eng *Engine) Server() { eng.Transport().SetServer() }
 
 func (eng *Engine) disconnect(err error) {
 	cond := eng.Transport().Condition()
-	cond.SetError(err)              // Set the provided error.
-	cond.SetError(eng.conn.Close()) // Use connection error if cond is not already set.
+	cond.SetError(err) // Set the provided error.
+	if cerr := eng.conn.Close(); cerr != nil {
+		eng.ioErr.Set(cerr)
+		cond.SetError(cerr) // Use connection error if cond is not already set.
+	}
 	eng.transport.CloseTail()
 	eng.transport.CloseHead()
 }
@@ -270,6 +325,9 @@ func (eng *Engine) dispatch() bool {
 		if eng.traceEvent {
 			eng.transport.Log(e.String())
 		}
+		if d := e.Delivery(); e.Type() == EDelivery && d.Link().IsReceiver() {
+			d.track()
+		}
 		for _, h := range eng.handlers {
 			h.HandleEvent(e)
 		}
@@ -277,10 +335,23 @@ func (eng *Engine) dispatch() bool {
 			eng.tick() // Update the tick if changed by remote.
 		}
 		C.pn_collector_pop(eng.collector)
+		if eng.dispatched != nil {
+			close(eng.dispatched)
+			eng.dispatched = nil
+		}
 	}
 	return !eng.transport.Closed() || C.pn_collector_peek(eng.collector) != nil
 }
 
+// nextDispatch returns a channel that is closed after the next event is dispatched.
+// Must be called in the engine goroutine.
+func (eng *Engine) nextDispatch() <-chan struct{} {
+	if eng.dispatched == nil {
+		eng.dispatched = make(chan struct{})
+	}
+	return eng.dispatched
+}
+
 func (eng *Engine) writeBuffer() []byte {
 	size := eng.Transport().Pending() // Evaluate before Head(), may change buffer.
 	start := eng.Transport().Head()
@@ -295,6 +366,7 @@ func (eng *Engine) readBuffer() []byte {
 
 func (eng *Engine) free() {
 	if !eng.transport.IsNil() {
+		eng.transport.SetTracer(nil)
 		eng.transport.Unbind()
 		eng.transport.Free()
 		eng.transport = Transport{}
@@ -338,6 +410,7 @@ func (eng *Engine) Run() error {
 				readsOut <- rbuf[:n]
 			} else if err != nil {
 				_ = eng.Inject(func() {
+					eng.ioErr.Set(err)
 					eng.Transport().Condition().SetError(err)
 					eng.Transport().CloseTail()
 				})
@@ -358,6 +431,7 @@ func (eng *Engine) Run() error {
 				writesOut <- wbuf[:n]
 			} else if err != nil {
 				_ = eng.Inject(func() {
+					eng.ioErr.Set(err)
 					eng.Transport().Condition().SetError(err)
 					eng.Transport().CloseHead()
 				})
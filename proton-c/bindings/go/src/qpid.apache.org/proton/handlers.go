@@ -19,7 +19,10 @@ under the License.
 
 package proton
 
-import "fmt"
+import (
+	"fmt"
+	"qpid.apache.org/amqp"
+)
 
 // EventHandler handles core proton events.
 type EventHandler interface {
@@ -32,13 +35,20 @@ type EventHandler interface {
 // MessagingHandler provides an alternative interface to EventHandler.
 // it is easier to use for most applications that send and receive messages.
 //
-// Implement this interface and then wrap your value with a MessagingHandlerDelegator.
-// MessagingHandlerDelegator implements EventHandler and can be registered with a Engine.
+// Implement this interface and then wrap your value with NewMessagingAdapter().
+// MessagingAdapter implements EventHandler and can be registered with an Engine
+// by passing it to NewEngine().
+//
+// There is one method for all events rather than a method per event, so a
+// handler only needs to handle the events it is interested in. The Event gives
+// access to the relevant proton objects, for example e.Delivery() for MMessage
+// and MSettled, e.Link() for MLinkOpening or e.Transport() for
+// MDisconnected.
 //
 type MessagingHandler interface {
 	// HandleMessagingEvent is called with  MessagingEvent.
-	// Typically HandleEvent() is implemented as a switch on e.Type()
-	// Returning an error will stop the Engine.
+	// Typically HandleMessagingEvent() is implemented as a switch on the
+	// MessagingEvent.
 	HandleMessagingEvent(MessagingEvent, Event)
 }
 
@@ -115,6 +125,15 @@ const (
 	MMessage
 	// A network connection was disconnected.
 	MDisconnected
+	// A receiver link drained with Link.Drain() has finished draining: the
+	// sender has sent what it could and given up the rest of the credit.
+	// It is raised once for each call to Link.Drain().
+	MDrained
+	// The peer updates the state of an outgoing delivery. It is raised for
+	// every update, including the non-terminal Received state, see
+	// Delivery.RemoteReceived(), before MAccepted, MRejected, MReleased or
+	// MSettled for the same update.
+	MDisposition
 )
 
 func (t MessagingEvent) String() string {
@@ -165,6 +184,10 @@ func (t MessagingEvent) String() string {
 		return "Settled"
 	case MMessage:
 		return "Message"
+	case MDrained:
+		return "Drained"
+	case MDisposition:
+		return "Disposition"
 	default:
 		return "Unknown"
 	}
@@ -237,8 +260,10 @@ func (d flowcontroller) HandleEvent(e Event) {
 	case ELinkLocalOpen, ELinkRemoteOpen, ELinkFlow, EDelivery:
 		if link.IsReceiver() {
 			d.drained += link.Drained()
-			if d.drained != 0 {
-				link.Flow(d.window - link.Credit())
+			// Top the credit up to the window, there is nothing to do if the
+			// link already has at least window credit.
+			if n := d.window - link.Credit(); d.drained != 0 && n > 0 {
+				_ = link.Flow(n)
 			}
 		}
 	}
@@ -342,6 +367,8 @@ func (d *MessagingAdapter) HandleEvent(e Event) {
 	case ELinkFlow:
 		if e.Link().IsSender() && e.Link().Credit() > 0 {
 			d.mhandler.HandleMessagingEvent(MSendable, e)
+		} else if e.Link().IsReceiver() && e.Link().drainDone() {
+			d.mhandler.HandleMessagingEvent(MDrained, e)
 		}
 
 	case EDelivery:
@@ -358,6 +385,13 @@ func (d *MessagingAdapter) HandleEvent(e Event) {
 
 func (d *MessagingAdapter) incoming(e Event) {
 	delivery := e.Delivery()
+	// Close the link if a message is larger than the maximum we advertised.
+	// Pending() is the data not yet read, that is the whole message unless
+	// the handler reads it with Delivery.MessageReader().
+	if max := e.Link().MaxMessageSize(); max > 0 && uint64(delivery.Pending()) > max {
+		CloseError(e.Link(), amqp.Errorf(amqp.LinkMessageSizeExceeded, "message size exceeds maximum %v", max))
+		return
+	}
 	if delivery.HasMessage() {
 		d.mhandler.HandleMessagingEvent(MMessage, e)
 		if d.AutoAccept && !delivery.Settled() {
@@ -375,6 +409,7 @@ func (d *MessagingAdapter) incoming(e Event) {
 func (d *MessagingAdapter) outgoing(e Event) {
 	delivery := e.Delivery()
 	if delivery.Updated() {
+		d.mhandler.HandleMessagingEvent(MDisposition, e)
 		switch delivery.Remote().Type() {
 		case Accepted:
 			d.mhandler.HandleMessagingEvent(MAccepted, e)
@@ -387,7 +422,7 @@ func (d *MessagingAdapter) outgoing(e Event) {
 			// The delivery was settled remotely, inform the local end.
 			d.mhandler.HandleMessagingEvent(MSettled, e)
 		}
-		if d.AutoSettle {
+		if d.AutoSettle && delivery.Remote().Type() != Received { // Received is not an outcome
 			delivery.Settle() // Local settle, don't mhandler MSettled till the remote end settles.
 		}
 	}
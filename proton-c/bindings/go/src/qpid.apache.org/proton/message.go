@@ -22,13 +22,39 @@ package proton
 // #include <proton/types.h>
 // #include <proton/message.h>
 // #include <proton/codec.h>
+// #include <proton/link.h>
+// #include <proton/delivery.h>
+// #include <proton/object.h>
+//
+// PN_HANDLE(GO_TAG_COUNTER)
+// PN_HANDLE(GO_DELIVERY_STATE)
+//
+// /* Increment and return the tag counter stored in the link attachments. */
+// static uint64_t go_link_next_tag(pn_link_t *l) {
+//   pn_record_t *r = pn_link_attachments(l);
+//   if (!pn_record_has(r, GO_TAG_COUNTER)) pn_record_def(r, GO_TAG_COUNTER, PN_VOID);
+//   uintptr_t n = (uintptr_t)pn_record_get(r, GO_TAG_COUNTER) + 1;
+//   pn_record_set(r, GO_TAG_COUNTER, (void*)n);
+//   return n;
+// }
+//
+// /* Get and set the incoming delivery state stored in the delivery attachments. */
+// static uintptr_t go_delivery_state(pn_delivery_t *d) {
+//   return (uintptr_t)pn_record_get(pn_delivery_attachments(d), GO_DELIVERY_STATE);
+// }
+// static void go_delivery_set_state(pn_delivery_t *d, uintptr_t state) {
+//   pn_record_t *r = pn_delivery_attachments(d);
+//   if (!pn_record_has(r, GO_DELIVERY_STATE)) pn_record_def(r, GO_DELIVERY_STATE, PN_VOID);
+//   pn_record_set(r, GO_DELIVERY_STATE, (void*)state);
+// }
 import "C"
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io"
 	"qpid.apache.org/amqp"
 	"strconv"
-	"sync/atomic"
 )
 
 // HasMessage is true if all message data is available.
@@ -41,28 +67,225 @@ func (d Delivery) HasMessage() bool { return !d.IsNil() && d.Readable() && !d.Pa
 // handling an MMessage event is always a safe context to call this function.
 //
 // Will return an error if message is incomplete or not current.
+//
+// The message is decoded into memory that belongs to the message, it does not
+// refer to the delivery, the engine or a buffer passed to MessageInto(). It can
+// be handed to another goroutine and used after the delivery is settled.
 func (delivery Delivery) Message() (m amqp.Message, err error) {
+	m, _, err = delivery.MessageInto(nil)
+	return
+}
+
+// MessageInto is like Message but receives the message data into buffer,
+// allocating a new buffer if it is too small. It returns the buffer so it can
+// be re-used for the next delivery.
+func (delivery Delivery) MessageInto(buffer []byte) (amqp.Message, []byte, error) {
+	m := amqp.NewMessage()
+	buffer, err := delivery.decodeInto(m, buffer)
+	return m, buffer, err
+}
+
+// MessageReuse is like Message but decodes into m instead of allocating a new
+// message, so one message can be re-used for many deliveries. The previous
+// contents of m are cleared.
+func (delivery Delivery) MessageReuse(m amqp.Message) error {
+	_, err := delivery.decodeInto(m, nil)
+	return err
+}
+
+// RawBytes receives the encoded message data of the delivery into buffer
+// without decoding it, allocating a new buffer if it is too small. It returns
+// the encoded data, which is a slice of the buffer, so the buffer can be
+// re-used for the next delivery.
+//
+// The data is copied once from the proton-C engine, which owns the bytes
+// received from the network. Use amqp.BodyBytes() to get the body of a message
+// with a data section body without copying it again. The returned slice, and
+// any slice of it, is only valid until buffer is re-used. To forward the
+// message with its body bytes unchanged, pass the data to amqp.NewMessageBytes()
+// and send the result with Link.Send().
+//
+// The same conditions as Message() apply.
+func (delivery Delivery) RawBytes(buffer []byte) ([]byte, error) {
+	if delivery.Aborted() {
+		return nil, amqp.ErrAborted
+	}
 	if !delivery.Readable() {
 		return nil, fmt.Errorf("delivery is not readable")
 	}
 	if delivery.Partial() {
 		return nil, fmt.Errorf("delivery has partial message")
 	}
-	data := make([]byte, delivery.Pending())
+	size := int(delivery.Pending())
+	if cap(buffer) < size {
+		buffer = make([]byte, size)
+	}
+	data := buffer[:size]
 	result := delivery.Link().Recv(data)
 	if result != len(data) {
 		return nil, fmt.Errorf("cannot receive message: %s", PnErrorCode(result))
 	}
-	m = amqp.NewMessage()
-	err = m.Decode(data)
+	return data, nil
+}
+
+// DecodeBody receives the message of the delivery and unmarshals its body
+// into the value pointed to by v, for example a pointer to a struct, see
+// amqp.UnmarshalBody(). Use it when only the body is needed: the other
+// sections are not decoded and no amqp.Message is created.
+//
+// The same conditions as Message() apply.
+func (delivery Delivery) DecodeBody(v interface{}) error {
+	data, err := delivery.RawBytes(nil)
+	if err != nil {
+		return err
+	}
+	return amqp.UnmarshalBody(data, v)
+}
+
+func (delivery Delivery) decodeInto(m amqp.Message, buffer []byte) ([]byte, error) {
+	data, err := delivery.RawBytes(buffer)
+	if err != nil {
+		return buffer, err
+	}
+	return data[:cap(data)], m.Decode(data)
+}
+
+// deliveryStreaming is the state of an incoming delivery that was seen
+// unsettled and incomplete, recorded by the engine as events arrive.
+const deliveryStreaming = 1
+
+// track records the state of an incoming delivery for Aborted().
+// Called by the engine for each delivery event.
+func (delivery Delivery) track() {
+	if !delivery.Settled() && delivery.Partial() {
+		C.go_delivery_set_state(delivery.pn, C.uintptr_t(deliveryStreaming))
+	}
+}
+
+// Aborted is true if an incoming delivery was aborted by the sender before it
+// was complete. Message() returns amqp.ErrAborted for an aborted delivery, the
+// data received so far should be discarded.
+//
+// The proton-C engine has no transfer aborted flag. It reports that the sender
+// settled a delivery only from the first transfer or from a disposition, so a
+// delivery is aborted if it was seen unsettled and incomplete and is now settled
+// while still Partial(): no more data will arrive for it. A delivery that the
+// sender settles on its final transfer is complete, not aborted.
+func (delivery Delivery) Aborted() bool {
+	return delivery.Settled() && delivery.Partial() && C.go_delivery_state(delivery.pn) == deliveryStreaming
+}
+
+// Abort abandons an outgoing delivery that is not complete, for example because
+// the source of a streamed message fails part way through. The delivery must be
+// the current delivery of its sending link, it is not possible to abort a
+// delivery after Link.Advance().
+//
+// The delivery is settled. The engine can't send an aborted transfer, settling
+// completes the delivery with a final settled transfer, so a proton-C receiver
+// gets the truncated data as a complete delivery and fails to decode it.
+func (delivery Delivery) Abort() error {
+	if !delivery.Link().IsSender() {
+		return fmt.Errorf("cannot abort incoming delivery")
+	}
+	if !delivery.Current() {
+		return fmt.Errorf("cannot abort complete delivery")
+	}
+	delivery.Settle()
+	return nil
+}
+
+// DeliveryReader reads the encoded message data of a delivery as it arrives,
+// so a large message can be processed without holding it all in memory.
+//
+// Unlike most values in this package, the DeliveryReader methods must be called
+// in a goroutine other than the engine goroutine, they inject functions into the
+// engine to receive data and will block if the engine goroutine is blocked.
+type DeliveryReader struct {
+	delivery Delivery
+	eng      *Engine
+	received uint
+	pending  uint
+	err      error
+}
+
+// MessageReader returns a DeliveryReader to read the encoded message data of
+// the delivery as it arrives. The delivery must be the current delivery of its
+// link. Use amqp.Message.Decode() to decode the complete data.
+//
+// The reader advances the link when all the data has been read. Don't also
+// handle the delivery with Message() or a MessagingHandler MMessage event.
+//
+// Must be called in the engine goroutine, the returned reader must not be used
+// in the engine goroutine.
+func (delivery Delivery) MessageReader(eng *Engine) *DeliveryReader {
+	return &DeliveryReader{delivery: delivery, eng: eng, pending: delivery.Pending()}
+}
+
+// Read reads message data, blocking until some data is available.
+// Returns io.EOF when the complete message has been read, amqp.ErrAborted if the
+// delivery is Aborted() or an error if the engine is closed.
+func (r *DeliveryReader) Read(p []byte) (n int, err error) {
+	if r.err != nil || len(p) == 0 {
+		return 0, r.err
+	}
+	for n == 0 && err == nil {
+		var wait <-chan struct{}
+		injected := false
+		err = r.eng.InjectWait(func() error {
+			injected = true
+			d := r.delivery
+			if !d.Current() {
+				return fmt.Errorf("delivery is not current")
+			}
+			result := d.Link().Recv(p)
+			switch {
+			case result > 0:
+				n = result
+				r.received += uint(n)
+			case result == int(C.PN_EOS):
+				d.Link().Advance()
+				return io.EOF
+			case result < 0:
+				return fmt.Errorf("cannot receive message: %s", PnErrorCode(result))
+			case d.Aborted():
+				return amqp.ErrAborted
+			default: // Wait for more data
+				wait = r.eng.nextDispatch()
+			}
+			r.pending = d.Pending()
+			return nil
+		})
+		if err == nil && !injected {
+			err = fmt.Errorf("engine closed")
+		}
+		if wait != nil {
+			select {
+			case <-wait:
+			case <-r.eng.running:
+			}
+		}
+	}
+	r.err = err
 	return
 }
 
-// Process-wide atomic counter for generating tag names
-var tagCounter uint64
+// Received returns the number of bytes read so far.
+func (r *DeliveryReader) Received() uint { return r.received }
+
+// Pending returns the number of bytes that had arrived but were not yet read
+// at the time of the last call to Read.
+func (r *DeliveryReader) Pending() uint { return r.pending }
+
+// NextTag returns a new delivery tag for the link. Tags are generated from a
+// counter that belongs to the link, so they are unique among the deliveries
+// of the link but tags on different links may be the same.
+//
+// Use NextTag to get a tag in advance, for example to correlate it with
+// application state, before sending a message with the tag.
+func (link Link) NextTag() []byte { return []byte(link.nextTag()) }
 
-func nextTag() string {
-	return strconv.FormatUint(atomic.AddUint64(&tagCounter, 1), 32)
+func (link Link) nextTag() string {
+	return strconv.FormatUint(uint64(C.go_link_next_tag(link.pn)), 32)
 }
 
 // Send sends a amqp.Message over a Link.
@@ -71,12 +294,201 @@ func (link Link) Send(m amqp.Message) (Delivery, error) {
 	if !link.IsSender() {
 		return Delivery{}, fmt.Errorf("attempt to send message on receiving link")
 	}
+	delivery, _, err := link.send(m, link.nextTag(), nil)
+	return delivery, err
+}
 
-	delivery := link.Delivery(nextTag())
-	bytes, err := m.Encode(nil)
+// SendPresettled sends a amqp.Message over a Link like Send, but settles the
+// delivery before it is transferred, regardless of the negotiated
+// RemoteSndSettleMode(). This is "at most once" delivery: the peer does not
+// send a disposition and the outcome of the message is never known.
+//
+// The returned Delivery is settled locally, so it is no longer counted by
+// Link.Unsettled() and will be freed by the engine, it should not be used
+// after the current event or injected function returns.
+func (link Link) SendPresettled(m amqp.Message) (Delivery, error) {
+	if !link.IsSender() {
+		return Delivery{}, fmt.Errorf("attempt to send message on receiving link")
+	}
+	delivery, _, err := link.send(m, link.nextTag(), nil)
+	if err == nil && link.RemoteSndSettleMode() != SndSettled { // send() settled already
+		delivery.Settle()
+	}
+	return delivery, err
+}
+
+// SendWithEncoder sends a amqp.Message over a Link like Send, but encodes it
+// using enc so the encoding buffer is re-used between messages.
+func (link Link) SendWithEncoder(m amqp.Message, enc *amqp.MessageEncoder) (Delivery, error) {
+	if !link.IsSender() {
+		return Delivery{}, fmt.Errorf("attempt to send message on receiving link")
+	}
+	bytes, err := enc.Encode(m)
 	if err != nil {
 		return Delivery{}, fmt.Errorf("cannot send mesage %s", err)
 	}
+	return link.sendBytes(bytes, link.nextTag())
+}
+
+// MaxTagSize is the maximum size of a delivery tag allowed by AMQP.
+const MaxTagSize = 32
+
+// SendWithTag sends a amqp.Message over a Link like Send, but uses tag as the
+// delivery tag rather than generating one. The tag must not be empty or longer
+// than MaxTagSize, and should not be the same as the tag of any other unsettled
+// delivery on the link.
+func (link Link) SendWithTag(m amqp.Message, tag []byte) (Delivery, error) {
+	if !link.IsSender() {
+		return Delivery{}, fmt.Errorf("attempt to send message on receiving link")
+	}
+	if len(tag) == 0 || len(tag) > MaxTagSize {
+		return Delivery{}, fmt.Errorf("invalid delivery tag size %v, must be 1 to %v bytes", len(tag), MaxTagSize)
+	}
+	delivery, _, err := link.send(m, string(tag), nil)
+	return delivery, err
+}
+
+// SendBatch sends a slice of amqp.Message over a Link, re-using a single
+// encoding buffer for the whole batch.
+//
+// Returns a Delivery for each message that was sent. If sending a message
+// fails, SendBatch stops and returns the deliveries sent so far with the
+// error, so len(deliveries) is always the number of messages sent. A delivery
+// that failed part way through sending is settled by SendBatch, so the
+// receiver discards it.
+func (link Link) SendBatch(msgs []amqp.Message) ([]Delivery, error) {
+	if !link.IsSender() {
+		return nil, fmt.Errorf("attempt to send message on receiving link")
+	}
+	deliveries := make([]Delivery, 0, len(msgs))
+	var buffer []byte
+	for _, m := range msgs {
+		delivery, bytes, err := link.send(m, link.nextTag(), buffer)
+		if err != nil {
+			if !delivery.IsNil() { // Don't leave a partly sent delivery behind.
+				delivery.Settle()
+			}
+			return deliveries, err
+		}
+		deliveries = append(deliveries, delivery)
+		buffer = bytes[:cap(bytes)] // SendBytes copies, so the buffer can be re-used.
+	}
+	return deliveries, nil
+}
+
+// streamChunkSize is the largest body chunk sent by SendReader.
+const streamChunkSize = 1 << 16
+
+// SendReader sends a message with the sections of m and a body streamed from
+// body, so a large body such as an HTTP upload can be sent without holding it
+// all in memory. m must not have a body or footer. The body is sent as a
+// sequence of AMQP data sections, one for each chunk read from body, each
+// chunk no larger than the remote maximum frame size. amqp.Message.Decode()
+// joins the sections into a single Binary body.
+//
+// The delivery is complete and the link is advanced when body returns io.EOF.
+// If body returns any other error, or the message becomes larger than the
+// RemoteMaxMessageSize() of the link, the delivery is aborted, see
+// Delivery.Abort(), and the error is returned.
+//
+// Like DeliveryReader, SendReader must be called in a goroutine other than the
+// engine goroutine, it reads body outside the engine and injects functions into
+// eng to send the data. No other message can be sent on the link until
+// SendReader returns. Data that can't be sent yet, for example because the link
+// has no credit, is buffered by the engine.
+func (link Link) SendReader(eng *Engine, m amqp.Message, body io.Reader) (Delivery, error) {
+	if m.Body() != nil || len(m.Footer()) > 0 {
+		return Delivery{}, fmt.Errorf("cannot stream body of a message with a body or footer")
+	}
+	var delivery Delivery
+	var max, sent uint64 // sent is the size of the message so far.
+	chunk := streamChunkSize
+	err := eng.InjectWait(func() error {
+		if !link.IsSender() {
+			return fmt.Errorf("attempt to send message on receiving link")
+		}
+		bytes, err := m.Encode(nil)
+		if err != nil {
+			return fmt.Errorf("cannot send message %s", err)
+		}
+		if size := link.Session().Connection().Transport().RemoteMaxFrameSize(); size > 0 && size < streamChunkSize {
+			chunk = int(size)
+		}
+		max, sent = link.RemoteMaxMessageSize(), uint64(len(bytes))
+		delivery = link.Delivery(link.nextTag())
+		if result := link.SendBytes(bytes); result != len(bytes) {
+			delivery.Settle()
+			return fmt.Errorf("send failed %v", PnErrorCode(result))
+		}
+		return nil
+	})
+	if err != nil {
+		return delivery, err
+	}
+	// Each data section is a described binary with a 4 byte length:
+	// 0x00 0x53 0x75 0xb0 <length>
+	buffer := make([]byte, 8+chunk)
+	copy(buffer, []byte{0x00, 0x53, 0x75, 0xb0})
+	for err == nil {
+		n, rerr := body.Read(buffer[8:])
+		data := buffer[:8+n]
+		if n > 0 {
+			sent += uint64(len(data))
+		}
+		switch {
+		case rerr != nil && rerr != io.EOF:
+			err = rerr
+		case max > 0 && sent > max:
+			err = amqp.Errorf(amqp.LinkMessageSizeExceeded, "message size exceeds maximum %v", max)
+		}
+		ierr := eng.InjectWait(func() error {
+			if err != nil {
+				return delivery.Abort()
+			}
+			if n > 0 {
+				binary.BigEndian.PutUint32(data[4:], uint32(n))
+				if result := link.SendBytes(data); result != len(data) {
+					err = fmt.Errorf("send failed %v", PnErrorCode(result))
+					return delivery.Abort()
+				}
+			}
+			if rerr == io.EOF {
+				link.Advance()
+				if link.RemoteSndSettleMode() == SndSettled {
+					delivery.Settle()
+				}
+			}
+			return nil
+		})
+		if err == nil {
+			err = ierr
+		}
+		if rerr == io.EOF {
+			break
+		}
+	}
+	return delivery, err
+}
+
+// send encodes m using buffer if it is large enough and sends it as a new delivery
+// with the given tag. Returns the encoded bytes so the caller can re-use the buffer.
+func (link Link) send(m amqp.Message, tag string, buffer []byte) (Delivery, []byte, error) {
+	bytes, err := m.Encode(buffer)
+	if err != nil {
+		return Delivery{}, buffer, fmt.Errorf("cannot send mesage %s", err)
+	}
+	delivery, err := link.sendBytes(bytes, tag)
+	return delivery, bytes, err
+}
+
+// sendBytes sends encoded message bytes as a new delivery with the given tag.
+// Returns an error without sending if the message is larger than the
+// RemoteMaxMessageSize() of the link.
+func (link Link) sendBytes(bytes []byte, tag string) (Delivery, error) {
+	if max := link.RemoteMaxMessageSize(); max > 0 && uint64(len(bytes)) > max {
+		return Delivery{}, amqp.Errorf(amqp.LinkMessageSizeExceeded, "message size %v exceeds maximum %v", len(bytes), max)
+	}
+	delivery := link.Delivery(tag)
 	result := link.SendBytes(bytes)
 	link.Advance()
 	if result != len(bytes) {
@@ -20,10 +20,21 @@ under the License.
 package proton
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"os"
 	"path"
+	"qpid.apache.org/amqp"
+	"reflect"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -94,3 +105,1597 @@ func Test(t *testing.T) {
 	fatalIf(t, client.expect(events{EConnectionLocalOpen}))
 	fatalIf(t, server.expect(events{EConnectionRemoteOpen}))
 }
+
+// handlerFunc adapts a function to the EventHandler interface.
+type handlerFunc func(Event)
+
+func (f handlerFunc) HandleEvent(e Event) { f(e) }
+
+// newEnginePair returns running client and server engines connected by Pipe()
+func newEnginePair(t *testing.T, client, server EventHandler) (*Engine, *Engine) {
+	cEng, sEng, err := Pipe(client, server)
+	fatalIf(t, err)
+	return cEng, sEng
+}
+
+// receiveHandler opens remote endpoints, gives credit to receivers and sends
+// each message received on the messages channel. Deliveries are accepted.
+func receiveHandler(messages chan<- amqp.Message) EventHandler {
+	var buffer []byte // Re-used for all messages
+	return handlerFunc(func(e Event) {
+		if d := e.Delivery(); e.Type() == EDelivery && d.HasMessage() {
+			var m amqp.Message
+			var err error
+			m, buffer, err = d.MessageInto(buffer)
+			if err != nil {
+				m = nil
+			}
+			d.Accept()
+			messages <- m
+		} else {
+			openRemote(e)
+		}
+	})
+}
+
+// openRemote opens endpoints opened by the remote peer, and gives credit to receivers.
+func openRemote(e Event) {
+	switch e.Type() {
+	case EConnectionRemoteOpen:
+		e.Connection().Open()
+	case ESessionRemoteOpen:
+		e.Session().Open()
+	case ELinkRemoteOpen:
+		e.Link().Open()
+		if e.Link().IsReceiver() {
+			e.Link().Flow(100)
+		}
+	}
+}
+
+// openSender opens a connection, session and sending link on eng.
+func openSender(eng *Engine, name string) (l Link, err error) {
+	err = eng.InjectWait(func() error {
+		eng.Connection().Open()
+		s, err := eng.Connection().Session()
+		if err != nil {
+			return err
+		}
+		s.Open()
+		l = s.Sender(name)
+		l.Target().SetAddress(name)
+		l.Open()
+		return nil
+	})
+	return l, err
+}
+
+func expectMessages(messages <-chan amqp.Message, want ...interface{}) error {
+	for _, v := range want {
+		select {
+		case m := <-messages:
+			if m == nil {
+				return fmt.Errorf("bad message, want %v", v)
+			}
+			if got := m.Body(); got != v {
+				return fmt.Errorf("want %#v, got %#v", v, got)
+			}
+		case <-time.After(5 * time.Second):
+			return fmt.Errorf("timeout waiting for %#v", v)
+		}
+	}
+	return nil
+}
+
+func TestSendBatch(t *testing.T) {
+	messages := make(chan amqp.Message, 10)
+	client, server := newEnginePair(t, handlerFunc(func(Event) {}), receiveHandler(messages))
+	defer server.Disconnect(nil)
+	defer client.Disconnect(nil)
+	snd, err := openSender(client, "batch")
+	fatalIf(t, err)
+
+	var batch []amqp.Message
+	for _, s := range []string{"a", "bb", "a longer message body"} {
+		batch = append(batch, amqp.NewMessageWith(s))
+	}
+	var deliveries []Delivery
+	fatalIf(t, client.InjectWait(func() (err error) { deliveries, err = snd.SendBatch(batch); return }))
+	if len(deliveries) != len(batch) {
+		t.Errorf("want %v deliveries, got %v", len(batch), len(deliveries))
+	}
+	fatalIf(t, expectMessages(messages, "a", "bb", "a longer message body"))
+
+	// Sending stops at the first message that fails.
+	bad := amqp.NewMessageWith("bad")
+	bad.SetTTL(-time.Second)
+	batch = []amqp.Message{amqp.NewMessageWith("c"), bad, amqp.NewMessageWith("d")}
+	err = client.InjectWait(func() (err error) { deliveries, err = snd.SendBatch(batch); return })
+	if err == nil || len(deliveries) != 1 {
+		t.Errorf("want 1 delivery and an error, got %v %v", len(deliveries), err)
+	}
+	fatalIf(t, expectMessages(messages, "c"))
+	select {
+	case m := <-messages:
+		t.Errorf("unexpected message after failed send: %v", m)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Cannot send a batch on a receiving link
+	fatalIf(t, client.InjectWait(func() error {
+		r := snd.Session().Receiver("r")
+		if _, err := r.SendBatch(batch); err == nil {
+			return fmt.Errorf("expected error sending batch on receiver")
+		}
+		return nil
+	}))
+}
+
+func TestLinkTags(t *testing.T) {
+	messages := make(chan amqp.Message, 10)
+	client, server := newEnginePair(t, handlerFunc(func(Event) {}), receiveHandler(messages))
+	defer server.Disconnect(nil)
+	defer client.Disconnect(nil)
+	a, err := openSender(client, "a")
+	fatalIf(t, err)
+	b, err := openSender(client, "b")
+	fatalIf(t, err)
+	fatalIf(t, client.InjectWait(func() error {
+		// Each link has its own tag counter
+		if a, b := string(a.NextTag()), string(b.NextTag()); a != "1" || b != "1" {
+			return fmt.Errorf("want tags 1, 1 got %v, %v", a, b)
+		}
+		for _, l := range []Link{a, b} {
+			d, err := l.Send(amqp.NewMessageWith(l.Name()))
+			if err != nil {
+				return err
+			}
+			if tag := d.Tag().String(); tag != "2" {
+				return fmt.Errorf("%v: want tag 2, got %v", l, tag)
+			}
+		}
+		d, err := a.SendWithTag(amqp.NewMessageWith("c"), []byte("my-tag"))
+		if err != nil {
+			return err
+		}
+		if tag := d.Tag().String(); tag != "my-tag" {
+			return fmt.Errorf("want tag my-tag, got %v", tag)
+		}
+		for _, tag := range [][]byte{nil, make([]byte, MaxTagSize+1)} {
+			if _, err := a.SendWithTag(amqp.NewMessageWith("x"), tag); err == nil {
+				return fmt.Errorf("expected error for tag size %v", len(tag))
+			}
+		}
+		return nil
+	}))
+	// Messages on different links may arrive in any order.
+	got := map[interface{}]bool{}
+	for i := 0; i < 3; i++ {
+		got[(<-messages).Body()] = true
+	}
+	if want := map[interface{}]bool{"a": true, "b": true, "c": true}; !reflect.DeepEqual(want, got) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestMessageInto(t *testing.T) {
+	buffers := make(chan []byte, 10)
+	messages := make(chan amqp.Message, 10)
+	var buffer []byte
+	server := handlerFunc(func(e Event) {
+		if d := e.Delivery(); e.Type() == EDelivery && d.HasMessage() {
+			m, b, err := d.MessageInto(buffer)
+			if err != nil || m.Body() == nil {
+				b = nil
+			}
+			buffer = b
+			buffers <- b
+			messages <- m
+			d.Accept()
+		} else {
+			openRemote(e)
+		}
+	})
+	client, sEng := newEnginePair(t, handlerFunc(func(Event) {}), server)
+	defer sEng.Disconnect(nil)
+	defer client.Disconnect(nil)
+	snd, err := openSender(client, "into")
+	fatalIf(t, err)
+	fatalIf(t, client.InjectWait(func() (err error) {
+		_, err = snd.SendBatch([]amqp.Message{amqp.NewMessageWith("a longer message"), amqp.NewMessageWith("short")})
+		return
+	}))
+	first, second := <-buffers, <-buffers
+	switch {
+	case first == nil || second == nil:
+		t.Fatal("MessageInto failed")
+	case &first[:1][0] != &second[:1][0]:
+		t.Error("buffer was not re-used")
+	}
+	// Messages don't refer to the re-used buffer.
+	if err := expectMessages(messages, "a longer message", "short"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMessageReuse(t *testing.T) {
+	bodies := make(chan interface{}, 10)
+	m := amqp.NewMessage()
+	server := handlerFunc(func(e Event) {
+		if d := e.Delivery(); e.Type() == EDelivery && d.HasMessage() {
+			if err := d.MessageReuse(m); err != nil {
+				bodies <- err
+			} else {
+				bodies <- m.Body()
+			}
+			d.Accept()
+		} else {
+			openRemote(e)
+		}
+	})
+	client, sEng := newEnginePair(t, handlerFunc(func(Event) {}), server)
+	defer sEng.Disconnect(nil)
+	defer client.Disconnect(nil)
+	snd, err := openSender(client, "reuse")
+	fatalIf(t, err)
+	first := amqp.NewMessageWith("first")
+	first.SetSubject("subject")
+	fatalIf(t, client.InjectWait(func() (err error) {
+		_, err = snd.SendBatch([]amqp.Message{first, amqp.NewMessageWith("second")})
+		return
+	}))
+	for _, want := range []string{"first", "second"} {
+		if got := <-bodies; got != want {
+			t.Errorf("want %v, got %v", want, got)
+		}
+	}
+	if m.Subject() != "" { // Cleared by the second message
+		t.Errorf("message not cleared, subject %q", m.Subject())
+	}
+}
+
+func TestRawBytes(t *testing.T) {
+	bodies := make(chan interface{}, 10)
+	var buffer []byte
+	server := handlerFunc(func(e Event) {
+		if d := e.Delivery(); e.Type() == EDelivery && d.HasMessage() {
+			data, err := d.RawBytes(buffer)
+			if err == nil {
+				buffer = data
+				data, err = amqp.BodyBytes(data)
+			}
+			if err != nil {
+				bodies <- err
+			} else {
+				bodies <- string(data)
+			}
+			d.Accept()
+		} else {
+			openRemote(e)
+		}
+	})
+	client, sEng := newEnginePair(t, handlerFunc(func(Event) {}), server)
+	defer sEng.Disconnect(nil)
+	defer client.Disconnect(nil)
+	snd, err := openSender(client, "raw")
+	fatalIf(t, err)
+	big := strings.Repeat("x", 1000)
+	fatalIf(t, client.InjectWait(func() (err error) {
+		var batch []amqp.Message
+		for _, s := range []string{"data", big} {
+			m := amqp.NewMessage()
+			m.SetData([]byte(s))
+			batch = append(batch, m)
+		}
+		_, err = snd.SendBatch(batch)
+		return
+	}))
+	for _, want := range []string{"data", big} {
+		if got := <-bodies; got != want {
+			t.Errorf("want %.10q, got %.10q", want, got)
+		}
+	}
+}
+
+// Forward raw message data with amqp.NewMessageBytes, changing an annotation.
+func TestForwardRawBytes(t *testing.T) {
+	raw := make(chan []byte, 1)
+	received := make(chan amqp.Message, 1)
+	server := handlerFunc(func(e Event) {
+		if d := e.Delivery(); e.Type() == EDelivery && d.HasMessage() {
+			if d.Link().Name() == "in" {
+				data, err := d.RawBytes(nil)
+				if err != nil {
+					t.Error(err)
+				}
+				raw <- data
+			} else {
+				m, err := d.Message()
+				if err != nil {
+					t.Error(err)
+				}
+				received <- m
+			}
+			d.Accept()
+		} else {
+			openRemote(e)
+		}
+	})
+	client, sEng := newEnginePair(t, handlerFunc(func(Event) {}), server)
+	defer sEng.Disconnect(nil)
+	defer client.Disconnect(nil)
+	in, err := openSender(client, "in")
+	fatalIf(t, err)
+	out, err := openSender(client, "out")
+	fatalIf(t, err)
+	hops := amqp.AnnotationKeySymbol("x-opt-hops")
+	fatalIf(t, client.InjectWait(func() error {
+		m := amqp.NewMessageWith("body")
+		m.SetMessageAnnotations(map[amqp.AnnotationKey]interface{}{hops: int32(1)})
+		_, err := in.Send(m)
+		return err
+	}))
+	m, err := amqp.NewMessageBytes(<-raw)
+	fatalIf(t, err)
+	n, _ := m.MessageAnnotations()[hops].(int32)
+	m.SetMessageAnnotations(map[amqp.AnnotationKey]interface{}{hops: n + 1})
+	fatalIf(t, client.InjectWait(func() error {
+		_, err := out.Send(m)
+		return err
+	}))
+	m = <-received
+	if got := m.MessageAnnotations()[hops]; got != int32(2) {
+		t.Errorf("want 2 hops, got %v", got)
+	}
+	if got := m.Body(); got != "body" {
+		t.Errorf("want %q, got %q", "body", got)
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	type request struct {
+		Op  string `amqp:"op"`
+		Arg int64  `amqp:"arg"`
+	}
+	type result struct {
+		body request
+		err  error
+	}
+	results := make(chan result, 10)
+	server := handlerFunc(func(e Event) {
+		if d := e.Delivery(); e.Type() == EDelivery && d.HasMessage() {
+			var r result
+			r.err = d.DecodeBody(&r.body)
+			results <- r
+			d.Accept()
+		} else {
+			openRemote(e)
+		}
+	})
+	client, sEng := newEnginePair(t, handlerFunc(func(Event) {}), server)
+	defer sEng.Disconnect(nil)
+	defer client.Disconnect(nil)
+	snd, err := openSender(client, "body")
+	fatalIf(t, err)
+	fatalIf(t, client.InjectWait(func() error {
+		for _, body := range []interface{}{request{"add", 2}, "not a request"} {
+			if _, err := snd.Send(amqp.NewMessageWith(body)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	if r := <-results; r.err != nil || r.body != (request{"add", 2}) {
+		t.Errorf("want %v, got %v, %v", request{"add", 2}, r.body, r.err)
+	}
+	if r := <-results; r.err == nil {
+		t.Errorf("expected error decoding a string body, got %v", r.body)
+	}
+}
+
+func TestMessageReader(t *testing.T) {
+	type result struct {
+		data []byte
+		err  error
+	}
+	results := make(chan result, 1)
+	partial := make(chan bool, 1)
+	readers := make(map[Delivery]*DeliveryReader)
+	server := handlerFunc(func(e Event) {
+		if d := e.Delivery(); e.Type() == EDelivery && readers[d] == nil {
+			partial <- d.Partial()
+			r := d.MessageReader(e.Injecter().(*Engine))
+			readers[d] = r
+			go func() {
+				data, err := ioutil.ReadAll(r)
+				results <- result{data, err}
+			}()
+		} else {
+			openRemote(e)
+		}
+	})
+	client, sEng := newEnginePair(t, handlerFunc(func(Event) {}), server)
+	defer sEng.Disconnect(nil)
+	defer client.Disconnect(nil)
+	snd, err := openSender(client, "reader")
+	fatalIf(t, err)
+	body := strings.Repeat("x", 10000)
+	data, err := amqp.NewMessageWith(body).Encode(nil)
+	fatalIf(t, err)
+	// Send the first part of the message, wait for the reader, send the rest.
+	fatalIf(t, client.InjectWait(func() error {
+		snd.Delivery("x")
+		snd.SendBytes(data[:len(data)/2])
+		return nil
+	}))
+	if !<-partial {
+		t.Error("expected partial delivery")
+	}
+	fatalIf(t, client.InjectWait(func() error {
+		snd.SendBytes(data[len(data)/2:])
+		snd.Advance()
+		return nil
+	}))
+	res := <-results
+	fatalIf(t, res.err)
+	m := amqp.NewMessage()
+	fatalIf(t, m.Decode(res.data))
+	if m.Body() != body {
+		t.Errorf("bad message body: %.20q...", m.Body())
+	}
+	var r *DeliveryReader
+	fatalIf(t, sEng.InjectWait(func() error {
+		for _, r = range readers {
+		}
+		return nil
+	}))
+	if r.Received() != uint(len(data)) || r.Pending() != 0 {
+		t.Errorf("want received %v pending 0, got %v %v", len(data), r.Received(), r.Pending())
+	}
+
+	// A delivery settled by the sender on its final transfer is complete.
+	fatalIf(t, client.InjectWait(func() error {
+		snd.Delivery("y")
+		snd.SendBytes(data[:len(data)/2])
+		return nil
+	}))
+	if !<-partial {
+		t.Error("expected partial delivery")
+	}
+	fatalIf(t, client.InjectWait(func() error {
+		d := snd.Current()
+		snd.SendBytes(data[len(data)/2:])
+		snd.Advance()
+		d.Settle()
+		return nil
+	}))
+	res = <-results
+	if res.err != nil || !bytes.Equal(res.data, data) {
+		t.Errorf("want %v bytes reading settled delivery, got %v bytes %v", len(data), len(res.data), res.err)
+	}
+}
+
+func TestAbort(t *testing.T) {
+	type result struct {
+		body    interface{}
+		aborted bool
+		err     error
+	}
+	results := make(chan result, 1)
+	partial := make(chan bool, 1)
+	server := handlerFunc(func(e Event) {
+		if d := e.Delivery(); e.Type() == EDelivery {
+			if d.Partial() {
+				partial <- true
+			} else if d.HasMessage() {
+				var res result
+				m, err := d.Message()
+				if err == nil {
+					res.body = m.Body()
+				}
+				res.aborted, res.err = d.Aborted(), err
+				d.Settle()
+				results <- res
+			}
+		} else {
+			openRemote(e)
+		}
+	})
+	client, sEng := newEnginePair(t, handlerFunc(func(Event) {}), server)
+	defer sEng.Disconnect(nil)
+	defer client.Disconnect(nil)
+	snd, err := openSender(client, "abort")
+	fatalIf(t, err)
+	data, err := amqp.NewMessageWith(strings.Repeat("x", 1000)).Encode(nil)
+	fatalIf(t, err)
+
+	// Send part of a message, wait for the receiver to see it, then abort.
+	var d Delivery
+	fatalIf(t, client.InjectWait(func() error {
+		d = snd.Delivery("x")
+		snd.SendBytes(data[:len(data)/2])
+		return nil
+	}))
+	<-partial
+	fatalIf(t, client.InjectWait(func() error { return d.Abort() }))
+	// The engine can't send an aborted transfer, the receiver gets truncated data.
+	if res := <-results; res.aborted || res.err == nil {
+		t.Errorf("want error decoding aborted delivery, got %v %v", res.aborted, res.err)
+	}
+
+	// A delivery settled by the sender on its final transfer is not aborted.
+	fatalIf(t, client.InjectWait(func() error {
+		d = snd.Delivery("y")
+		snd.SendBytes(data[:len(data)/2])
+		return nil
+	}))
+	<-partial
+	fatalIf(t, client.InjectWait(func() error {
+		snd.SendBytes(data[len(data)/2:])
+		snd.Advance()
+		d.Settle()
+		return nil
+	}))
+	if res := <-results; res.aborted || res.err != nil || res.body != strings.Repeat("x", 1000) {
+		t.Errorf("want complete message, got %.20q %v %v", res.body, res.aborted, res.err)
+	}
+
+	// The next delivery on the link is not affected.
+	fatalIf(t, client.InjectWait(func() error {
+		var err error
+		d, err = snd.Send(amqp.NewMessageWith("next"))
+		return err
+	}))
+	if res := <-results; res.aborted || res.err != nil || res.body != "next" {
+		t.Errorf("want next, got %v %v %v", res.body, res.aborted, res.err)
+	}
+	// Can't abort a delivery that is complete.
+	fatalIf(t, client.InjectWait(func() error {
+		if err := d.Abort(); err == nil {
+			t.Error("expected error aborting complete delivery")
+		}
+		return nil
+	}))
+}
+
+// errReader returns data then fails.
+type errReader struct {
+	data []byte
+	err  error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestSendReader(t *testing.T) {
+	type result struct {
+		m       amqp.Message
+		aborted bool
+		err     error
+	}
+	results := make(chan result, 1)
+	server := handlerFunc(func(e Event) {
+		if d := e.Delivery(); e.Type() == EDelivery {
+			if d.HasMessage() || d.Aborted() {
+				m, err := d.Message()
+				res := result{m, d.Aborted(), err}
+				d.Settle()
+				results <- res
+			}
+		} else {
+			if e.Type() == EConnectionBound {
+				e.Transport().SetMaxFrameSize(1024)
+			}
+			openRemote(e)
+		}
+	})
+	client, sEng := newEnginePair(t, handlerFunc(func(Event) {}), server)
+	defer sEng.Disconnect(nil)
+	defer client.Disconnect(nil)
+	snd, err := openSender(client, "stream")
+	fatalIf(t, err)
+	props := amqp.NewMessage()
+	props.SetSubject("upload")
+
+	// The body is sent as several data sections, in frames of at most 1024 bytes.
+	body := strings.Repeat("x", 100000)
+	_, err = snd.SendReader(client, props, strings.NewReader(body))
+	fatalIf(t, err)
+	res := <-results
+	fatalIf(t, res.err)
+	if b, _ := res.m.Body().(amqp.Binary); string(b) != body || res.m.Subject() != "upload" {
+		t.Errorf("bad message %q: %.20q...", res.m.Subject(), res.m.Body())
+	}
+
+	// A reader error aborts the delivery.
+	readErr := errors.New("read failed")
+	_, err = snd.SendReader(client, props, &errReader{[]byte(body), readErr})
+	if err != readErr {
+		t.Errorf("want %v, got %v", readErr, err)
+	}
+	if res := <-results; res.err == nil {
+		t.Errorf("want error decoding aborted delivery, got %v", res.m)
+	}
+
+	// The message must not have a body.
+	if _, err = snd.SendReader(client, amqp.NewMessageWith("x"), strings.NewReader(body)); err == nil {
+		t.Error("expected error streaming message with a body")
+	}
+}
+
+func TestDispositions(t *testing.T) {
+	type outcome struct {
+		state                 uint64
+		err                   error
+		failed, undeliverable bool
+		annotations           amqp.Map
+	}
+	outcomes := make(chan outcome, 10)
+	client := handlerFunc(func(e Event) {
+		if d := e.Delivery(); e.Type() == EDelivery && d.Updated() && d.Settled() {
+			failed, undeliverable, annotations, ok := d.RemoteModified()
+			if ok != (d.RemoteState() == Modified) {
+				t.Errorf("RemoteModified ok %v for state %v", ok, d.RemoteState())
+			}
+			outcomes <- outcome{d.RemoteState(), d.RemoteError(), failed, undeliverable, annotations}
+			d.Settle()
+		}
+	})
+	server := handlerFunc(func(e Event) {
+		if d := e.Delivery(); e.Type() == EDelivery && d.HasMessage() {
+			m, _ := d.Message()
+			switch m.Body() {
+			case "accept":
+				d.Accept()
+			case "reject":
+				d.RejectError(amqp.Errorf(amqp.InvalidField, "bad message"))
+			case "release":
+				d.Release(true)
+			case "modify":
+				errorIf(t, d.Modify(false, true, amqp.Map{amqp.Symbol("x"): "y"}))
+			}
+			return
+		}
+		openRemote(e)
+	})
+	cEng, sEng := newEnginePair(t, client, server)
+	defer sEng.Disconnect(nil)
+	defer cEng.Disconnect(nil)
+	snd, err := openSender(cEng, "dispositions")
+	fatalIf(t, err)
+	want := []outcome{
+		{state: Accepted},
+		{state: Rejected, err: amqp.Errorf(amqp.InvalidField, "bad message")},
+		{state: Modified, failed: true},
+		{state: Modified, undeliverable: true, annotations: amqp.Map{amqp.Symbol("x"): "y"}},
+	}
+	for i, body := range []string{"accept", "reject", "release", "modify"} {
+		fatalIf(t, cEng.InjectWait(func() (err error) { _, err = snd.Send(amqp.NewMessageWith(body)); return }))
+		if got := <-outcomes; !reflect.DeepEqual(want[i], got) {
+			t.Errorf("%v: want %#v, got %#v", body, want[i], got)
+		}
+	}
+}
+
+func TestDispositionEvents(t *testing.T) {
+	type update struct {
+		event           MessagingEvent
+		state           uint64
+		section         uint32
+		offset          uint64
+		received, ended bool
+	}
+	updates := make(chan update, 10)
+	client := NewMessagingAdapter(messagingHandlerFunc(func(me MessagingEvent, e Event) {
+		switch me {
+		case MDisposition, MAccepted, MSettled:
+			d := e.Delivery()
+			section, offset, ok := d.RemoteReceived()
+			updates <- update{me, d.RemoteState(), section, offset, ok, d.Settled()}
+		}
+	}))
+	deliveries := make(chan Delivery, 1)
+	server := handlerFunc(func(e Event) {
+		if d := e.Delivery(); e.Type() == EDelivery && d.HasMessage() {
+			d.UpdateReceived(0, 42)
+			e.Link().Advance()
+			deliveries <- d
+			return
+		}
+		openRemote(e)
+	})
+	cEng, sEng := newEnginePair(t, client, server)
+	defer sEng.Disconnect(nil)
+	defer cEng.Disconnect(nil)
+	snd, err := openSender(cEng, "disposition")
+	fatalIf(t, err)
+	fatalIf(t, cEng.InjectWait(func() (err error) { _, err = snd.Send(amqp.NewMessageWith("x")); return }))
+	d := <-deliveries
+	want := update{event: MDisposition, state: Received, offset: 42, received: true}
+	if got := <-updates; got != want {
+		t.Errorf("want %#v, got %#v", want, got)
+	}
+	fatalIf(t, sEng.InjectWait(func() error { d.Accept(); return nil }))
+	for _, want := range []update{
+		{event: MDisposition, state: Accepted, ended: true},
+		{event: MAccepted, state: Accepted, ended: true},
+		{event: MSettled, state: Accepted, ended: true},
+	} {
+		if got := <-updates; got != want {
+			t.Errorf("want %#v, got %#v", want, got)
+		}
+	}
+}
+
+func TestCredit(t *testing.T) {
+	cEng, sEng := newEnginePair(t, handlerFunc(func(Event) {}), handlerFunc(openRemote))
+	defer sEng.Disconnect(nil)
+	defer cEng.Disconnect(nil)
+	snd, err := openSender(cEng, "credit")
+	fatalIf(t, err)
+	fatalIf(t, cEng.InjectWait(func() error {
+		if err := snd.Flow(1); err == nil {
+			return fmt.Errorf("expected error for Flow on sender")
+		}
+		rcv := snd.Session().Receiver("r")
+		if err := rcv.Flow(-1); err == nil {
+			return fmt.Errorf("expected error for negative credit")
+		}
+		if err := rcv.Flow(100); err != nil {
+			return err
+		}
+		if err := rcv.Drain(10); err != nil {
+			return err
+		}
+		if c := rcv.Credit(); c != 110 {
+			return fmt.Errorf("want credit 110, got %v", c)
+		}
+		if !rcv.IsDrain() {
+			return fmt.Errorf("expected drain flag")
+		}
+		return nil
+	}))
+}
+
+func TestDrained(t *testing.T) {
+	drained := make(chan bool, 10)
+	var flow Event // Last flow event for the receiver
+	client := NewMessagingAdapter(messagingHandlerFunc(func(me MessagingEvent, e Event) {
+		if me == MDrained {
+			flow = e
+			drained <- true
+		}
+	}))
+	client.Prefetch = 0
+	server := handlerFunc(func(e Event) {
+		if l := e.Link(); e.Type() == ELinkFlow && l.IsSender() {
+			l.Drained() // Nothing to send, give up the credit.
+		} else {
+			openRemote(e)
+		}
+	})
+	cEng, sEng := newEnginePair(t, client, server)
+	defer sEng.Disconnect(nil)
+	defer cEng.Disconnect(nil)
+	var rcv Link
+	fatalIf(t, cEng.InjectWait(func() error {
+		cEng.Connection().Open()
+		s, err := cEng.Connection().Session()
+		if err != nil {
+			return err
+		}
+		s.Open()
+		rcv = s.Receiver("drain")
+		rcv.Source().SetAddress("drain")
+		rcv.Open()
+		return rcv.Drain(5)
+	}))
+	<-drained
+	// Another flow event does not report the same drain again.
+	fatalIf(t, cEng.InjectWait(func() error {
+		client.HandleEvent(flow)
+		return rcv.Drain(5)
+	}))
+	<-drained
+	select {
+	case <-drained:
+		t.Error("drain reported twice")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestNavigation(t *testing.T) {
+	containers := make(chan string, 1)
+	cEng, sEng := newEnginePair(t, handlerFunc(func(Event) {}), handlerFunc(func(e Event) {
+		if d := e.Delivery(); e.Type() == EDelivery && d.HasMessage() {
+			l := d.Link()
+			c := l.Session().Connection()
+			if c != e.Connection() || l.Connection() != c || l.Session() != e.Session() {
+				containers <- "bad navigation"
+			} else {
+				containers <- c.RemoteContainer()
+			}
+			d.Accept()
+		} else {
+			openRemote(e)
+		}
+	}))
+	defer sEng.Disconnect(nil)
+	defer cEng.Disconnect(nil)
+	fatalIf(t, cEng.InjectWait(func() error { cEng.Connection().SetContainer("nav"); return nil }))
+	snd, err := openSender(cEng, "nav")
+	fatalIf(t, err)
+	fatalIf(t, cEng.InjectWait(func() error {
+		_, err := snd.Send(amqp.NewMessageWith("x"))
+		return err
+	}))
+	select {
+	case c := <-containers:
+		if c != "nav" {
+			t.Errorf("want remote container nav, got %v", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	// Enumerate sessions and links
+	fatalIf(t, cEng.InjectWait(func() error {
+		c := cEng.Connection()
+		rcv := snd.Session().Receiver("nav-r")
+		other, err := c.Session()
+		if err != nil {
+			return err
+		}
+		other.Sender("other")
+		if got := len(c.Sessions(0)); got != 2 {
+			t.Errorf("want 2 sessions, got %v", got)
+		}
+		if got := len(c.Links(0)); got != 3 {
+			t.Errorf("want 3 links, got %v", got)
+		}
+		s := snd.Session()
+		if got := s.Links(0); len(got) != 2 {
+			t.Errorf("want 2 links, got %v", got)
+		}
+		if got := s.Senders(0); len(got) != 1 || got[0] != snd || got[0].Name() != "nav" {
+			t.Errorf("want sender %v, got %v", snd, got)
+		}
+		if got := s.Receivers(0); len(got) != 1 || got[0] != rcv {
+			t.Errorf("want receiver %v, got %v", rcv, got)
+		}
+		if got := s.Links(SLocalActive); len(got) != 1 || got[0] != snd {
+			t.Errorf("want active link %v, got %v", snd, got)
+		}
+		return nil
+	}))
+}
+
+func TestSetFilter(t *testing.T) {
+	filters := make(chan amqp.Map, 1)
+	cEng, sEng := newEnginePair(t, handlerFunc(func(Event) {}), handlerFunc(func(e Event) {
+		if e.Type() == ELinkRemoteOpen {
+			var m amqp.Map
+			if err := e.Link().RemoteSource().Filter().Unmarshal(&m); err != nil {
+				m = nil
+			}
+			filters <- m
+		}
+		openRemote(e)
+	}))
+	defer sEng.Disconnect(nil)
+	defer cEng.Disconnect(nil)
+	fatalIf(t, cEng.InjectWait(func() error {
+		cEng.Connection().Open()
+		s, err := cEng.Connection().Session()
+		if err != nil {
+			return err
+		}
+		s.Open()
+		r := s.Receiver("filtered")
+		if err := r.Source().SetFilter("selector", amqp.Symbol("apache.org:selector-filter:string"), "a = 1"); err != nil {
+			return err
+		}
+		if err := r.Source().SetFilter("id", uint64(42), true); err != nil {
+			return err
+		}
+		r.Open()
+		return nil
+	}))
+	want := amqp.Map{
+		amqp.Symbol("selector"): amqp.Described{Descriptor: amqp.Symbol("apache.org:selector-filter:string"), Value: "a = 1"},
+		amqp.Symbol("id"):       amqp.Described{Descriptor: uint64(42), Value: true},
+	}
+	select {
+	case got := <-filters:
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("%#v != %#v", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestUnsettledDeliveries(t *testing.T) {
+	cEng, sEng := newEnginePair(t, handlerFunc(func(Event) {}), handlerFunc(openRemote))
+	defer sEng.Disconnect(nil)
+	defer cEng.Disconnect(nil)
+	snd, err := openSender(cEng, "unsettled")
+	fatalIf(t, err)
+	fatalIf(t, cEng.InjectWait(func() error {
+		var tags []string
+		for i := 0; i < 3; i++ {
+			d, err := snd.SendWithTag(amqp.NewMessageWith(i), []byte(fmt.Sprintf("tag%v", i)))
+			if err != nil {
+				return err
+			}
+			tags = append(tags, string(d.Tag().Bytes()))
+		}
+		var got []string
+		for _, d := range snd.UnsettledDeliveries() {
+			if d.LocalState() != 0 || d.Settled() {
+				return fmt.Errorf("unexpected state for %v", d.Tag())
+			}
+			got = append(got, string(d.Tag().Bytes()))
+		}
+		if !reflect.DeepEqual(tags, got) {
+			return fmt.Errorf("want %v, got %v", tags, got)
+		}
+		snd.UnsettledDeliveries()[0].Settle()
+		if n := len(snd.UnsettledDeliveries()); n != 2 || n != snd.Unsettled() {
+			return fmt.Errorf("want 2 unsettled, got %v (%v)", n, snd.Unsettled())
+		}
+		return nil
+	}))
+}
+
+func TestSendPresettled(t *testing.T) {
+	settled := make(chan bool, 1)
+	cEng, sEng := newEnginePair(t, handlerFunc(func(Event) {}), handlerFunc(func(e Event) {
+		if d := e.Delivery(); e.Type() == EDelivery && d.HasMessage() {
+			settled <- d.Settled() // Remotely settled by the sender
+			d.Settle()
+		} else {
+			openRemote(e)
+		}
+	}))
+	defer sEng.Disconnect(nil)
+	defer cEng.Disconnect(nil)
+	snd, err := openSender(cEng, "presettled")
+	fatalIf(t, err)
+	fatalIf(t, cEng.InjectWait(func() error {
+		if _, err := snd.SendPresettled(amqp.NewMessageWith("x")); err != nil {
+			return err
+		}
+		if n := snd.Unsettled(); n != 0 {
+			return fmt.Errorf("want 0 unsettled, got %v", n)
+		}
+		return nil
+	}))
+	select {
+	case s := <-settled:
+		if !s {
+			t.Error("delivery was not presettled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestSendWithEncoder(t *testing.T) {
+	messages := make(chan amqp.Message, 10)
+	client, server := newEnginePair(t, handlerFunc(func(Event) {}), receiveHandler(messages))
+	defer server.Disconnect(nil)
+	defer client.Disconnect(nil)
+	snd, err := openSender(client, "encoder")
+	fatalIf(t, err)
+	var enc amqp.MessageEncoder
+	fatalIf(t, client.InjectWait(func() error {
+		for _, s := range []string{"x", "yy", "zzz"} {
+			if _, err := snd.SendWithEncoder(amqp.NewMessageWith(s), &enc); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	fatalIf(t, expectMessages(messages, "x", "yy", "zzz"))
+}
+
+func TestDetachError(t *testing.T) {
+	type detach struct {
+		event EventType
+		err   error
+	}
+	detached := make(chan detach, 2)
+	cEng, sEng := newEnginePair(t, handlerFunc(func(Event) {}), handlerFunc(func(e Event) {
+		switch e.Type() {
+		case ELinkRemoteDetach, ELinkRemoteClose:
+			detached <- detach{e.Type(), e.Link().RemoteCondition().Error()}
+		default:
+			openRemote(e)
+		}
+	}))
+	defer sEng.Disconnect(nil)
+	defer cEng.Disconnect(nil)
+	want := amqp.Errorf(amqp.LinkMessageSizeExceeded, "too big")
+	for _, close := range []bool{false, true} {
+		snd, err := openSender(cEng, fmt.Sprintf("detach-%v", close))
+		fatalIf(t, err)
+		fatalIf(t, cEng.InjectWait(func() error {
+			if close {
+				CloseError(snd, want)
+			} else {
+				DetachError(snd, want)
+			}
+			return nil
+		}))
+		wantEvent := ELinkRemoteDetach
+		if close {
+			wantEvent = ELinkRemoteClose
+		}
+		select {
+		case got := <-detached:
+			if got.event != wantEvent || !reflect.DeepEqual(got.err, want) {
+				t.Errorf("want %v %v, got %v %v", wantEvent, want, got.event, got.err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestSASL(t *testing.T) {
+	// Returns the server SASL mechanism and outcome, or the client transport error
+	authenticate := func(clientMechs string, insecure bool) (string, SASLOutcome, error) {
+		type result struct {
+			mech    string
+			outcome SASLOutcome
+			err     error
+		}
+		results := make(chan result, 2)
+		cConn, sConn := net.Pipe()
+		cEng, err := NewEngine(cConn, handlerFunc(func(e Event) {
+			if e.Type() == ETransportClosed {
+				results <- result{err: e.Transport().Condition().Error()}
+			}
+		}))
+		fatalIf(t, err)
+		sEng, err := NewEngine(sConn, handlerFunc(func(e Event) {
+			if e.Type() == EConnectionRemoteOpen {
+				s := e.Transport().SASL()
+				results <- result{mech: s.Mech(), outcome: s.Outcome()}
+			}
+			openRemote(e)
+		}))
+		fatalIf(t, err)
+		sEng.Server()
+		sEng.Transport().SASL().AllowedMechs("ANONYMOUS PLAIN")
+		cEng.Connection().SetUser("user")
+		cEng.Connection().SetPassword([]byte("password"))
+		cSASL := cEng.Transport().SASL()
+		cSASL.AllowedMechs(clientMechs)
+		cSASL.SetAllowInsecureMechs(insecure)
+		cEng.Connection().Open()
+		go cEng.Run()
+		go sEng.Run()
+		defer sEng.Disconnect(nil)
+		defer cEng.Disconnect(nil)
+		select {
+		case r := <-results:
+			return r.mech, r.outcome, r.err
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+		return "", SASLNone, nil
+	}
+
+	mech, outcome, err := authenticate("ANONYMOUS", false)
+	if err != nil || mech != "ANONYMOUS" || outcome != SASLOk {
+		t.Errorf("want ANONYMOUS SASLOk, got %v %v %v", mech, outcome, err)
+	}
+	// PLAIN is refused over an unencrypted connection unless insecure mechanisms are allowed.
+	if _, _, err := authenticate("PLAIN", false); err == nil {
+		t.Errorf("expected PLAIN to be refused")
+	}
+}
+
+func TestSSL(t *testing.T) {
+	if !SSLPresent() {
+		if _, err := NewSSLDomain(SSLModeClient); err == nil {
+			t.Error("expected error creating SSL domain without SSL support")
+		}
+		t.Skip("proton-C library has no SSL support")
+	}
+	dir := os.Getenv("PN_INTEROP_DIR")
+	if dir == "" {
+		t.Skip("no PN_INTEROP_DIR in environment")
+	}
+	certs := path.Join(dir, "..", "python", "proton_tests", "ssl_db")
+
+	sDomain, err := NewSSLDomain(SSLModeServer)
+	fatalIf(t, err)
+	defer sDomain.Free()
+	fatalIf(t, sDomain.SetCredentials(path.Join(certs, "server-certificate.pem"), path.Join(certs, "server-private-key.pem"), "server-password"))
+	cDomain, err := NewSSLDomain(SSLModeClient)
+	fatalIf(t, err)
+	defer cDomain.Free()
+	fatalIf(t, cDomain.SetTrustedCADb(path.Join(certs, "ca-certificate.pem")))
+	fatalIf(t, cDomain.SetPeerAuthentication(SSLVerifyPeerName, ""))
+
+	// Returns the client protocol and cipher names, or the client transport error
+	handshake := func(peerHostname string) (string, string, error) {
+		type result struct {
+			protocol, cipher string
+			err              error
+		}
+		results := make(chan result, 2)
+		var cSSL SSL
+		cConn, sConn := net.Pipe()
+		cEng, err := NewEngine(cConn, handlerFunc(func(e Event) {
+			switch e.Type() {
+			case EConnectionRemoteOpen:
+				results <- result{protocol: cSSL.ProtocolName(), cipher: cSSL.CipherName()}
+			case ETransportClosed:
+				results <- result{err: e.Transport().Condition().Error()}
+			}
+		}))
+		fatalIf(t, err)
+		sEng, err := NewEngine(sConn, handlerFunc(openRemote))
+		fatalIf(t, err)
+		sEng.Server()
+		_, err = sEng.Transport().SetSSL(sDomain, "")
+		fatalIf(t, err)
+		cSSL, err = cEng.Transport().SetSSL(cDomain, peerHostname)
+		fatalIf(t, err)
+		cEng.Connection().Open()
+		go cEng.Run()
+		go sEng.Run()
+		defer sEng.Disconnect(nil)
+		defer cEng.Disconnect(nil)
+		select {
+		case r := <-results:
+			return r.protocol, r.cipher, r.err
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+		return "", "", nil
+	}
+
+	protocol, cipher, err := handshake("A1.Good.Server.domain.com")
+	if err != nil || protocol == "" || cipher == "" {
+		t.Errorf("want SSL connection, got %q %q %v", protocol, cipher, err)
+	}
+	// Verify-peer-name fails if the certificate does not match the host name.
+	if _, _, err := handshake("A1.Good.Server.domain.comX"); err == nil {
+		t.Errorf("expected peer name verification to fail")
+	}
+}
+
+// muteConn discards writes once muted, simulating a peer that has gone silent.
+type muteConn struct {
+	net.Conn
+	muted int32
+}
+
+func (c *muteConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&c.muted) != 0 {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	// Returns the client's remote idle timeout and channels for the client and
+	// server transport errors.
+	start := func(cConn, sConn net.Conn, idle time.Duration) (*Engine, *Engine, time.Duration, chan error, chan error) {
+		remoteIdle := make(chan time.Duration, 1)
+		cClosed, sClosed := make(chan error, 1), make(chan error, 1)
+		cEng, err := NewEngine(cConn, handlerFunc(func(e Event) {
+			switch e.Type() {
+			case EConnectionRemoteOpen:
+				remoteIdle <- e.Transport().RemoteIdleTimeout()
+			case ETransportClosed:
+				cClosed <- e.Transport().Condition().Error()
+			}
+		}))
+		fatalIf(t, err)
+		sEng, err := NewEngine(sConn, handlerFunc(func(e Event) {
+			if e.Type() == ETransportClosed {
+				sClosed <- e.Transport().Condition().Error()
+			}
+			openRemote(e)
+		}))
+		fatalIf(t, err)
+		sEng.Server()
+		sEng.Transport().SetIdleTimeout(idle)
+		cEng.Transport().SetIdleTimeout(idle)
+		cEng.Connection().Open()
+		go cEng.Run()
+		go sEng.Run()
+		select {
+		case d := <-remoteIdle:
+			return cEng, sEng, d, cClosed, sClosed
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+		return nil, nil, 0, nil, nil
+	}
+
+	// Heartbeats keep a quiet connection open past the idle timeout.
+	cConn, sConn := net.Pipe()
+	cEng, sEng, d, cClosed, sClosed := start(cConn, sConn, 100*time.Millisecond)
+	// Proton advertises half the local timeout to allow for network delay.
+	if d != 50*time.Millisecond {
+		t.Errorf("want remote idle timeout 50ms, got %v", d)
+	}
+	select {
+	case err := <-cClosed:
+		t.Errorf("heartbeats did not keep connection open: %v", err)
+	case err := <-sClosed:
+		t.Errorf("heartbeats did not keep connection open: %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+	sEng.Disconnect(nil)
+	cEng.Disconnect(nil)
+
+	// The transport fails if nothing is received within the idle timeout.
+	expire := func(closed chan error, muted *muteConn) {
+		atomic.StoreInt32(&muted.muted, 1)
+		select {
+		case err := <-closed:
+			if !amqp.IsResourceLimitExceeded(err) {
+				t.Errorf("want resource-limit-exceeded, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("idle timeout did not expire")
+		}
+	}
+	cPipe, sPipe := net.Pipe()
+	sMute := &muteConn{Conn: sPipe}
+	cEng, sEng, _, cClosed, _ = start(cPipe, sMute, 100*time.Millisecond)
+	expire(cClosed, sMute)
+	sEng.Disconnect(nil)
+	cEng.Disconnect(nil)
+
+	cPipe, sPipe = net.Pipe()
+	cMute := &muteConn{Conn: cPipe}
+	cEng, sEng, _, _, sClosed = start(cMute, sPipe, 100*time.Millisecond)
+	expire(sClosed, cMute)
+	sEng.Disconnect(nil)
+	cEng.Disconnect(nil)
+
+	// A zero idle timeout disables heartbeats.
+	cConn, sConn = net.Pipe()
+	cEng, sEng, d, _, _ = start(cConn, sConn, 0)
+	defer sEng.Disconnect(nil)
+	defer cEng.Disconnect(nil)
+	if d != 0 {
+		t.Errorf("want no remote idle timeout, got %v", d)
+	}
+}
+
+func TestFrameAndChannelMax(t *testing.T) {
+	type result struct {
+		maxFrame   uint32
+		channelMax uint16
+		frameErr   error
+		channelErr error
+	}
+	results := make(chan result, 1)
+	serverErrors := make(chan error, 2)
+	cConn, sConn := net.Pipe()
+	cEng, err := NewEngine(cConn, handlerFunc(func(e Event) {
+		if e.Type() == EConnectionRemoteOpen {
+			results <- result{
+				maxFrame:   e.Transport().RemoteMaxFrameSize(),
+				channelMax: e.Connection().RemoteChannelMax(),
+				frameErr:   e.Transport().SetMaxFrameSize(1024),
+				channelErr: e.Connection().SetChannelMax(1),
+			}
+		}
+	}))
+	fatalIf(t, err)
+	sEng, err := NewEngine(sConn, handlerFunc(func(e Event) {
+		if e.Type() == EConnectionBound {
+			serverErrors <- e.Connection().SetChannelMax(9)
+		}
+		openRemote(e)
+	}))
+	fatalIf(t, err)
+	sEng.Server()
+	// Frames larger than 64k must not be truncated.
+	fatalIf(t, sEng.Transport().SetMaxFrameSize(1<<20))
+	if err := sEng.Connection().SetChannelMax(9); err == nil {
+		t.Error("expected error setting channel max on an unbound connection")
+	}
+	cEng.Connection().Open()
+	go cEng.Run()
+	go sEng.Run()
+	defer sEng.Disconnect(nil)
+	defer cEng.Disconnect(nil)
+	select {
+	case r := <-results:
+		fatalIf(t, <-serverErrors)
+		if r.maxFrame != 1<<20 || r.channelMax != 9 {
+			t.Errorf("want remote max frame %v channel max 9, got %v %v", 1<<20, r.maxFrame, r.channelMax)
+		}
+		if r.frameErr == nil || r.channelErr == nil {
+			t.Errorf("expected errors setting limits on an open connection, got %v %v", r.frameErr, r.channelErr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+type messagingHandlerFunc func(MessagingEvent, Event)
+
+func (f messagingHandlerFunc) HandleMessagingEvent(me MessagingEvent, e Event) { f(me, e) }
+
+func TestMaxMessageSize(t *testing.T) {
+	const max = 64
+	messages := make(chan interface{}, 10)
+	server := NewMessagingAdapter(messagingHandlerFunc(func(me MessagingEvent, e Event) {
+		switch me {
+		case MLinkOpening:
+			e.Link().SetMaxMessageSize(max)
+			e.Link().Flow(10)
+		case MMessage:
+			if m, err := e.Delivery().Message(); err == nil {
+				messages <- m.Body()
+			}
+		}
+	}))
+	remoteMax := make(chan uint64, 1)
+	closed := make(chan error, 1)
+	client, sEng := newEnginePair(t, handlerFunc(func(e Event) {
+		switch e.Type() {
+		case ELinkRemoteOpen:
+			remoteMax <- e.Link().RemoteMaxMessageSize()
+		case ELinkRemoteClose:
+			closed <- e.Link().RemoteCondition().Error()
+		}
+	}), server)
+	defer sEng.Disconnect(nil)
+	defer client.Disconnect(nil)
+	snd, err := openSender(client, "max")
+	fatalIf(t, err)
+	if got := <-remoteMax; got != max {
+		t.Errorf("want remote max %v, got %v", max, got)
+	}
+
+	// Send refuses a message that is too large
+	big := amqp.NewMessageWith(strings.Repeat("x", max))
+	fatalIf(t, client.InjectWait(func() error {
+		if _, err := snd.Send(big); err == nil {
+			t.Error("expected error sending a message that is too large")
+		} else if e, ok := err.(amqp.Error); !ok || e.Name != amqp.LinkMessageSizeExceeded {
+			t.Errorf("want %v, got %v", amqp.LinkMessageSizeExceeded, err)
+		}
+		_, err := snd.Send(amqp.NewMessageWith("small"))
+		return err
+	}))
+	if got := <-messages; got != "small" {
+		t.Errorf("want small, got %v", got)
+	}
+
+	// The receiver closes the link if the sender ignores the limit.
+	fatalIf(t, client.InjectWait(func() error {
+		bytes, err := big.Encode(nil)
+		if err == nil {
+			snd.Delivery("big")
+			snd.SendBytes(bytes)
+			snd.Advance()
+		}
+		return err
+	}))
+	select {
+	case err := <-closed:
+		if e, ok := err.(amqp.Error); !ok || e.Name != amqp.LinkMessageSizeExceeded {
+			t.Errorf("want %v, got %v", amqp.LinkMessageSizeExceeded, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("timeout waiting for link to close")
+	}
+	select {
+	case got := <-messages:
+		t.Errorf("message was not rejected: %v", got)
+	default:
+	}
+}
+
+func TestTracer(t *testing.T) {
+	var lock sync.Mutex
+	var frames []string
+	client, server := newEnginePair(t, handlerFunc(func(Event) {}), receiveHandler(make(chan amqp.Message, 10)))
+	defer server.Disconnect(nil)
+	defer client.Disconnect(nil)
+	fatalIf(t, client.InjectWait(func() error {
+		client.Transport().Trace(TraceFrame)
+		transport := client.Transport()
+		transport.SetTracer(func(tr Transport, direction, frame string) {
+			if tr != transport {
+				t.Errorf("want tracer for %v, got %v", transport, tr)
+			}
+			lock.Lock()
+			frames = append(frames, direction+" "+frame)
+			lock.Unlock()
+		})
+		return nil
+	}))
+	_, err := openSender(client, "trace")
+	fatalIf(t, err)
+	// Wait for the remote attach so both directions have been traced.
+	var trace string
+	for deadline := time.Now().Add(5 * time.Second); !strings.Contains(trace, "<- @attach"); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for attach in trace:\n%s", trace)
+		}
+		time.Sleep(time.Millisecond)
+		lock.Lock()
+		trace = strings.Join(frames, "\n")
+		lock.Unlock()
+	}
+	for _, want := range []string{"-> 0 -> @open", "-> 0 -> @begin", "-> 0 -> @attach", "<- 0 <- @open"} {
+		if !strings.Contains(trace, want) {
+			t.Errorf("want %q in trace:\n%s", want, trace)
+		}
+	}
+
+	// Turn tracing off at runtime
+	fatalIf(t, client.InjectWait(func() error {
+		client.Transport().Trace(TraceOff)
+		lock.Lock()
+		frames = nil
+		lock.Unlock()
+		return nil
+	}))
+	_, err = openSender(client, "untraced")
+	fatalIf(t, err)
+	fatalIf(t, client.InjectWait(func() error { return nil }))
+	lock.Lock()
+	defer lock.Unlock()
+	if len(frames) != 0 {
+		t.Errorf("unexpected trace with tracing off: %v", frames)
+	}
+
+	for message, want := range map[string]string{
+		"1 -> @flow(19) []": "->",
+		"  <- AMQP":         "<-",
+		"  -> EOS":          "->",
+		"RAW: \"AMQP\"":     "",
+		"AMQP detected":     "",
+	} {
+		if got := traceDirection(message); got != want {
+			t.Errorf("%q: want direction %q, got %q", message, want, got)
+		}
+	}
+}
+
+func TestSettleAll(t *testing.T) {
+	deliveries := make(chan Delivery, 10)
+	server := handlerFunc(func(e Event) {
+		if d := e.Delivery(); e.Type() == EDelivery && d.HasMessage() {
+			e.Link().Advance()
+			deliveries <- d
+		} else {
+			openRemote(e)
+		}
+	})
+	accepted := make(chan Delivery, 10)
+	client, sEng := newEnginePair(t, handlerFunc(func(e Event) {
+		if d := e.Delivery(); e.Type() == EDelivery && d.Remote().Type() == Accepted {
+			accepted <- d
+		}
+	}), server)
+	defer sEng.Disconnect(nil)
+	defer client.Disconnect(nil)
+	snd, err := openSender(client, "settle")
+	fatalIf(t, err)
+	var lock sync.Mutex
+	var dispositions int
+	fatalIf(t, sEng.InjectWait(func() error {
+		sEng.Transport().Trace(TraceFrame)
+		sEng.Transport().SetTracer(func(_ Transport, direction, frame string) {
+			if direction == "->" && strings.Contains(frame, "@disposition") {
+				lock.Lock()
+				dispositions++
+				lock.Unlock()
+			}
+		})
+		return nil
+	}))
+	const n = 10
+	fatalIf(t, client.InjectWait(func() error {
+		for i := 0; i < n; i++ {
+			if _, err := snd.Send(amqp.NewMessageWith(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	var received []Delivery
+	for i := 0; i < n; i++ {
+		received = append(received, <-deliveries)
+	}
+	fatalIf(t, sEng.InjectWait(func() error {
+		// Accept all but one, there is a gap in the delivery-ids.
+		SettleAll(Accepted, received[:4]...)
+		SettleAll(Accepted, received[5:]...)
+		return nil
+	}))
+	for i := 0; i < n-1; i++ {
+		select {
+		case <-accepted:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %v accepted deliveries", n-1)
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if dispositions != 2 {
+		t.Errorf("want 2 disposition frames, got %v", dispositions)
+	}
+}
+
+// resetConn fails reads with a connection reset error.
+type resetConn struct{ net.Conn }
+
+func (c resetConn) Read(b []byte) (int, error) {
+	return 0, &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+}
+
+func TestTransportError(t *testing.T) {
+	// Run an engine on conn, return the engine and the condition of the
+	// transport error event.
+	run := func(conn net.Conn) (*Engine, error) {
+		conditions := make(chan error, 1)
+		eng, err := NewEngine(conn, handlerFunc(func(e Event) {
+			if e.Type() == ETransportError {
+				conditions <- e.Transport().Condition().Error()
+			}
+		}))
+		fatalIf(t, err)
+		go func() { _ = eng.Run() }()
+		select {
+		case err := <-conditions:
+			<-eng.running
+			return eng, err
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for transport error")
+			return nil, nil
+		}
+	}
+
+	// Protocol error: an AMQP condition, no I/O error.
+	cConn, sConn := net.Pipe()
+	defer cConn.Close()
+	go func() { _, _ = io.Copy(ioutil.Discard, cConn) }()
+	go func() { _, _ = cConn.Write([]byte("not an AMQP header")) }()
+	eng, err := run(sConn)
+	if !amqp.IsCondition(err, amqp.ConnectionFramingError) {
+		t.Errorf("want %s condition, got %v", amqp.ConnectionFramingError, err)
+	}
+	if eng.IOError() != nil || eng.Errno() != 0 {
+		t.Errorf("want no I/O error, got %v, %v", eng.IOError(), eng.Errno())
+	}
+
+	// I/O error: the original error and errno are available.
+	cConn, sConn = net.Pipe()
+	defer cConn.Close()
+	go func() { _, _ = io.Copy(ioutil.Discard, cConn) }()
+	eng, err = run(resetConn{sConn})
+	if err == nil {
+		t.Error("want transport error condition")
+	}
+	if _, ok := eng.IOError().(*net.OpError); !ok {
+		t.Errorf("want *net.OpError, got %#v", eng.IOError())
+	}
+	if eng.Errno() != syscall.ECONNRESET {
+		t.Errorf("want %v, got %v", syscall.ECONNRESET, eng.Errno())
+	}
+}
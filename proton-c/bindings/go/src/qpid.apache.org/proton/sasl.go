@@ -0,0 +1,157 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// Server side SASL authentication by a Go function, using the SASL plugin
+// interface in sasl-plugin.h. The C callbacks into Go are in sasl_export.go,
+// which must only contain C declarations.
+
+package proton
+
+/*
+#include <proton/sasl.h>
+#include <proton/sasl-plugin.h>
+#include <stdlib.h>
+
+extern const char *goSASLListMechs(pn_transport_t *transport);
+extern void goSASLProcessInit(pn_transport_t *transport, char *mechanism, pn_bytes_t *recv);
+extern void goSASLFree(pn_transport_t *transport);
+
+static void go_sasl_free(pn_transport_t *t) { goSASLFree(t); }
+static const char *go_sasl_list_mechs(pn_transport_t *t) { return goSASLListMechs(t); }
+static bool go_sasl_init_server(pn_transport_t *t) {
+  pnx_sasl_set_desired_state(t, SASL_POSTED_MECHANISMS);
+  return true;
+}
+static bool go_sasl_init_client(pn_transport_t *t) { return false; }
+static void go_sasl_prepare_write(pn_transport_t *t) {}
+static void go_sasl_process_init(pn_transport_t *t, const char *mechanism, const pn_bytes_t *recv) {
+  goSASLProcessInit(t, (char*)mechanism, (pn_bytes_t*)recv);
+}
+static void go_sasl_process_response(pn_transport_t *t, const pn_bytes_t *recv) {}
+static bool go_sasl_process_mechanisms(pn_transport_t *t, const char *mechs) { return false; }
+static void go_sasl_process_challenge(pn_transport_t *t, const pn_bytes_t *recv) {}
+static void go_sasl_process_outcome(pn_transport_t *t) {}
+static bool go_sasl_can_encrypt(pn_transport_t *t) { return false; }
+static ssize_t go_sasl_max_encrypt_size(pn_transport_t *t) { return 0; }
+static ssize_t go_sasl_encode(pn_transport_t *t, pn_bytes_t in, pn_bytes_t *out) { return 0; }
+static ssize_t go_sasl_decode(pn_transport_t *t, pn_bytes_t in, pn_bytes_t *out) { return 0; }
+
+static const pnx_sasl_implementation go_sasl_impl = {
+  go_sasl_free,
+  go_sasl_list_mechs,
+  go_sasl_init_server,
+  go_sasl_init_client,
+  go_sasl_prepare_write,
+  go_sasl_process_init,
+  go_sasl_process_response,
+  go_sasl_process_mechanisms,
+  go_sasl_process_challenge,
+  go_sasl_process_outcome,
+  go_sasl_can_encrypt,
+  go_sasl_max_encrypt_size,
+  go_sasl_encode,
+  go_sasl_decode
+};
+
+// pn_sasl() decides if SASL is client or server when it is first called.
+static bool go_sasl_is_client(pn_transport_t *t) {
+  pn_sasl(t);
+  return pnx_sasl_is_client(t);
+}
+
+// The context must not be NULL or go_sasl_free is not called.
+static void go_sasl_set(pn_transport_t *t) {
+  pnx_sasl_set_implementation(t, &go_sasl_impl, t);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// SASLAuthenticator checks the credentials sent by a client with SASL
+// mechanism mech. For ANONYMOUS the user is the client's trace information, if
+// any, the password is empty and an accepted client's Transport.User() is
+// "anonymous".
+//
+// Return true to accept the client. Return false to refuse it with the SASL
+// "auth" outcome, the client's credentials are wrong. Return an error to
+// refuse it with the "sys-temp" outcome, authentication could not be done, for
+// example because a user database is unavailable, and the client may retry.
+type SASLAuthenticator func(mech, user, password string) (bool, error)
+
+// saslMechs are the mechanisms supported by a SASLAuthenticator.
+var saslMechs = map[string]bool{"PLAIN": true, "ANONYMOUS": true}
+
+type saslServer struct {
+	mechs        []string
+	authenticate SASLAuthenticator
+	cMechs       *C.char // Last list returned by goSASLListMechs
+	cUser        *C.char // Authenticated user, proton keeps the pointer
+}
+
+// SASL servers by transport, the C callbacks have no other way to find the Go function.
+var saslServers = struct {
+	sync.Mutex
+	m map[*C.pn_transport_t]*saslServer
+}{m: make(map[*C.pn_transport_t]*saslServer)}
+
+// SetSASLAuthenticator makes a server transport offer the SASL mechanisms
+// mechs, a space-separated list of PLAIN and ANONYMOUS, and authenticate
+// clients by calling authenticate. It replaces the SASL implementation built in
+// to proton, Transport.SASL().AllowedMechs() still restricts the mechanisms
+// offered.
+//
+// PLAIN sends a clear-text password so it is only offered over an encrypted
+// connection unless Transport.SASL().SetAllowInsecureMechs(true) is set.
+//
+// Call it after Engine.Server() and before the engine starts running. If
+// Transport.SASL() is called before Engine.Server() SASL is set up as a client
+// and SetSASLAuthenticator returns an error. authenticate
+// is called in the engine goroutine, so it must not block for long.
+func (t Transport) SetSASLAuthenticator(mechs string, authenticate SASLAuthenticator) error {
+	if C.go_sasl_is_client(t.pn) {
+		return fmt.Errorf("SASL authenticator is only allowed for a server transport")
+	}
+	ss := &saslServer{mechs: strings.Fields(mechs), authenticate: authenticate}
+	for _, m := range ss.mechs {
+		if !saslMechs[m] {
+			return fmt.Errorf("SASL authenticator does not support mechanism %q", m)
+		}
+	}
+	saslServers.Lock()
+	defer saslServers.Unlock()
+	if old := saslServers.m[t.pn]; old != nil {
+		old.free()
+	}
+	saslServers.m[t.pn] = ss
+	C.go_sasl_set(t.pn)
+	return nil
+}
+
+// free releases the C strings. Call with saslServers locked.
+func (ss *saslServer) free() {
+	C.free(unsafe.Pointer(ss.cMechs))
+	C.free(unsafe.Pointer(ss.cUser))
+	ss.cMechs, ss.cUser = nil, nil
+}
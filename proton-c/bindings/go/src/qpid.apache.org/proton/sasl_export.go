@@ -0,0 +1,126 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// C callbacks for the SASL implementation in sasl.go, this file must only
+// contain C declarations, not definitions.
+
+package proton
+
+//#include <proton/sasl.h>
+//#include <proton/sasl-plugin.h>
+//#include <stdlib.h>
+import "C"
+
+import (
+	"bytes"
+	"strings"
+	"unsafe"
+)
+
+//export goSASLListMechs
+func goSASLListMechs(transport *C.pn_transport_t) *C.char {
+	saslServers.Lock()
+	defer saslServers.Unlock()
+	ss := saslServers.m[transport]
+	if ss == nil {
+		return nil
+	}
+	secure := bool(C.pnx_sasl_is_transport_encrypted(transport)) || bool(C.pnx_sasl_get_allow_insecure_mechs(transport))
+	var mechs []string
+	for _, m := range ss.mechs {
+		cm := C.CString(m)
+		included := bool(C.pnx_sasl_is_included_mech(transport, C.pn_bytes(C.size_t(len(m)), cm)))
+		C.free(unsafe.Pointer(cm))
+		if included && (m != "PLAIN" || secure) {
+			mechs = append(mechs, m)
+		}
+	}
+	C.free(unsafe.Pointer(ss.cMechs))
+	ss.cMechs = C.CString(strings.Join(mechs, " "))
+	return ss.cMechs
+}
+
+//export goSASLProcessInit
+func goSASLProcessInit(transport *C.pn_transport_t, mechanism *C.char, recv *C.pn_bytes_t) {
+	saslServers.Lock()
+	ss := saslServers.m[transport]
+	saslServers.Unlock()
+	mech := C.GoString(mechanism)
+	outcome := SASLAuth
+	if ss != nil && offered(C.GoString(goSASLListMechs(transport)), mech) {
+		user, password, ok := saslCredentials(mech, C.GoBytes(unsafe.Pointer(recv.start), C.int(recv.size)))
+		if ok {
+			accept, err := ss.authenticate(mech, user, password)
+			switch {
+			case err != nil:
+				outcome = SASLTemp
+			case accept:
+				outcome = SASLOk
+				if mech == "ANONYMOUS" {
+					user = "anonymous"
+				}
+				saslServers.Lock()
+				C.free(unsafe.Pointer(ss.cUser))
+				ss.cUser = C.CString(user)
+				C.pnx_sasl_succeed_authentication(transport, ss.cUser)
+				saslServers.Unlock()
+			}
+		}
+	}
+	if outcome != SASLOk {
+		C.pn_sasl_done(C.pn_sasl(transport), C.pn_sasl_outcome_t(outcome))
+	}
+	C.pnx_sasl_set_desired_state(transport, C.SASL_POSTED_OUTCOME)
+}
+
+//export goSASLFree
+func goSASLFree(transport *C.pn_transport_t) {
+	saslServers.Lock()
+	defer saslServers.Unlock()
+	if ss := saslServers.m[transport]; ss != nil {
+		ss.free()
+		delete(saslServers.m, transport)
+	}
+}
+
+// offered returns true if mech is in the space-separated list mechs.
+func offered(mechs, mech string) bool {
+	for _, m := range strings.Fields(mechs) {
+		if m == mech {
+			return true
+		}
+	}
+	return false
+}
+
+// saslCredentials gets the user and password from the initial response of a
+// PLAIN or ANONYMOUS client. PLAIN is "authzid NUL authcid NUL password".
+func saslCredentials(mech string, response []byte) (user, password string, ok bool) {
+	switch mech {
+	case "ANONYMOUS":
+		return string(response), "", true
+	case "PLAIN":
+		fields := bytes.Split(response, []byte{0})
+		if len(fields) != 3 {
+			return "", "", false
+		}
+		return string(fields[1]), string(fields[2]), true
+	}
+	return "", "", false
+}
@@ -0,0 +1,214 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// Wrappers for declarations in ssl.h, written by hand because the domain and
+// buffer-based getters don't follow the pattern of genwrap.go.
+
+package proton
+
+//#include <proton/ssl.h>
+//#include <proton/transport.h>
+//#include <stdlib.h>
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// SSLPresent returns true if the proton-C library was built with SSL support.
+func SSLPresent() bool { return bool(C.pn_ssl_present()) }
+
+// SSLMode determines whether an SSLDomain is used for client or server connections.
+type SSLMode C.pn_ssl_mode_t
+
+const (
+	SSLModeClient SSLMode = C.PN_SSL_MODE_CLIENT
+	SSLModeServer SSLMode = C.PN_SSL_MODE_SERVER
+)
+
+func (m SSLMode) String() string {
+	switch m {
+	case SSLModeClient:
+		return "SSLModeClient"
+	case SSLModeServer:
+		return "SSLModeServer"
+	}
+	return fmt.Sprintf("SSLMode(%d)", int(m))
+}
+
+// SSLVerifyMode determines how the identity of the remote peer is checked.
+type SSLVerifyMode C.pn_ssl_verify_mode_t
+
+const (
+	// SSLAnonymousPeer does not require a peer certificate.
+	SSLAnonymousPeer SSLVerifyMode = C.PN_SSL_ANONYMOUS_PEER
+	// SSLVerifyPeer requires a valid certificate signed by a trusted CA.
+	SSLVerifyPeer SSLVerifyMode = C.PN_SSL_VERIFY_PEER
+	// SSLVerifyPeerName is like SSLVerifyPeer and also requires the certificate
+	// CN or subjectAltName to match the peer host name.
+	SSLVerifyPeerName SSLVerifyMode = C.PN_SSL_VERIFY_PEER_NAME
+)
+
+func (m SSLVerifyMode) String() string {
+	switch m {
+	case SSLAnonymousPeer:
+		return "SSLAnonymousPeer"
+	case SSLVerifyPeer:
+		return "SSLVerifyPeer"
+	case SSLVerifyPeerName:
+		return "SSLVerifyPeerName"
+	}
+	return fmt.Sprintf("SSLVerifyMode(%d)", int(m))
+}
+
+// SSLDomain holds the SSL configuration (certificates, trusted CAs and peer
+// verification) shared by a group of connections.
+//
+// An SSLDomain is not bound to an engine goroutine, it can be configured and
+// passed to Transport.SetSSL() for any number of transports. Transports keep a
+// reference to the domain, call Free() when you no longer need to create new
+// transports with it.
+type SSLDomain struct{ pn *C.pn_ssl_domain_t }
+
+// NewSSLDomain creates an SSLDomain for client or server connections.
+// Returns an error if SSL is not supported by the proton-C library.
+func NewSSLDomain(mode SSLMode) (SSLDomain, error) {
+	d := SSLDomain{C.pn_ssl_domain(C.pn_ssl_mode_t(mode))}
+	if d.IsNil() {
+		return d, fmt.Errorf("cannot create %s domain, SSL is not available", mode)
+	}
+	return d, nil
+}
+
+func (d SSLDomain) IsNil() bool          { return d.pn == nil }
+func (d SSLDomain) CPtr() unsafe.Pointer { return unsafe.Pointer(d.pn) }
+
+// Free releases the domain. Transports already using the domain are not affected.
+func (d SSLDomain) Free() { C.pn_ssl_domain_free(d.pn) }
+
+// cStringOrNil returns nil for an empty string. Free the result with C.free.
+func cStringOrNil(s string) *C.char {
+	if s == "" {
+		return nil
+	}
+	return C.CString(s)
+}
+
+// SetCredentials sets the certificate that identifies this endpoint to the
+// remote peer. Required for servers, and for clients if the server verifies
+// its peers. password is used to decrypt keyFile, it may be empty if the key is
+// not protected.
+func (d SSLDomain) SetCredentials(certFile, keyFile, password string) error {
+	ccert, ckey, cpass := C.CString(certFile), C.CString(keyFile), cStringOrNil(password)
+	defer C.free(unsafe.Pointer(ccert))
+	defer C.free(unsafe.Pointer(ckey))
+	defer C.free(unsafe.Pointer(cpass))
+	if C.pn_ssl_domain_set_credentials(d.pn, ccert, ckey, cpass) != 0 {
+		return fmt.Errorf("cannot set SSL credentials cert=%q key=%q", certFile, keyFile)
+	}
+	return nil
+}
+
+// SetTrustedCADb sets the database of trusted CA certificates used to verify
+// the remote peer.
+func (d SSLDomain) SetTrustedCADb(path string) error {
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+	if C.pn_ssl_domain_set_trusted_ca_db(d.pn, cpath) != 0 {
+		return fmt.Errorf("cannot set SSL trusted CA database %q", path)
+	}
+	return nil
+}
+
+// SetPeerAuthentication sets how the remote peer is verified. The default is
+// SSLVerifyPeerName for clients and SSLAnonymousPeer for servers.
+//
+// trustedCAs is only used by servers that verify their peers: it names the
+// file of CA certificates advertised to clients. Pass "" for clients.
+//
+func (d SSLDomain) SetPeerAuthentication(mode SSLVerifyMode, trustedCAs string) error {
+	ccas := cStringOrNil(trustedCAs)
+	defer C.free(unsafe.Pointer(ccas))
+	if C.pn_ssl_domain_set_peer_authentication(d.pn, C.pn_ssl_verify_mode_t(mode), ccas) != 0 {
+		return fmt.Errorf("cannot set SSL peer authentication %s", mode)
+	}
+	return nil
+}
+
+// SSL is the SSL session of a Transport. It is only valid while the
+// transport exists, and must only be used in the engine goroutine.
+type SSL struct{ pn *C.pn_ssl_t }
+
+func (s SSL) IsNil() bool          { return s.pn == nil }
+func (s SSL) CPtr() unsafe.Pointer { return unsafe.Pointer(s.pn) }
+
+// SetSSL enables SSL on the transport using the configuration in domain.
+//
+// Call SetSSL before the engine starts running. For clients peerHostname is
+// the name checked against the server certificate by SSLVerifyPeerName,
+// if it is empty the host name of the connection is used.
+//
+// If the handshake or peer verification fails the transport is closed with
+// an error condition, which is reported by the engine as the connection error.
+//
+func (t Transport) SetSSL(domain SSLDomain, peerHostname string) (SSL, error) {
+	s := SSL{C.pn_ssl(t.pn)}
+	if s.IsNil() {
+		return s, fmt.Errorf("cannot enable SSL on transport, SSL is not available")
+	}
+	if C.pn_ssl_init(s.pn, domain.pn, nil) != 0 {
+		return s, fmt.Errorf("cannot initialize SSL on transport")
+	}
+	if peerHostname != "" {
+		chost := C.CString(peerHostname)
+		defer C.free(unsafe.Pointer(chost))
+		if C.pn_ssl_set_peer_hostname(s.pn, chost) != 0 {
+			return s, fmt.Errorf("cannot set SSL peer host name %q", peerHostname)
+		}
+	}
+	return s, nil
+}
+
+// sslName calls a pn_ssl_get_*_name function, returns "" if SSL is not active.
+func sslName(get func(*C.char, C.size_t) C.bool) string {
+	buf := make([]byte, 128)
+	if !get((*C.char)(unsafe.Pointer(&buf[0])), C.size_t(len(buf))) {
+		return ""
+	}
+	return C.GoString((*C.char)(unsafe.Pointer(&buf[0])))
+}
+
+// ProtocolName returns the negotiated SSL/TLS protocol, for example "TLSv1.2".
+// Returns "" if the handshake has not completed.
+func (s SSL) ProtocolName() string {
+	return sslName(func(buf *C.char, size C.size_t) C.bool { return C.pn_ssl_get_protocol_name(s.pn, buf, size) })
+}
+
+// CipherName returns the negotiated cipher suite.
+// Returns "" if the handshake has not completed.
+func (s SSL) CipherName() string {
+	return sslName(func(buf *C.char, size C.size_t) C.bool { return C.pn_ssl_get_cipher_name(s.pn, buf, size) })
+}
+
+// RemoteSubject returns the subject of the remote peer's certificate, or "" if
+// there is none.
+func (s SSL) RemoteSubject() string {
+	return C.GoString(C.pn_ssl_get_remote_subject(s.pn))
+}
@@ -0,0 +1,122 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// Wrappers for the transport trace functions in transport.h. The tracer is a C
+// callback into Go, so this file must only contain C declarations, not
+// definitions.
+
+package proton
+
+//#include <proton/transport.h>
+//
+// extern void goTracer(pn_transport_t *transport, char *message);
+import "C"
+
+import (
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// TraceFlags selects what a Transport logs, see Transport.Trace()
+type TraceFlags int
+
+const (
+	// TraceOff turns tracing off.
+	TraceOff TraceFlags = C.PN_TRACE_OFF
+	// TraceRaw logs raw bytes read and written.
+	TraceRaw TraceFlags = C.PN_TRACE_RAW
+	// TraceFrame logs each AMQP frame sent (->) or received (<-).
+	TraceFrame TraceFlags = C.PN_TRACE_FRM
+	// TraceDriver logs transport state changes.
+	TraceDriver TraceFlags = C.PN_TRACE_DRV
+)
+
+// Trace sets the trace flags of the transport, replacing any flags set by the
+// PN_TRACE_FRM, PN_TRACE_RAW or PN_TRACE_DRV environment variables. Tracing
+// can be turned on or off at any time. Messages are written to standard error,
+// or passed to the function set by SetTracer().
+//
+// For an Engine, call it in the engine goroutine, for example with
+// Engine.Inject().
+func (t Transport) Trace(flags TraceFlags) {
+	C.pn_transport_trace(t.pn, C.pn_trace_t(flags))
+}
+
+type tracer struct {
+	trace    func(t Transport, direction, frame string)
+	original C.pn_tracer_t
+}
+
+// Tracers by transport, the C callback has no other way to find the Go function.
+var tracers = struct {
+	sync.Mutex
+	m map[*C.pn_transport_t]tracer
+}{m: make(map[*C.pn_transport_t]tracer)}
+
+// SetTracer sets a function to receive the trace messages of the transport
+// instead of writing them to standard error. Use Trace() to choose what is
+// logged. SetTracer(nil) restores the default.
+//
+// The function is passed the transport, so one tracer can log several
+// connections, and the trace message as frame. For a frame, including the AMQP
+// and SASL headers and end of stream, direction is "->" if it was sent or "<-"
+// if it was received. It is empty for other messages, for example raw bytes.
+//
+// The function is called in the goroutine that processes the transport, for an
+// Engine that is the engine goroutine, so it must not block.
+func (t Transport) SetTracer(trace func(t Transport, direction, frame string)) {
+	tracers.Lock()
+	defer tracers.Unlock()
+	old, ok := tracers.m[t.pn]
+	switch {
+	case trace == nil && ok:
+		C.pn_transport_set_tracer(t.pn, old.original)
+		delete(tracers.m, t.pn)
+	case trace != nil && ok:
+		tracers.m[t.pn] = tracer{trace, old.original}
+	case trace != nil:
+		tracers.m[t.pn] = tracer{trace, C.pn_transport_get_tracer(t.pn)}
+		C.pn_transport_set_tracer(t.pn, C.pn_tracer_t(unsafe.Pointer(C.goTracer)))
+	}
+}
+
+//export goTracer
+func goTracer(transport *C.pn_transport_t, message *C.char) {
+	tracers.Lock()
+	tr := tracers.m[transport]
+	tracers.Unlock()
+	if tr.trace != nil {
+		frame := C.GoString(message)
+		tr.trace(Transport{transport}, traceDirection(frame), frame)
+	}
+}
+
+// traceDirection returns the direction of a frame trace message: "->" or "<-"
+// after an optional channel number, or "" if message is not about a frame.
+func traceDirection(message string) string {
+	s := strings.TrimLeft(strings.TrimLeft(message, " "), "0123456789")
+	s = strings.TrimLeft(s, " ")
+	for _, dir := range []string{"->", "<-"} {
+		if strings.HasPrefix(s, dir) {
+			return dir
+		}
+	}
+	return ""
+}
@@ -33,6 +33,18 @@ package proton
 //#include <proton/session.h>
 //#include <proton/transport.h>
 //#include <stdlib.h>
+//
+// PN_HANDLE(GO_DRAIN_PENDING)
+//
+// /* Get and set the drain pending flag stored in the link attachments. */
+// static bool go_link_drain_pending(pn_link_t *l) {
+//   return pn_record_get(pn_link_attachments(l), GO_DRAIN_PENDING) != NULL;
+// }
+// static void go_link_set_drain_pending(pn_link_t *l, bool pending) {
+//   pn_record_t *r = pn_link_attachments(l);
+//   if (!pn_record_has(r, GO_DRAIN_PENDING)) pn_record_def(r, GO_DRAIN_PENDING, PN_VOID);
+//   pn_record_set(r, GO_DRAIN_PENDING, pending ? (void*)1 : NULL);
+// }
 import "C"
 
 import (
@@ -146,6 +158,46 @@ func (d Data) Marshal(v interface{}) error {
 	return amqp.MarshalUnsafe(v, d.CPtr())
 }
 
+// SetSymbols encodes symbols as an AMQP array of symbols, the encoding used for
+// capabilities. An empty slice clears d.
+func (d Data) SetSymbols(symbols []amqp.Symbol) {
+	d.Clear()
+	if len(symbols) == 0 {
+		return
+	}
+	C.pn_data_put_array(d.pn, false, C.PN_SYMBOL)
+	C.pn_data_enter(d.pn)
+	for _, s := range symbols {
+		_ = amqp.MarshalUnsafe(s, d.CPtr()) // Can't fail for a Symbol
+	}
+	C.pn_data_exit(d.pn)
+}
+
+// Symbols decodes AMQP capabilities, which may be a single symbol or an array
+// of symbols. Returns nil if d is empty.
+func (d Data) Symbols() (symbols []amqp.Symbol, err error) {
+	d.Rewind()
+	if !C.pn_data_next(d.pn) {
+		return nil, nil
+	}
+	var s amqp.Symbol
+	if C.pn_data_type(d.pn) != C.PN_ARRAY {
+		if err = amqp.UnmarshalUnsafe(d.CPtr(), &s); err != nil {
+			return nil, err
+		}
+		return []amqp.Symbol{s}, nil
+	}
+	C.pn_data_enter(d.pn)
+	defer C.pn_data_exit(d.pn)
+	for C.pn_data_next(d.pn) {
+		if err = amqp.UnmarshalUnsafe(d.CPtr(), &s); err != nil {
+			return nil, err
+		}
+		symbols = append(symbols, s)
+	}
+	return symbols, nil
+}
+
 // State holds the state flags for an AMQP endpoint.
 type State byte
 
@@ -201,6 +253,16 @@ func CloseError(e Endpoint, err error) {
 	e.Close()
 }
 
+// DetachError sets an error condition (if err != nil) on a link and detaches
+// it without closing it, so the remote peer may expect the link to be
+// re-attached later. Use CloseError to close a link with an error.
+func DetachError(l Link, err error) {
+	if err != nil && !l.Condition().IsSet() {
+		l.Condition().SetError(err)
+	}
+	l.Detach()
+}
+
 // EndpointError returns the remote error if there is one, the local error if not
 // nil if there is no error.
 func EndpointError(e Endpoint) error {
@@ -225,26 +287,126 @@ func (d Delivery) SettleAs(disposition uint64) {
 	d.Settle()
 }
 
+// SettleAll is equivalent to calling d.SettleAs(disposition) for each delivery.
+//
+// The engine sends a single disposition frame for a range of deliveries with
+// contiguous delivery-ids on the same session that are settled the same way
+// before the engine next writes, so settling a batch of deliveries together is
+// much cheaper than settling them one at a time in separate engine turns. Pass
+// the deliveries in the order they were received to get the fewest frames,
+// each gap in the delivery-ids starts a new frame.
+func SettleAll(disposition uint64, deliveries ...Delivery) {
+	for _, d := range deliveries {
+		d.SettleAs(disposition)
+	}
+}
+
 // Accept accepts and settles a delivery.
 func (d Delivery) Accept() { d.SettleAs(Accepted) }
 
 // Reject rejects and settles a delivery
 func (d Delivery) Reject() { d.SettleAs(Rejected) }
 
+// RejectError rejects and settles a delivery with an error condition.
+// If err is not an amqp.Error it is converted as for Condition.SetError()
+func (d Delivery) RejectError(err error) {
+	d.Local().Condition().SetError(err)
+	d.SettleAs(Rejected)
+}
+
+// RemoteError returns the error condition sent by the remote peer with a
+// Rejected outcome, as an amqp.Error. Returns nil if the delivery was not
+// rejected, or was rejected without a condition.
+func (d Delivery) RemoteError() error {
+	if d.RemoteState() != Rejected {
+		return nil
+	}
+	return d.Remote().Condition().Error()
+}
+
+// RemoteModified returns the fields of a Modified outcome sent by the remote
+// peer, see Modify(). ok is false if the remote state is not Modified.
+// annotations is nil if the peer sent none or they cannot be decoded.
+func (d Delivery) RemoteModified() (deliveryFailed, undeliverable bool, annotations amqp.Map, ok bool) {
+	if d.RemoteState() != Modified {
+		return false, false, nil, false
+	}
+	remote := d.Remote()
+	if err := remote.Annotations().Unmarshal(&annotations); err != nil || len(annotations) == 0 {
+		annotations = nil
+	}
+	return remote.IsFailed(), remote.IsUndeliverable(), annotations, true
+}
+
+// RemoteReceived returns the position sent by the remote peer with a Received
+// state, see UpdateReceived(). ok is false if the remote state is not
+// Received. A sender can use the position to resume a large transfer.
+func (d Delivery) RemoteReceived() (section uint32, offset uint64, ok bool) {
+	if d.RemoteState() != Received {
+		return 0, 0, false
+	}
+	return d.Remote().SectionNumber(), d.Remote().SectionOffset(), true
+}
+
+// UpdateReceived sends the non-terminal Received state without settling the
+// delivery: the message has been received up to offset bytes into section,
+// counting sections from 0. The outcome is still to be decided.
+func (d Delivery) UpdateReceived(section uint32, offset uint64) {
+	d.Local().SetSectionNumber(section)
+	d.Local().SetSectionOffset(offset)
+	d.Update(Received)
+}
+
 // Release releases and settles a delivery
 // If delivered is true the delivery count for the message will be increased.
 func (d Delivery) Release(delivered bool) {
 	if delivered {
-		d.SettleAs(Modified)
+		_ = d.Modify(true, false, nil)
 	} else {
 		d.SettleAs(Released)
 	}
 }
 
+// Modify settles a delivery with the modified outcome.
+//
+// If deliveryFailed is true the delivery count for the message will be
+// increased. If undeliverable is true the message should not be redelivered
+// to this link. If annotations is not nil, they are merged with the message
+// annotations when the message is redelivered.
+//
+// Returns an error, without settling, if annotations cannot be encoded.
+func (d Delivery) Modify(deliveryFailed, undeliverable bool, annotations amqp.Map) error {
+	local := d.Local()
+	if annotations != nil {
+		if err := local.Annotations().Marshal(annotations); err != nil {
+			return err
+		}
+	}
+	local.SetFailed(deliveryFailed)
+	local.SetUndeliverable(undeliverable)
+	d.SettleAs(Modified)
+	return nil
+}
+
 type DeliveryTag struct{ pn C.pn_delivery_tag_t }
 
 func (t DeliveryTag) String() string { return C.GoStringN(t.pn.start, C.int(t.pn.size)) }
 
+// Bytes returns a copy of the tag bytes.
+func (t DeliveryTag) Bytes() []byte { return C.GoBytes(unsafe.Pointer(t.pn.start), C.int(t.pn.size)) }
+
+// UnsettledDeliveries returns the deliveries on the link that have not been
+// settled locally, oldest first. Link.Unsettled() returns the number of them.
+//
+// Use Delivery.Tag(), Delivery.Local() and Delivery.Remote() to decide what to
+// do with each delivery, e.g. when recovering a link.
+func (l Link) UnsettledDeliveries() (deliveries []Delivery) {
+	for d := C.pn_unsettled_head(l.pn); d != nil; d = C.pn_unsettled_next(d) {
+		deliveries = append(deliveries, Delivery{d})
+	}
+	return deliveries
+}
+
 func (l Link) Recv(buf []byte) int {
 	if len(buf) == 0 {
 		return 0
@@ -267,6 +429,12 @@ func (l Link) Delivery(tag string) Delivery {
 
 func (l Link) Connection() Connection { return l.Session().Connection() }
 
+// Note: there is no Link.Properties() or Link.RemoteProperties(). The proton-C
+// engine does not send or decode the properties field of the AMQP attach
+// frame, so link properties cannot be set or read. Use terminus capabilities
+// (Terminus.Capabilities()) or connection properties (Connection.Properties())
+// instead.
+
 // Human-readable link description including name, source, target and direction.
 func (l Link) String() string {
 	switch {
@@ -287,11 +455,88 @@ func (l Link) Type() string {
 	}
 }
 
+// DistributionMode calls pn_terminus_get_distribution_mode(), it is not
+// generated because the C function takes a const terminus pointer.
+func (t Terminus) DistributionMode() DistributionMode {
+	return DistributionMode(C.pn_terminus_get_distribution_mode(t.pn))
+}
+
+// ClearAddress removes the address of a terminus, so it has no address rather
+// than an empty one. A sender with no target address is used with an
+// anonymous relay, which routes each message by its "to" address.
+func (t Terminus) ClearAddress() {
+	C.pn_terminus_set_address(t.pn, nil)
+}
+
+// HasAddress returns false if the terminus has no address, see ClearAddress().
+func (t Terminus) HasAddress() bool {
+	return C.pn_terminus_get_address(t.pn) != nil
+}
+
+// SetFilter adds a named filter to the filter-set of a source terminus, call
+// before the link is opened. The filter is encoded as an AMQP described value
+// with the given descriptor, which is normally an amqp.Symbol or uint64. For
+// example a JMS selector:
+//
+//	t.SetFilter("selector", amqp.Symbol("apache.org:selector-filter:string"), "color = 'red'")
+func (t Terminus) SetFilter(name string, descriptor interface{}, value interface{}) error {
+	filters := amqp.Map{}
+	if f := t.Filter(); !f.Empty() {
+		if err := f.Unmarshal(&filters); err != nil {
+			return err
+		}
+	}
+	filters[amqp.Symbol(name)] = amqp.Described{Descriptor: descriptor, Value: value}
+	return t.Filter().Marshal(filters)
+}
+
 // IsDrain calls pn_link_get_drain(), it conflicts with pn_link_drain() under the normal mapping.
 func (l Link) IsDrain() bool {
 	return bool(C.pn_link_get_drain(l.pn))
 }
 
+// Flow issues credit to a receiving link, allowing the sender to send credit
+// more messages. Returns an error if the link is not a receiver or credit is
+// negative.
+func (l Link) Flow(credit int) error {
+	if err := l.checkCredit(credit); err != nil {
+		return err
+	}
+	C.pn_link_flow(l.pn, C.int(credit))
+	return nil
+}
+
+// Drain is like Flow but also asks the sender to use up all the link credit
+// by sending messages or advancing the delivery count. The link is Draining()
+// until the sender has done so.
+func (l Link) Drain(credit int) error {
+	if err := l.checkCredit(credit); err != nil {
+		return err
+	}
+	C.pn_link_drain(l.pn, C.int(credit))
+	C.go_link_set_drain_pending(l.pn, true)
+	return nil
+}
+
+// drainDone is true once for each Drain(), when the sender has finished draining.
+func (l Link) drainDone() bool {
+	if bool(C.go_link_drain_pending(l.pn)) && l.IsDrain() && !l.Draining() {
+		C.go_link_set_drain_pending(l.pn, false)
+		return true
+	}
+	return false
+}
+
+func (l Link) checkCredit(credit int) error {
+	switch {
+	case !l.IsReceiver():
+		return fmt.Errorf("cannot issue credit on sending link %s", l)
+	case credit < 0:
+		return fmt.Errorf("invalid credit %v on link %s", credit, l)
+	}
+	return nil
+}
+
 func cPtr(b []byte) *C.char {
 	if len(b) == 0 {
 		return nil
@@ -339,6 +584,7 @@ func (c Connection) SessionHead(s State) Session {
 	return Session{C.pn_session_head(c.pn, C.pn_state_t(s))}
 }
 
+// Links returns the links of the connection that match state, see Session.Links().
 func (c Connection) Links(state State) (links []Link) {
 	for l := c.LinkHead(state); !l.IsNil(); l = l.Next(state) {
 		links = append(links, l)
@@ -346,6 +592,8 @@ func (c Connection) Links(state State) (links []Link) {
 	return
 }
 
+// Sessions returns the sessions of the connection that match state, state 0
+// matches all sessions.
 func (c Connection) Sessions(state State) (sessions []Session) {
 	for s := c.SessionHead(state); !s.IsNil(); s = s.Next(state) {
 		sessions = append(sessions, s)
@@ -353,6 +601,38 @@ func (c Connection) Sessions(state State) (sessions []Session) {
 	return
 }
 
+// Links returns the links of the session that match state, for example
+// SLocalActive|SRemoteActive for links that are open at both ends. State 0
+// matches all links.
+func (s Session) Links(state State) (links []Link) {
+	for l := s.Connection().LinkHead(state); !l.IsNil(); l = l.Next(state) {
+		if l.Session() == s {
+			links = append(links, l)
+		}
+	}
+	return
+}
+
+// Senders is like Links but only returns sending links.
+func (s Session) Senders(state State) (links []Link) {
+	for _, l := range s.Links(state) {
+		if l.IsSender() {
+			links = append(links, l)
+		}
+	}
+	return
+}
+
+// Receivers is like Links but only returns receiving links.
+func (s Session) Receivers(state State) (links []Link) {
+	for _, l := range s.Links(state) {
+		if l.IsReceiver() {
+			links = append(links, l)
+		}
+	}
+	return
+}
+
 // SetPassword takes []byte not string because it is impossible to erase a string
 // from memory reliably. Proton will not keep the password in memory longer than
 // needed, the caller should overwrite their copy on return.
@@ -371,21 +651,33 @@ func (s Session) String() string {
 
 func (s Session) Type() string { return "session" }
 
-// Error returns an instance of amqp.Error or nil.
+// Error returns an instance of amqp.Error or nil. The Info field is set if the
+// condition has a non-empty info map.
 func (c Condition) Error() error {
 	if c.IsNil() || !c.IsSet() {
 		return nil
 	}
-	return amqp.Error{Name: c.Name(), Description: c.Description()}
+	err := amqp.Error{Name: c.Name(), Description: c.Description()}
+	var info amqp.Map
+	if c.Info().Unmarshal(&info) == nil && len(info) > 0 {
+		err.Info = info
+	}
+	return err
 }
 
 // Set a Go error into a condition.
 // If it is not an amqp.Condition use the error type as name, error string as description.
+// The Info map of an amqp.Error is dropped if it cannot be encoded.
 func (c Condition) SetError(err error) {
 	if err != nil {
 		if cond, ok := err.(amqp.Error); ok {
 			c.SetName(cond.Name)
 			c.SetDescription(cond.Description)
+			if len(cond.Info) > 0 {
+				if err := c.Info().Marshal(cond.Info); err != nil {
+					c.Info().Clear()
+				}
+			}
 		} else {
 			c.SetName(reflect.TypeOf(err).Name())
 			c.SetDescription(err.Error())
@@ -444,7 +736,83 @@ func (t Transport) Push(bytes []byte) int {
 	return int(C.pn_transport_push(t.pn, (*C.char)(unsafe.Pointer(&bytes[0])), C.size_t(len(bytes))))
 }
 
-// Get the SASL object for the transport.
+// MaxFrameSize is the largest frame this end will accept, 0 means no limit.
+func (t Transport) MaxFrameSize() uint32 {
+	return uint32(C.pn_transport_get_max_frame(t.pn))
+}
+
+// SetMaxFrameSize sets the largest frame this end will accept, 0 means no limit.
+// The size is sent to the peer in the AMQP open, so it must be set before the
+// connection is opened. Returns an error if the connection is already open.
+func (t Transport) SetMaxFrameSize(size uint32) error {
+	if c := t.Connection(); !c.IsNil() && !c.State().LocalUninit() {
+		return fmt.Errorf("cannot set max frame size after connection is opened")
+	}
+	C.pn_transport_set_max_frame(t.pn, C.uint32_t(size))
+	return nil
+}
+
+// RemoteMaxFrameSize is the largest frame the remote peer will accept, 0 means
+// no limit. Only valid once the remote open has been received.
+func (t Transport) RemoteMaxFrameSize() uint32 {
+	return uint32(C.pn_transport_get_remote_max_frame(t.pn))
+}
+
+// SetChannelMax sets the highest channel number, which limits the number of
+// sessions on the connection. The connection must be bound to a transport, for
+// an Engine that means calling it in the engine goroutine. Returns an error if
+// the connection is already open.
+func (c Connection) SetChannelMax(channelMax uint16) error {
+	t := c.Transport()
+	if t.IsNil() {
+		return fmt.Errorf("cannot set channel max, connection has no transport")
+	}
+	if !c.State().LocalUninit() || t.SetChannelMax(channelMax) != 0 {
+		return fmt.Errorf("cannot set channel max after connection is opened")
+	}
+	return nil
+}
+
+// RemoteChannelMax is the highest channel number the remote peer allows, only
+// valid once the remote open has been received.
+func (c Connection) RemoteChannelMax() uint16 {
+	if t := c.Transport(); !t.IsNil() {
+		return t.RemoteChannelMax()
+	}
+	return 0
+}
+
+// SetProperties sets the connection properties sent to the remote peer, call it
+// before the connection is opened. Returns an error if properties cannot be
+// encoded. Use RemoteProperties().Unmarshal() to read the remote peer's
+// properties, and RemoteOfferedCapabilities().Symbols() for its capabilities.
+func (c Connection) SetProperties(properties amqp.Map) error {
+	if len(properties) == 0 {
+		c.Properties().Clear()
+		return nil
+	}
+	return c.Properties().Marshal(properties)
+}
+
+// SetOfferedCapabilities sets the capabilities this connection offers to the
+// remote peer, call it before the connection is opened.
+func (c Connection) SetOfferedCapabilities(capabilities []amqp.Symbol) {
+	c.OfferedCapabilities().SetSymbols(capabilities)
+}
+
+// SetDesiredCapabilities sets the capabilities this connection would like the
+// remote peer to offer, call it before the connection is opened.
+func (c Connection) SetDesiredCapabilities(capabilities []amqp.Symbol) {
+	c.DesiredCapabilities().SetSymbols(capabilities)
+}
+
+// Get the SASL object for the transport, enabling SASL if it is not already.
+//
+// Configure SASL with AllowedMechs() and SetAllowInsecureMechs() before the
+// engine starts running. By default mechanisms that send clear-text passwords,
+// such as PLAIN, are refused over an unencrypted connection. Once the
+// connection is open use Outcome(), Mech() and User() to check the result.
+// The client password is set with Connection.SetPassword().
 func (t Transport) SASL() SASL {
 	return SASL{C.pn_sasl(t.pn)}
 }
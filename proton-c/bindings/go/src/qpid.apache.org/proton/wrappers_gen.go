@@ -342,18 +342,21 @@ func (l Link) Unsettled() int {
 func (l Link) Offered(credit int) {
 	C.pn_link_offered(l.pn, C.int(credit))
 }
-func (l Link) Flow(credit int) {
-	C.pn_link_flow(l.pn, C.int(credit))
-}
-func (l Link) Drain(credit int) {
-	C.pn_link_drain(l.pn, C.int(credit))
-}
 func (l Link) SetDrain(drain bool) {
 	C.pn_link_set_drain(l.pn, C.bool(drain))
 }
 func (l Link) Draining() bool {
 	return bool(C.pn_link_draining(l.pn))
 }
+func (l Link) MaxMessageSize() uint64 {
+	return uint64(C.pn_link_max_message_size(l.pn))
+}
+func (l Link) SetMaxMessageSize(size uint64) {
+	C.pn_link_set_max_message_size(l.pn, C.uint64_t(size))
+}
+func (l Link) RemoteMaxMessageSize() uint64 {
+	return uint64(C.pn_link_remote_max_message_size(l.pn))
+}
 
 // Wrappers for declarations in delivery.h
 
@@ -431,10 +434,10 @@ func (d Disposition) Condition() Condition {
 func (d Disposition) Data() Data {
 	return Data{C.pn_disposition_data(d.pn)}
 }
-func (d Disposition) SectionNumber() uint16 {
-	return uint16(C.pn_disposition_get_section_number(d.pn))
+func (d Disposition) SectionNumber() uint32 {
+	return uint32(C.pn_disposition_get_section_number(d.pn))
 }
-func (d Disposition) SetSectionNumber(section_number uint16) {
+func (d Disposition) SetSectionNumber(section_number uint32) {
 	C.pn_disposition_set_section_number(d.pn, C.uint32_t(section_number))
 }
 func (d Disposition) SectionOffset() uint64 {
@@ -789,23 +792,14 @@ func (t Transport) Log(message string) {
 
 	C.pn_transport_log(t.pn, messageC)
 }
-func (t Transport) ChannelMax() uint32 {
-	return uint32(C.pn_transport_get_channel_max(t.pn))
+func (t Transport) ChannelMax() uint16 {
+	return uint16(C.pn_transport_get_channel_max(t.pn))
 }
-func (t Transport) SetChannelMax(channel_max uint32) int {
+func (t Transport) SetChannelMax(channel_max uint16) int {
 	return int(C.pn_transport_set_channel_max(t.pn, C.uint16_t(channel_max)))
 }
-func (t Transport) RemoteChannelMax() uint32 {
-	return uint32(C.pn_transport_remote_channel_max(t.pn))
-}
-func (t Transport) MaxFrame() uint16 {
-	return uint16(C.pn_transport_get_max_frame(t.pn))
-}
-func (t Transport) SetMaxFrame(size uint16) {
-	C.pn_transport_set_max_frame(t.pn, C.uint32_t(size))
-}
-func (t Transport) RemoteMaxFrame() uint16 {
-	return uint16(C.pn_transport_get_remote_max_frame(t.pn))
+func (t Transport) RemoteChannelMax() uint16 {
+	return uint16(C.pn_transport_remote_channel_max(t.pn))
 }
 func (t Transport) IdleTimeout() time.Duration {
 	return (time.Duration(C.pn_transport_get_idle_timeout(t.pn)) * time.Millisecond)